@@ -1,15 +1,28 @@
 package tris
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	zmq "github.com/alecthomas/gozmq"
 	"github.com/fvbock/tris/server"
+	"io"
 	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	VERSION = "0.0.2"
+
+	// max nr of keys sent in one MADD/MDEL/MHAS request
+	BULK_CHUNK_SIZE = 1000
+	// nr of file bytes sent base64 encoded in one UPLOAD request
+	UPLOAD_CHUNK_SIZE = 48 * 1024
+	// first wait before a rate limited command is retried
+	RATE_LIMIT_BACKOFF = 100 * time.Millisecond
 )
 
 /*
@@ -19,6 +32,44 @@ type DSN struct {
 	Protocol string
 	Host     string
 	Port     int
+	// credentials sent with AUTH on Dial if User is set
+	User   string
+	Secret string
+	// z85 CURVE public key of the server. enables CURVE encryption.
+	// PublicKey and SecretKey are generated on Dial if not set
+	ServerKey string
+	PublicKey string
+	SecretKey string
+	// used with the protocol "tls". without TLSCAFile the system roots
+	// are used. TLSCertFile and TLSKeyFile are the client certificate
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+/*
+ParseDSN parses "[user:secret@]protocol:host:port".
+*/
+func ParseDSN(dsnString string) (dsn *DSN, err error) {
+	dsn = &DSN{}
+	if at := strings.LastIndex(dsnString, "@"); at >= 0 {
+		creds := strings.SplitN(dsnString[:at], ":", 2)
+		dsn.User = creds[0]
+		if len(creds) == 2 {
+			dsn.Secret = creds[1]
+		}
+		dsnString = dsnString[at+1:]
+	}
+	parts := strings.Split(dsnString, ":")
+	if len(parts) != 3 {
+		return nil, errors.New(fmt.Sprintf("Invalid DSN %s. Expected [user:secret@]protocol:host:port", dsnString))
+	}
+	port, err := strconv.ParseInt(parts[2], 10, 32)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid port in DSN: %v", err))
+	}
+	dsn.Protocol, dsn.Host, dsn.Port = parts[0], parts[1], int(port)
+	return
 }
 
 // type ClientCommand interface{
@@ -33,8 +84,16 @@ type Client struct {
 	Context   *zmq.Context
 	Socket    *zmq.Socket
 	connected bool
+	// local end of the tunnel for protocol "tls"
+	tunnel    net.Listener
 	ActiveDb  string
 	SessionId string
+	// how often a command rejected by a rate limit is retried, waiting
+	// twice as long every time starting with RATE_LIMIT_BACKOFF
+	RateLimitRetries int
+	// send and receive timeout set on Dial. 0 waits forever. after a
+	// timeout the client has to be closed
+	Timeout time.Duration
 	// Commands map[string]ClientCommand
 }
 
@@ -62,8 +121,68 @@ func (c *Client) Dial() (err error) {
 		return
 	}
 	c.Socket.SetSockOptInt(zmq.LINGER, 0)
-	c.Socket.Connect(fmt.Sprintf("%v://%v:%v", c.Dsn.Protocol, c.Dsn.Host, c.Dsn.Port))
+	if c.Timeout > 0 {
+		c.Socket.SetSockOptInt(zmq.RCVTIMEO, int(c.Timeout/time.Millisecond))
+		c.Socket.SetSockOptInt(zmq.SNDTIMEO, int(c.Timeout/time.Millisecond))
+	}
+	if c.Dsn.ServerKey != "" {
+		err = c.setupCurve()
+		if err != nil {
+			c.Socket.Close()
+			return
+		}
+	}
+	endpoint := fmt.Sprintf("%v://%v:%v", c.Dsn.Protocol, c.Dsn.Host, c.Dsn.Port)
+	if c.Dsn.Protocol == PROTOCOL_TLS {
+		endpoint, err = c.startTunnel()
+		if err != nil {
+			c.Socket.Close()
+			return
+		}
+	}
+	c.Socket.Connect(endpoint)
 	c.connected = true
+	err = c.hello()
+	if err == nil && c.Dsn.User != "" {
+		err = c.Auth(c.Dsn.User, c.Dsn.Secret)
+	}
+	if err != nil {
+		c.Socket.Close()
+		c.closeTunnel()
+		c.connected = false
+	}
+	return
+}
+
+/*
+hello asks for the reply protocol this client reads, so member listings
+carry the value rows.
+*/
+func (c *Client) hello() (err error) {
+	r, err := c.Send(fmt.Sprintf("%s %d", (&tris.CommandHello{}).Name(), tris.PROTOCOL_VERSION))
+	if err != nil {
+		return
+	}
+	response := tris.Unserialize(r)
+	if response.ReturnCode != tris.COMMAND_OK {
+		err = errors.New(fmt.Sprintf("HELLO failed: %s", response.Payload[0]))
+	}
+	return
+}
+
+/*
+Auth authenticates the connection. it does not go through exec so the
+secret does not end up in the log of failed commands.
+*/
+func (c *Client) Auth(user string, secret string) (err error) {
+	r, err := c.Send(fmt.Sprintf("%s %s %s", (&tris.CommandAuth{}).Name(), user, secret))
+	if err != nil {
+		return
+	}
+	response := tris.Unserialize(r)
+	if response.ReturnCode != tris.COMMAND_OK {
+		err = errors.New(fmt.Sprintf("AUTH failed: %s", response.Payload[0]))
+	}
 	return
 }
 
@@ -75,6 +194,7 @@ func (c *Client) Close() {
 	if c.connected {
 		c.Socket.Close()
 	}
+	c.closeTunnel()
 	c.connected = false
 	return
 }
@@ -89,17 +209,39 @@ func (c *Client) Send(msg string) (response []byte, err error) {
 	return
 }
 
+/*
+Raw sends msg as it is and unserializes the response. it can be used for
+commands without a Client method like database qualified ones (HAS@db).
+*/
+func (c *Client) Raw(msg string) (response *tris.Reply, err error) {
+	r, err := c.Send(msg)
+	if err != nil {
+		return
+	}
+	response = tris.Unserialize(r)
+	return
+}
+
 // func (c *Client) exec(cmd tris.Command, args ...string) {
 func (c *Client) exec(cmd tris.Command, args ...string) (response *tris.Reply, err error) {
 	msg := cmd.Name()
 	for _, arg := range args {
 		msg += " " + arg
 	}
-	r, err := c.Send(msg)
-	if err != nil {
-		fmt.Println("Error:", err)
+	backoff := RATE_LIMIT_BACKOFF
+	for retry := 0; ; retry++ {
+		var r []byte
+		r, err = c.Send(msg)
+		if err != nil {
+			fmt.Println("Error:", err)
+		}
+		response = tris.Unserialize(r)
+		if response.ReturnCode != tris.COMMAND_RATE_LIMITED || retry >= c.RateLimitRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	response = tris.Unserialize(r)
 	if response.ReturnCode != tris.COMMAND_OK {
 		log.Printf("FAILED:\ncmd: %s\nargs: %v\nresponse: %v\n", cmd, args, response)
 	} else {
@@ -109,6 +251,51 @@ func (c *Client) exec(cmd tris.Command, args ...string) (response *tris.Reply, e
 	return
 }
 
+func (c *Client) ClientList() (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandClient{}, "LIST")
+	return
+}
+
+func (c *Client) AclList() (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandACL{}, "LIST")
+	return
+}
+
+func (c *Client) AclSetUser(user string, flags []string, dbPatterns []string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandACL{}, "SETUSER", user, strings.Join(flags, ","), strings.Join(dbPatterns, ","))
+	return
+}
+
+func (c *Client) AclDelUser(user string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandACL{}, "DELUSER", user)
+	return
+}
+
+func (c *Client) Hello() (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandHello{})
+	return
+}
+
+func (c *Client) Ready() (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandReady{})
+	return
+}
+
+func (c *Client) Role() (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandRole{})
+	return
+}
+
+func (c *Client) ReplicaOf(host string, port int) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandReplicaOf{}, host, strconv.Itoa(port))
+	return
+}
+
+func (c *Client) ReplicaOfNoOne() (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandReplicaOf{}, "NO", "ONE")
+	return
+}
+
 func (c *Client) Ping() (r *tris.Reply, err error) {
 	r, err = c.exec(&tris.CommandPing{})
 	if r.ReturnCode != tris.COMMAND_OK || err != nil {
@@ -119,10 +306,9 @@ func (c *Client) Ping() (r *tris.Reply, err error) {
 
 func (c *Client) Select(dbname string) (r *tris.Reply, err error) {
 	r, err = c.exec(&tris.CommandSelect{}, dbname)
-	if r.ReturnCode != tris.COMMAND_OK || err != nil {
-		// TODO
+	if err == nil && r.ReturnCode == tris.COMMAND_OK {
+		c.ActiveDb = dbname
 	}
-	c.ActiveDb = dbname
 	return
 }
 
@@ -143,18 +329,57 @@ func (c *Client) Save() (r *tris.Reply, err error) {
 	return
 }
 
-func (c *Client) ImportDb(fname string, dbname string) (r *tris.Reply, err error) {
-	r, err = c.exec(&tris.CommandImportDb{}, fname, dbname)
+func (c *Client) ImportDb(fname string, dbname string, options ...string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandImportDb{}, append([]string{fname, dbname}, options...)...)
 	return
 }
 
-func (c *Client) MergeDb(fname string) (r *tris.Reply, err error) {
-	r, err = c.exec(&tris.CommandMergeDb{}, fname)
+func (c *Client) MergeDb(fname string, options ...string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandMergeDb{}, append([]string{fname}, options...)...)
+	return
+}
+
+func (c *Client) BulkLoad(fname string, options ...string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandBulkLoad{}, append([]string{fname}, options...)...)
+	return
+}
+
+/*
+Upload sends the contents of r to the server in chunks. IMPORT, MERGE and
+BULKLOAD sent with c can then read it as upload:name. the last reply
+carries the size of the upload. the server removes the uploads of c when
+it is closed or left idle.
+*/
+func (c *Client) Upload(name string, r io.Reader) (response *tris.Reply, err error) {
+	buf := make([]byte, UPLOAD_CHUNK_SIZE)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			response, err = c.exec(&tris.CommandUpload{}, name, base64.StdEncoding.EncodeToString(buf[:n]))
+			if err != nil || response.ReturnCode != tris.COMMAND_OK {
+				return
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return response, rerr
+		}
+	}
+	if response == nil {
+		err = errors.New("Nothing to upload")
+	}
 	return
 }
 
-func (c *Client) Create(dbname string) (r *tris.Reply, err error) {
-	r, err = c.exec(&tris.CommandCreateTrie{}, dbname)
+func (c *Client) ExportDb(fname string, options ...string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandExportDb{}, append([]string{fname}, options...)...)
+	return
+}
+
+func (c *Client) Create(dbname string, options ...string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandCreateTrie{}, append([]string{dbname}, options...)...)
 	return
 }
 
@@ -168,28 +393,214 @@ func (c *Client) Del(key string) (r *tris.Reply, err error) {
 	return
 }
 
+func (c *Client) MAdd(keys []string) (r *tris.Reply, err error) {
+	r, err = c.execChunked(&tris.CommandMAdd{}, keys)
+	return
+}
+
+func (c *Client) MDel(keys []string) (r *tris.Reply, err error) {
+	r, err = c.execChunked(&tris.CommandMDel{}, keys)
+	return
+}
+
+func (c *Client) MHas(keys []string) (r *tris.Reply, err error) {
+	r, err = c.execChunked(&tris.CommandMHas{}, keys)
+	return
+}
+
+/*
+execChunked sends the keys in chunks of BULK_CHUNK_SIZE and joins the
+reply rows of all chunks into one reply. it stops at the first failing
+chunk and returns its reply.
+*/
+func (c *Client) execChunked(cmd tris.Command, keys []string) (r *tris.Reply, err error) {
+	if len(keys) == 0 {
+		return c.exec(cmd)
+	}
+	for start := 0; start < len(keys); start += BULK_CHUNK_SIZE {
+		end := start + BULK_CHUNK_SIZE
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var chunkReply *tris.Reply
+		chunkReply, err = c.exec(cmd, keys[start:end]...)
+		if err != nil || chunkReply.ReturnCode != tris.COMMAND_OK {
+			return chunkReply, err
+		}
+		if r == nil {
+			r = chunkReply
+		} else {
+			r.Payload = append(r.Payload, chunkReply.Payload...)
+		}
+	}
+	return
+}
+
 func (c *Client) Has(key string) (r *tris.Reply, err error) {
 	r, err = c.exec(&tris.CommandHas{}, key)
 	return
 }
 
+/*
+HasIn checks key in all dbs. merge combines the per db results into one.
+*/
+func (c *Client) HasIn(key string, dbs []string, merge bool) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandHas{}, inArgs([]string{key}, dbs, merge)...)
+	return
+}
+
+func (c *Client) HasCountIn(key string, dbs []string, merge bool) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandHasCount{}, inArgs([]string{key}, dbs, merge)...)
+	return
+}
+
 func (c *Client) HasCount(key string) (r *tris.Reply, err error) {
 	r, err = c.exec(&tris.CommandHasCount{}, key)
 	return
 }
 
+func (c *Client) GetCount(key string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandGetCount{}, key)
+	return
+}
+
+func (c *Client) IncrBy(key string, n int64) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandIncrBy{}, key, strconv.FormatInt(n, 10))
+	return
+}
+
+func (c *Client) SetCount(key string, n int64) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandSetCount{}, key, strconv.FormatInt(n, 10))
+	return
+}
+
 func (c *Client) HasPrefix(key string) (r *tris.Reply, err error) {
 	r, err = c.exec(&tris.CommandHasPrefix{}, key)
 	return
 }
 
-func (c *Client) Members() (r *tris.Reply, err error) {
-	r, err = c.exec(&tris.CommandMembers{})
+func (c *Client) DelPrefix(prefix string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandDelPrefix{}, prefix)
+	return
+}
+
+func (c *Client) CountPrefix(prefix string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandCountPrefix{}, prefix)
 	return
 }
 
-func (c *Client) PrefixMembers(key string) (r *tris.Reply, err error) {
-	r, err = c.exec(&tris.CommandPrefixMembers{}, key)
+func (c *Client) Set(key string, value string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandSet{}, key, value)
+	return
+}
+
+func (c *Client) Get(key string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandGet{}, key)
+	return
+}
+
+func (c *Client) PrefixGet(prefix string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandPrefixGet{}, prefix)
+	return
+}
+
+func (c *Client) AddEx(key string, seconds int64) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandAddEx{}, key, strconv.FormatInt(seconds, 10))
+	return
+}
+
+func (c *Client) Expire(key string, seconds int64) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandExpire{}, key, strconv.FormatInt(seconds, 10))
+	return
+}
+
+func (c *Client) TTL(key string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandTTL{}, key)
+	return
+}
+
+func (c *Client) Persist(key string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandPersistKey{}, key)
+	return
+}
+
+func (c *Client) Members(options ...string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandMembers{}, options...)
+	return
+}
+
+func (c *Client) PrefixMembers(key string, options ...string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandPrefixMembers{}, append([]string{key}, options...)...)
+	return
+}
+
+func (c *Client) SuffixMembers(suffix string, options ...string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandSuffixMembers{}, append([]string{suffix}, options...)...)
+	return
+}
+
+func (c *Client) Contains(sub string, options ...string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandContains{}, append([]string{sub}, options...)...)
+	return
+}
+
+func (c *Client) LongestPrefix(input string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandLongestPrefix{}, input)
+	return
+}
+
+func (c *Client) AllPrefixes(input string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandAllPrefixes{}, input)
+	return
+}
+
+func (c *Client) PrefixMembersIn(key string, dbs []string, merge bool) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandPrefixMembers{}, inArgs([]string{key}, dbs, merge)...)
+	return
+}
+
+func (c *Client) Union(srcs []string, combine string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandUnion{}, setOpArgs(srcs, combine)...)
+	return
+}
+
+func (c *Client) UnionStore(dst string, srcs []string, combine string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandUnionStore{}, setOpArgs(append([]string{dst}, srcs...), combine)...)
+	return
+}
+
+func (c *Client) Intersect(srcs []string, combine string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandIntersect{}, setOpArgs(srcs, combine)...)
+	return
+}
+
+func (c *Client) IntersectStore(dst string, srcs []string, combine string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandIntersectStore{}, setOpArgs(append([]string{dst}, srcs...), combine)...)
+	return
+}
+
+func (c *Client) Diff(srcs []string, combine string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandDiff{}, setOpArgs(srcs, combine)...)
+	return
+}
+
+func (c *Client) DiffStore(dst string, srcs []string, combine string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandDiffStore{}, setOpArgs(append([]string{dst}, srcs...), combine)...)
+	return
+}
+
+func (c *Client) CopyDb(src string, dst string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandCopyDb{}, src, dst)
+	return
+}
+
+func (c *Client) RenameDb(src string, dst string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandRenameDb{}, src, dst)
+	return
+}
+
+func (c *Client) SwapDb(a string, b string) (r *tris.Reply, err error) {
+	r, err = c.exec(&tris.CommandSwapDb{}, a, b)
 	return
 }
 
@@ -209,3 +620,18 @@ func (c *Client) Help(key string) (r *tris.Reply, err error) {
 	r, err = c.exec(&tris.CommandHelp{}, key)
 	return
 }
+
+func inArgs(args []string, dbs []string, merge bool) []string {
+	args = append(args, "IN", strings.Join(dbs, ","))
+	if merge {
+		args = append(args, "MERGE")
+	}
+	return args
+}
+
+func setOpArgs(args []string, combine string) []string {
+	if combine != "" {
+		args = append(args, "COMBINE", combine)
+	}
+	return args
+}
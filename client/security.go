@@ -0,0 +1,128 @@
+package tris
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/fvbock/tris/server"
+	trisutil "github.com/fvbock/tris/util"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DSN protocol for TLS connections
+	PROTOCOL_TLS = "tls"
+	// name of the unix socket of the TLS tunnel
+	TUNNEL_SOCKET = "tunnel.sock"
+)
+
+/*
+setupCurve enables CURVE encryption on the socket with the key pair of
+the DSN or a new one.
+*/
+func (c *Client) setupCurve() (err error) {
+	if err = tris.CheckCurveKey(c.Dsn.ServerKey); err != nil {
+		return errors.New(fmt.Sprintf("Invalid server key: %v", err))
+	}
+	public, secret := c.Dsn.PublicKey, c.Dsn.SecretKey
+	if public == "" || secret == "" {
+		public, secret, err = tris.GenerateCurveKeyPair()
+		if err != nil {
+			return
+		}
+	}
+	return tris.SetCurveClientKeys(c.Socket, c.Dsn.ServerKey, public, secret)
+}
+
+func (c *Client) tlsConfig() (config *tls.Config, err error) {
+	config = &tls.Config{
+		ServerName: c.Dsn.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.Dsn.TLSCAFile != "" {
+		config.RootCAs, err = tris.LoadCertPool(c.Dsn.TLSCAFile)
+		if err != nil {
+			return
+		}
+	}
+	if c.Dsn.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.Dsn.TLSCertFile, c.Dsn.TLSKeyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not load the client certificate: %v", err))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+/*
+startTunnel listens on a unix socket and forwards the connections of the
+zmq socket to the server over TLS. it returns the local endpoint. the
+socket is in a new directory only this user can enter, so no other user
+on the host can connect through the tunnel with the certificate of the
+client. the first TLS connection is made right away so certificate
+errors show up in Dial.
+*/
+func (c *Client) startTunnel() (endpoint string, err error) {
+	config, err := c.tlsConfig()
+	if err != nil {
+		return
+	}
+	addr := fmt.Sprintf("%v:%v", c.Dsn.Host, c.Dsn.Port)
+	first, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("TLS connection to %s failed: %v", addr, err))
+	}
+	// TempDir creates the directory with mode 0700
+	dir, err := ioutil.TempDir("", "tris-tunnel")
+	if err != nil {
+		first.Close()
+		return
+	}
+	c.tunnel, err = net.Listen("unix", filepath.Join(dir, TUNNEL_SOCKET))
+	if err != nil {
+		first.Close()
+		os.Remove(dir)
+		return
+	}
+	pending := make(chan net.Conn, 1)
+	pending <- first
+	go func(listener net.Listener) {
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				// closed by Close
+				return
+			}
+			var remote net.Conn
+			select {
+			case remote = <-pending:
+			default:
+				remote, err = tls.Dial("tcp", addr, config)
+				if err != nil {
+					local.Close()
+					continue
+				}
+			}
+			go trisutil.Pipe(local, remote)
+		}
+	}(c.tunnel)
+	return "ipc://" + c.tunnel.Addr().String(), nil
+}
+
+/*
+closeTunnel stops the tunnel and removes its directory.
+*/
+func (c *Client) closeTunnel() {
+	if c.tunnel == nil {
+		return
+	}
+	dir := filepath.Dir(c.tunnel.Addr().String())
+	// closing a unix listener removes the socket file
+	c.tunnel.Close()
+	os.Remove(dir)
+	c.tunnel = nil
+}
@@ -0,0 +1,486 @@
+package tris
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fvbock/tris/server"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/*
+ShardedClient spreads the keys of a database over several servers. every
+shard is a TrisConnectionPool so it can be a primary with replicas. a
+ShardRule decides on which shard a key lives:
+
+	HashRule   FNV-1a hash of the key modulo the number of shards
+	RangeRule  sorted start keys. a shard holds the keys from its start
+	           up to the start of the next shard so keys with a long
+	           common prefix stay on one shard
+
+commands on one key go to its shard. MADD, MDEL and MHAS send each shard
+its keys and return the rows in the order of the keys. MEMBERS and the
+prefix commands ask all shards that can hold matching keys and merge the
+results. keys are routed in their normalized form, so the shards have to
+use the Normalization of the ShardedClient.
+
+moving keys when the rule changes is not handled.
+*/
+type ShardRule interface {
+	// the number of shards
+	Shards() int
+	// the shard of key
+	Shard(key string) int
+	// the shards that can hold keys starting with prefix
+	PrefixShards(prefix string) []int
+}
+
+type HashRule struct {
+	N int
+}
+
+func (r *HashRule) Shards() int { return r.N }
+
+func (r *HashRule) Shard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(r.N))
+}
+
+func (r *HashRule) PrefixShards(prefix string) []int {
+	return shardRange(0, r.N-1)
+}
+
+/*
+RangeRule assigns keys to shards by Starts, the sorted first keys of the
+shards. the first shard starts at the empty key.
+*/
+type RangeRule struct {
+	Starts []string
+}
+
+func NewRangeRule(starts []string) (r *RangeRule, err error) {
+	if len(starts) == 0 || starts[0] != "" {
+		return nil, errors.New("The first shard has to start at the empty key.")
+	}
+	for i := 1; i < len(starts); i++ {
+		if starts[i] <= starts[i-1] {
+			return nil, errors.New(fmt.Sprintf("Shard starts have to be sorted and unique: %q follows %q.", starts[i], starts[i-1]))
+		}
+	}
+	return &RangeRule{Starts: starts}, nil
+}
+
+func (r *RangeRule) Shards() int { return len(r.Starts) }
+
+func (r *RangeRule) Shard(key string) int {
+	return sort.Search(len(r.Starts), func(i int) bool { return r.Starts[i] > key }) - 1
+}
+
+func (r *RangeRule) PrefixShards(prefix string) []int {
+	last := len(r.Starts) - 1
+	if end, ok := prefixEnd(prefix); ok {
+		last = sort.Search(len(r.Starts), func(i int) bool { return r.Starts[i] >= end }) - 1
+	}
+	return shardRange(r.Shard(prefix), last)
+}
+
+/*
+prefixEnd returns the smallest key that is greater than all keys starting
+with prefix. there is none if prefix is empty or all 0xff bytes.
+*/
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+func shardRange(first int, last int) (shards []int) {
+	for i := first; i <= last; i++ {
+		shards = append(shards, i)
+	}
+	return
+}
+
+type ShardedClient struct {
+	Rule   ShardRule
+	Shards []*TrisConnectionPool
+	// the db selected on every shard. empty keeps the default db. SetDb
+	// also makes the shard pools keep it on their connections
+	Db string
+	// the Normalization of the sharded db, see tris.NormalizeKey
+	Normalization int
+}
+
+func NewShardedClient(rule ShardRule, shards []*TrisConnectionPool) (sc *ShardedClient, err error) {
+	if len(shards) == 0 {
+		return nil, errors.New("A ShardedClient needs at least one shard.")
+	}
+	if rule.Shards() != len(shards) {
+		return nil, errors.New(fmt.Sprintf("The rule has %v shards but %v pools are given.", rule.Shards(), len(shards)))
+	}
+	return &ShardedClient{Rule: rule, Shards: shards}, nil
+}
+
+/*
+SetDb selects db on every shard. the pools of the shards keep db on their
+connections, so commands do not select it again.
+*/
+func (sc *ShardedClient) SetDb(db string) {
+	sc.Db = db
+	for _, p := range sc.Shards {
+		p.Db = db
+	}
+}
+
+func (sc *ShardedClient) shard(key string) int {
+	return sc.Rule.Shard(tris.NormalizeKey(key, sc.Normalization))
+}
+
+/*
+exec runs fn on a connection of shard with Db selected.
+*/
+func (sc *ShardedClient) exec(shard int, write bool, fn func(c *Client) (*tris.Reply, error)) (*tris.Reply, error) {
+	return sc.Shards[shard].Exec(write, func(c *Client) (r *tris.Reply, err error) {
+		if sc.Db != "" && c.ActiveDb != sc.Db {
+			r, err = c.Select(sc.Db)
+			if err != nil || r.ReturnCode != tris.COMMAND_OK {
+				return
+			}
+		}
+		return fn(c)
+	})
+}
+
+/*
+scatter runs fn on all shards at once. it returns the replies in the
+order of shards, or the first reply that is not COMMAND_OK.
+*/
+func (sc *ShardedClient) scatter(shards []int, write bool, fn func(shard int, c *Client) (*tris.Reply, error)) (replies []*tris.Reply, failed *tris.Reply, err error) {
+	replies = make([]*tris.Reply, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard int) {
+			defer wg.Done()
+			replies[i], errs[i] = sc.exec(shard, write, func(c *Client) (*tris.Reply, error) {
+				return fn(shard, c)
+			})
+		}(i, shard)
+	}
+	wg.Wait()
+	for i, shard := range shards {
+		if errs[i] != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Shard %v failed: %v", shard, errs[i]))
+		}
+		if replies[i].ReturnCode != tris.COMMAND_OK {
+			return nil, replies[i], nil
+		}
+	}
+	return
+}
+
+func (sc *ShardedClient) onKey(key string, write bool, fn func(c *Client) (*tris.Reply, error)) (*tris.Reply, error) {
+	return sc.exec(sc.shard(key), write, fn)
+}
+
+/*
+onKeys sends every shard its part of keys and puts the reply rows back
+in the order of keys. the shards have to reply one row per key.
+*/
+func (sc *ShardedClient) onKeys(keys []string, write bool, fn func(c *Client, keys []string) (*tris.Reply, error)) (r *tris.Reply, err error) {
+	shardKeys := make([][]string, len(sc.Shards))
+	positions := make([][]int, len(sc.Shards))
+	for i, key := range keys {
+		shard := sc.shard(key)
+		shardKeys[shard] = append(shardKeys[shard], key)
+		positions[shard] = append(positions[shard], i)
+	}
+	var shards []int
+	for shard, part := range shardKeys {
+		if len(part) > 0 {
+			shards = append(shards, shard)
+		}
+	}
+	if len(shards) == 0 {
+		return sc.exec(0, write, func(c *Client) (*tris.Reply, error) { return fn(c, keys) })
+	}
+	replies, failed, err := sc.scatter(shards, write, func(shard int, c *Client) (*tris.Reply, error) {
+		return fn(c, shardKeys[shard])
+	})
+	if err != nil || failed != nil {
+		return failed, err
+	}
+	width := len(replies[0].Signature)
+	rows := make([][]byte, len(keys)*width)
+	for i, shard := range shards {
+		if len(replies[i].Payload) != len(positions[shard])*width {
+			return nil, errors.New(fmt.Sprintf("Shard %v replied %v fields for %v keys.", shard, len(replies[i].Payload), len(positions[shard])))
+		}
+		for j, pos := range positions[shard] {
+			copy(rows[pos*width:(pos+1)*width], replies[i].Payload[j*width:(j+1)*width])
+		}
+	}
+	r = replies[0]
+	r.Payload = rows
+	return
+}
+
+/*
+sumInts adds up the INT fields of single row replies.
+*/
+func sumInts(replies []*tris.Reply) *tris.Reply {
+	sums := make([]int64, len(replies[0].Payload))
+	for _, r := range replies {
+		for i := range sums {
+			if i < len(r.Payload) {
+				sums[i] += tris.DecodeIntPayload(r.Payload[i])
+			}
+		}
+	}
+	payload := make([][]byte, len(sums))
+	for i, sum := range sums {
+		payload[i] = tris.EncodeIntPayload(sum)
+	}
+	return tris.NewReply(payload, tris.COMMAND_OK, replies[0].Length, replies[0].Signature)
+}
+
+type shardMember struct {
+	key   []byte
+	nkey  string
+	count int64
+	value []byte
+	score []byte
+}
+
+type shardMembers struct {
+	members []*shardMember
+	sortBy  string
+}
+
+func (m *shardMembers) Len() int      { return len(m.members) }
+func (m *shardMembers) Swap(i, j int) { m.members[i], m.members[j] = m.members[j], m.members[i] }
+func (m *shardMembers) Less(i, j int) bool {
+	a, b := m.members[i], m.members[j]
+	switch m.sortBy {
+	case tris.SORT_BY_COUNT:
+		return a.count > b.count
+	case tris.SORT_BY_SCORE:
+		sa, _ := strconv.ParseFloat(string(a.score), 64)
+		sb, _ := strconv.ParseFloat(string(b.score), 64)
+		return sa > sb
+	}
+	return a.nkey < b.nkey
+}
+
+/*
+mergeMembers merges the key, count, value [, score] rows of member
+listings of several shards. keys found on more than one shard get the
+sum of their counts. the rows are sorted by key and then by sortBy. a
+reply that does not hold such rows is an error.
+*/
+func (sc *ShardedClient) mergeMembers(replies []*tris.Reply, sortBy string) (*tris.Reply, error) {
+	var merged []*shardMember
+	index := make(map[string]*shardMember)
+	for shard, r := range replies {
+		width := len(r.Signature)
+		if width < 3 {
+			return nil, errors.New(fmt.Sprintf("Shard %v replied %v fields per member, expected at least 3.", shard, width))
+		}
+		if len(r.Payload)%width != 0 {
+			return nil, errors.New(fmt.Sprintf("Shard %v replied %v fields, not a multiple of %v.", shard, len(r.Payload), width))
+		}
+		for i := 0; i+width <= len(r.Payload); i += width {
+			row := r.Payload[i : i+width]
+			nkey := tris.NormalizeKey(string(row[0]), sc.Normalization)
+			count := tris.DecodeIntPayload(row[1])
+			if m, exists := index[nkey]; exists {
+				m.count += count
+				continue
+			}
+			m := &shardMember{key: row[0], nkey: nkey, count: count, value: row[2]}
+			if width > 3 {
+				m.score = row[3]
+			}
+			index[nkey] = m
+			merged = append(merged, m)
+		}
+	}
+	sort.Sort(&shardMembers{members: merged})
+	if sortBy != "" {
+		sort.Stable(&shardMembers{members: merged, sortBy: sortBy})
+	}
+	signature := replies[0].Signature
+	for _, r := range replies {
+		if len(r.Signature) > len(signature) {
+			signature = r.Signature
+		}
+	}
+	var rows [][]byte
+	for _, m := range merged {
+		rows = append(rows, m.key, tris.EncodeIntPayload(m.count), m.value)
+		if len(signature) > 3 {
+			rows = append(rows, m.score)
+		}
+	}
+	return tris.NewReply(rows, tris.COMMAND_OK, int64(len(signature)), signature), nil
+}
+
+func sortArgs(sortBy string) []string {
+	if sortBy == "" {
+		return nil
+	}
+	return []string{"SORT", sortBy}
+}
+
+func (sc *ShardedClient) Add(key string) (r *tris.Reply, err error) {
+	return sc.onKey(key, true, func(c *Client) (*tris.Reply, error) { return c.Add(key) })
+}
+
+func (sc *ShardedClient) Del(key string) (r *tris.Reply, err error) {
+	return sc.onKey(key, true, func(c *Client) (*tris.Reply, error) { return c.Del(key) })
+}
+
+func (sc *ShardedClient) Has(key string) (r *tris.Reply, err error) {
+	return sc.onKey(key, false, func(c *Client) (*tris.Reply, error) { return c.Has(key) })
+}
+
+func (sc *ShardedClient) HasCount(key string) (r *tris.Reply, err error) {
+	return sc.onKey(key, false, func(c *Client) (*tris.Reply, error) { return c.HasCount(key) })
+}
+
+func (sc *ShardedClient) GetCount(key string) (r *tris.Reply, err error) {
+	return sc.onKey(key, false, func(c *Client) (*tris.Reply, error) { return c.GetCount(key) })
+}
+
+func (sc *ShardedClient) IncrBy(key string, n int64) (r *tris.Reply, err error) {
+	return sc.onKey(key, true, func(c *Client) (*tris.Reply, error) { return c.IncrBy(key, n) })
+}
+
+func (sc *ShardedClient) SetCount(key string, n int64) (r *tris.Reply, err error) {
+	return sc.onKey(key, true, func(c *Client) (*tris.Reply, error) { return c.SetCount(key, n) })
+}
+
+func (sc *ShardedClient) Set(key string, value string) (r *tris.Reply, err error) {
+	return sc.onKey(key, true, func(c *Client) (*tris.Reply, error) { return c.Set(key, value) })
+}
+
+func (sc *ShardedClient) Get(key string) (r *tris.Reply, err error) {
+	return sc.onKey(key, false, func(c *Client) (*tris.Reply, error) { return c.Get(key) })
+}
+
+func (sc *ShardedClient) AddEx(key string, seconds int64) (r *tris.Reply, err error) {
+	return sc.onKey(key, true, func(c *Client) (*tris.Reply, error) { return c.AddEx(key, seconds) })
+}
+
+func (sc *ShardedClient) Expire(key string, seconds int64) (r *tris.Reply, err error) {
+	return sc.onKey(key, true, func(c *Client) (*tris.Reply, error) { return c.Expire(key, seconds) })
+}
+
+func (sc *ShardedClient) TTL(key string) (r *tris.Reply, err error) {
+	return sc.onKey(key, false, func(c *Client) (*tris.Reply, error) { return c.TTL(key) })
+}
+
+func (sc *ShardedClient) Persist(key string) (r *tris.Reply, err error) {
+	return sc.onKey(key, true, func(c *Client) (*tris.Reply, error) { return c.Persist(key) })
+}
+
+func (sc *ShardedClient) MAdd(keys []string) (r *tris.Reply, err error) {
+	return sc.onKeys(keys, true, func(c *Client, keys []string) (*tris.Reply, error) { return c.MAdd(keys) })
+}
+
+func (sc *ShardedClient) MDel(keys []string) (r *tris.Reply, err error) {
+	return sc.onKeys(keys, true, func(c *Client, keys []string) (*tris.Reply, error) { return c.MDel(keys) })
+}
+
+func (sc *ShardedClient) MHas(keys []string) (r *tris.Reply, err error) {
+	return sc.onKeys(keys, false, func(c *Client, keys []string) (*tris.Reply, error) { return c.MHas(keys) })
+}
+
+/*
+HasPrefix replies the first shard that has a key under prefix, or the
+last one.
+*/
+func (sc *ShardedClient) HasPrefix(prefix string) (r *tris.Reply, err error) {
+	replies, failed, err := sc.scatter(sc.prefixShards(prefix), false, func(shard int, c *Client) (*tris.Reply, error) {
+		return c.HasPrefix(prefix)
+	})
+	if err != nil || failed != nil {
+		return failed, err
+	}
+	for _, r = range replies {
+		if len(r.Payload) > 0 && tris.DecodeIntPayload(r.Payload[0]) != 0 {
+			return
+		}
+	}
+	return
+}
+
+func (sc *ShardedClient) CountPrefix(prefix string) (r *tris.Reply, err error) {
+	replies, failed, err := sc.scatter(sc.prefixShards(prefix), false, func(shard int, c *Client) (*tris.Reply, error) {
+		return c.CountPrefix(prefix)
+	})
+	if err != nil || failed != nil {
+		return failed, err
+	}
+	return sumInts(replies), nil
+}
+
+func (sc *ShardedClient) DelPrefix(prefix string) (r *tris.Reply, err error) {
+	replies, failed, err := sc.scatter(sc.prefixShards(prefix), true, func(shard int, c *Client) (*tris.Reply, error) {
+		return c.DelPrefix(prefix)
+	})
+	if err != nil || failed != nil {
+		return failed, err
+	}
+	return sumInts(replies), nil
+}
+
+/*
+Members merges the members of all shards. sortBy is "",
+tris.SORT_BY_COUNT or tris.SORT_BY_SCORE.
+*/
+func (sc *ShardedClient) Members(sortBy string) (r *tris.Reply, err error) {
+	replies, failed, err := sc.scatter(shardRange(0, len(sc.Shards)-1), false, func(shard int, c *Client) (*tris.Reply, error) {
+		return c.Members(sortArgs(sortBy)...)
+	})
+	if err != nil || failed != nil {
+		return failed, err
+	}
+	return sc.mergeMembers(replies, sortBy)
+}
+
+/*
+PrefixMembers merges the members under prefix of the shards that can
+hold them.
+*/
+func (sc *ShardedClient) PrefixMembers(prefix string, sortBy string) (r *tris.Reply, err error) {
+	replies, failed, err := sc.scatter(sc.prefixShards(prefix), false, func(shard int, c *Client) (*tris.Reply, error) {
+		return c.PrefixMembers(prefix, sortArgs(sortBy)...)
+	})
+	if err != nil || failed != nil {
+		return failed, err
+	}
+	return sc.mergeMembers(replies, sortBy)
+}
+
+func (sc *ShardedClient) prefixShards(prefix string) []int {
+	return sc.Rule.PrefixShards(tris.NormalizeKey(prefix, sc.Normalization))
+}
+
+/*
+Close closes the pools of all shards.
+*/
+func (sc *ShardedClient) Close() {
+	for _, p := range sc.Shards {
+		p.Close()
+	}
+}
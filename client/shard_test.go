@@ -0,0 +1,170 @@
+package tris
+
+import (
+	"fmt"
+	"github.com/fvbock/tris/server"
+	"testing"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		end    string
+		ok     bool
+	}{
+		{"", "", false},
+		{"a", "b", true},
+		{"abc", "abd", true},
+		{"a\xff", "b", true},
+		{"a\xff\xff", "b", true},
+		{"\xff", "", false},
+		{"\xff\xff", "", false},
+	}
+	for _, tt := range tests {
+		end, ok := prefixEnd(tt.prefix)
+		if end != tt.end || ok != tt.ok {
+			t.Errorf("prefixEnd(%q) = %q, %v, want %q, %v", tt.prefix, end, ok, tt.end, tt.ok)
+		}
+	}
+}
+
+func TestRangeRulePrefixShards(t *testing.T) {
+	r, err := NewRangeRule([]string{"", "c", "f", "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix string
+		shards []int
+	}{
+		{"", []int{0, 1, 2, 3}},
+		{"a", []int{0}},
+		{"b", []int{0}},
+		{"c", []int{1}},
+		{"d", []int{1}},
+		{"f", []int{2, 3}},
+		{"fo", []int{2, 3}},
+		{"foo", []int{3}},
+		{"fop", []int{3}},
+		{"z", []int{3}},
+		{"\xff", []int{3}},
+	}
+	for _, tt := range tests {
+		shards := r.PrefixShards(tt.prefix)
+		if fmt.Sprint(shards) != fmt.Sprint(tt.shards) {
+			t.Errorf("PrefixShards(%q) = %v, want %v", tt.prefix, shards, tt.shards)
+		}
+	}
+}
+
+func TestNewRangeRule(t *testing.T) {
+	for _, starts := range [][]string{nil, {"a"}, {"", "b", "a"}, {"", "a", "a"}} {
+		if _, err := NewRangeRule(starts); err == nil {
+			t.Errorf("NewRangeRule(%q) did not fail", starts)
+		}
+	}
+}
+
+func membersReply(width int, rows ...string) *tris.Reply {
+	signature := []int{tris.REPLY_TYPE_STRING, tris.REPLY_TYPE_INT, tris.REPLY_TYPE_BYTES, tris.REPLY_TYPE_STRING}[:width]
+	var payload [][]byte
+	for i, f := range rows {
+		if i%width == 1 {
+			var n int64
+			fmt.Sscan(f, &n)
+			payload = append(payload, tris.EncodeIntPayload(n))
+			continue
+		}
+		payload = append(payload, []byte(f))
+	}
+	return tris.NewReply(payload, tris.COMMAND_OK, int64(width), signature)
+}
+
+func memberRowsString(r *tris.Reply) string {
+	width := len(r.Signature)
+	var s string
+	for i, f := range r.Payload {
+		if i%width == 1 {
+			s += fmt.Sprint(tris.DecodeIntPayload(f))
+		} else {
+			s += string(f)
+		}
+		if (i+1)%width == 0 {
+			s += ";"
+		} else {
+			s += ","
+		}
+	}
+	return s
+}
+
+func TestMergeMembers(t *testing.T) {
+	sc := &ShardedClient{}
+	tests := []struct {
+		replies []*tris.Reply
+		sortBy  string
+		want    string
+		err     bool
+	}{
+		{
+			[]*tris.Reply{membersReply(3, "b", "1", "vb"), membersReply(3, "a", "2", "va")},
+			"",
+			"a,2,va;b,1,vb;",
+			false,
+		},
+		// keys on more than one shard add up their counts
+		{
+			[]*tris.Reply{membersReply(3, "a", "2", "va", "c", "1", ""), membersReply(3, "a", "3", "", "b", "4", "")},
+			"",
+			"a,5,va;b,4,;c,1,;",
+			false,
+		},
+		{
+			[]*tris.Reply{membersReply(3, "a", "2", "", "c", "1", ""), membersReply(3, "b", "4", "")},
+			tris.SORT_BY_COUNT,
+			"b,4,;a,2,;c,1,;",
+			false,
+		},
+		{
+			[]*tris.Reply{membersReply(4, "a", "1", "", "0.5", "b", "1", "", "2"), membersReply(4, "c", "1", "", "1")},
+			tris.SORT_BY_SCORE,
+			"b,1,,2;c,1,,1;a,1,,0.5;",
+			false,
+		},
+		// the widest signature wins
+		{
+			[]*tris.Reply{membersReply(3, "a", "1", ""), membersReply(4, "b", "1", "", "2")},
+			"",
+			"a,1,,;b,1,,2;",
+			false,
+		},
+		{
+			[]*tris.Reply{membersReply(3), membersReply(3)},
+			"",
+			"",
+			false,
+		},
+		{
+			[]*tris.Reply{membersReply(3, "a", "1", ""), membersReply(2, "b", "1")},
+			"",
+			"",
+			true,
+		},
+		{
+			[]*tris.Reply{tris.NewReply([][]byte{[]byte("a"), tris.EncodeIntPayload(1)}, tris.COMMAND_OK, 3, []int{tris.REPLY_TYPE_STRING, tris.REPLY_TYPE_INT, tris.REPLY_TYPE_BYTES})},
+			"",
+			"",
+			true,
+		},
+	}
+	for i, tt := range tests {
+		r, err := sc.mergeMembers(tt.replies, tt.sortBy)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: mergeMembers error %v", i, err)
+			continue
+		}
+		if err == nil && memberRowsString(r) != tt.want {
+			t.Errorf("%v: mergeMembers = %q, want %q", i, memberRowsString(r), tt.want)
+		}
+	}
+}
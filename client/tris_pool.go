@@ -3,50 +3,268 @@ package tris
 import (
 	"errors"
 	"fmt"
+	"github.com/fvbock/tris/server"
+	"sync"
 	"time"
 )
 
+/*
+TrisConnectionPool keeps up to PoolSize connections to every node of a
+replicated setup. Get and GetWriter return a connection to the node that
+reports itself as primary in ROLE, GetReader one to any node in turn.
+connections are dialed when they are first needed.
+
+after a failover Refresh, or Exec on a write rejected as READONLY, finds
+the new primary.
+
+Put switches a connection back to Db if another database was selected on
+it, so connections come out of the pool with Db selected.
+*/
+const (
+	// send and receive timeout of pooled connections
+	POOL_CLIENT_TIMEOUT = 5 * time.Second
+)
+
 type TrisConnectionPool struct {
+	sync.Mutex
+	// the first node
 	Dsn      *DSN
-	Pool     chan *Client
+	Dsns     []*DSN
 	PoolSize int
+	// the db of pooled connections. empty is the default db
+	Db    string
+	nodes []*poolNode
+	// index of the primary in nodes
+	primary int
+	// next node GetReader uses
+	next int
+}
+
+type poolNode struct {
+	Dsn *DSN
+	// nil entries are connections that are not dialed yet
+	Pool chan *Client
+}
+
+func newPoolNode(dsn *DSN, poolSize int) *poolNode {
+	n := &poolNode{
+		Dsn:  dsn,
+		Pool: make(chan *Client, poolSize),
+	}
+	for i := 0; i < poolSize; i++ {
+		n.Pool <- nil
+	}
+	return n
+}
+
+func (n *poolNode) get() (c *Client, err error) {
+	c = <-n.Pool
+	if c != nil {
+		return
+	}
+	c, err = NewClient(n.Dsn)
+	if err == nil {
+		c.Timeout = POOL_CLIENT_TIMEOUT
+		err = c.Dial()
+	}
+	if err != nil {
+		n.Pool <- nil
+		return nil, errors.New(fmt.Sprintf("Failed to connect pool Client to %s:%v: %v.", n.Dsn.Host, n.Dsn.Port, err))
+	}
+	return
+}
+
+/*
+discard closes a connection that failed and frees its slot.
+*/
+func (n *poolNode) discard(c *Client) {
+	c.Close()
+	n.Pool <- nil
 }
 
 func NewTrisConnectionPool(dsn *DSN, poolSize int) (p *TrisConnectionPool, err error) {
-	var poolStart = time.Now()
-	defer func() { fmt.Printf("Pool initializatopn took %v\n", time.Since(poolStart)) }()
+	return NewTrisReplicatedPool([]*DSN{dsn}, poolSize)
+}
+
+/*
+NewTrisReplicatedPool creates a pool for the primary and replicas in
+dsns. with more than one node it looks for the primary right away.
+*/
+func NewTrisReplicatedPool(dsns []*DSN, poolSize int) (p *TrisConnectionPool, err error) {
+	if len(dsns) == 0 {
+		return nil, errors.New("A pool needs at least one DSN.")
+	}
+	if poolSize < 1 {
+		return nil, errors.New("The pool size has to be at least 1.")
+	}
 	p = &TrisConnectionPool{
-		Pool:     make(chan *Client, poolSize),
+		Dsn:      dsns[0],
+		Dsns:     dsns,
 		PoolSize: poolSize,
 	}
-	for i := 0; i < p.PoolSize; i++ {
-		c, err := NewClient(dsn)
+	for _, dsn := range dsns {
+		p.nodes = append(p.nodes, newPoolNode(dsn, poolSize))
+	}
+	if len(p.nodes) > 1 {
+		err = p.Refresh()
+	}
+	return
+}
+
+/*
+Refresh asks every node for its role and routes writes to the first one
+that is primary. a single node is always used for writes.
+*/
+func (p *TrisConnectionPool) Refresh() error {
+	if len(p.nodes) == 1 {
+		return nil
+	}
+	for i, n := range p.nodes {
+		c, err := n.get()
 		if err != nil {
-			err = errors.New(fmt.Sprintf("Failed to initialize pool Client: %v.", err))
-			break
+			continue
 		}
-		err = c.Dial()
+		r, err := c.Role()
 		if err != nil {
-			err = errors.New(fmt.Sprintf("Failed to initialize pool Client: %v.", err))
-			break
+			n.discard(c)
+			continue
+		}
+		n.Pool <- c
+		if r.ReturnCode == tris.COMMAND_OK && len(r.Payload) > 0 && string(r.Payload[0]) == tris.ROLE_PRIMARY {
+			p.Lock()
+			p.primary = i
+			p.Unlock()
+			return nil
 		}
-		p.Pool <- c
 	}
-	return
+	return errors.New("None of the pool nodes is a primary.")
 }
 
+/*
+Get returns a connection to the primary.
+*/
 func (p *TrisConnectionPool) Get() (c *Client, err error) {
-	c = <-p.Pool
+	return p.GetWriter()
+}
+
+/*
+GetWriter returns a connection to the primary.
+*/
+func (p *TrisConnectionPool) GetWriter() (c *Client, err error) {
+	p.Lock()
+	n := p.nodes[p.primary]
+	p.Unlock()
+	return n.get()
+}
+
+/*
+GetReader returns a connection to the next node that can be reached.
+*/
+func (p *TrisConnectionPool) GetReader() (c *Client, err error) {
+	for i := 0; i < len(p.nodes); i++ {
+		p.Lock()
+		n := p.nodes[p.next]
+		p.next = (p.next + 1) % len(p.nodes)
+		p.Unlock()
+		c, err = n.get()
+		if err == nil {
+			return
+		}
+	}
 	return
 }
 
+func (p *TrisConnectionPool) node(c *Client) *poolNode {
+	for _, n := range p.nodes {
+		if n.Dsn == c.Dsn {
+			return n
+		}
+	}
+	return nil
+}
+
 func (p *TrisConnectionPool) Put(c *Client) (err error) {
-	// TODO: name needs to go into some "common" package and be a constant there - not in the server
-	c.Select("0")
-	p.Pool <- c
+	n := p.node(c)
+	if n == nil {
+		return errors.New(fmt.Sprintf("Client for %s:%v is not from this pool.", c.Dsn.Host, c.Dsn.Port))
+	}
+	if dbName(c.ActiveDb) != dbName(p.Db) {
+		var r *tris.Reply
+		r, err = c.Select(dbName(p.Db))
+		if err == nil && r.ReturnCode != tris.COMMAND_OK {
+			err = errors.New(fmt.Sprintf("Could not select db %s: %s", dbName(p.Db), r.Payload[0]))
+		}
+		if err != nil {
+			n.discard(c)
+			return
+		}
+	}
+	n.Pool <- c
 	return
 }
 
-func (p *TrisConnectionPool) recycleClient(c *Client) (err error) {
-	return
+/*
+dbName returns name or the default db for an empty name.
+*/
+func dbName(name string) string {
+	if name == "" {
+		return tris.DEFAULT_DB
+	}
+	return name
+}
+
+/*
+Exec runs fn with a connection to the primary if write is set or to any
+node otherwise. a read is run once more if it fails. a write is run
+once more, after looking for the primary again, only if it is rejected as
+READONLY or no connection to the primary could be dialed. a write that
+failed on the wire may have been applied, so it is not sent again.
+*/
+func (p *TrisConnectionPool) Exec(write bool, fn func(c *Client) (*tris.Reply, error)) (r *tris.Reply, err error) {
+	for attempt := 0; ; attempt++ {
+		var c *Client
+		if write {
+			c, err = p.GetWriter()
+		} else {
+			c, err = p.GetReader()
+		}
+		dialed := err == nil
+		if dialed {
+			r, err = fn(c)
+			if err != nil {
+				p.node(c).discard(c)
+			} else {
+				p.Put(c)
+			}
+		}
+		var retry bool
+		switch {
+		case !dialed:
+			retry = true
+		case err != nil:
+			retry = !write
+		default:
+			retry = write && r.ReturnCode == tris.COMMAND_READONLY
+		}
+		if !retry || attempt > 0 {
+			return
+		}
+		if write {
+			p.Refresh()
+		}
+	}
+}
+
+/*
+Close closes all connections. it waits for connections that are still
+in use to be put back.
+*/
+func (p *TrisConnectionPool) Close() {
+	for _, n := range p.nodes {
+		for i := 0; i < p.PoolSize; i++ {
+			if c := <-n.Pool; c != nil {
+				c.Close()
+			}
+		}
+	}
 }
@@ -18,8 +18,14 @@ import (
 // TODO: detect connection loss and handle reconnect + currentDB
 
 var (
-	term      *liner.State = nil
-	dsnString              = flag.String("d", "tcp:localhost:6000", "dsn to connect to")
+	term        *liner.State = nil
+	dsnString                = flag.String("d", "tcp:localhost:6000", "dsn to connect to: [user:secret@]protocol:host:port")
+	serverKey                = flag.String("serverkey", "", "CURVE public key of the server")
+	publicKey                = flag.String("publickey", "", "CURVE public key of the client")
+	secretKey                = flag.String("secretkey", "", "CURVE secret key of the client")
+	tlsCAFile                = flag.String("cacert", "", "CA certificates to verify the server with (protocol tls)")
+	tlsCertFile              = flag.String("cert", "", "client certificate (protocol tls)")
+	tlsKeyFile               = flag.String("key", "", "key of the client certificate (protocol tls)")
 )
 
 func init() {
@@ -73,18 +79,20 @@ func main() {
 
 	// TRIS conn
 	flag.Parse()
-	dsnParts := strings.Split(*dsnString, ":")
-	port, _ := strconv.ParseInt(dsnParts[2], 10, 32)
-	dsn := &trisclient.DSN{
-		Protocol: dsnParts[0],
-		Host:     dsnParts[1],
-		Port:     int(port),
+	dsn, err := trisclient.ParseDSN(*dsnString)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	dsn.ServerKey, dsn.PublicKey, dsn.SecretKey = *serverKey, *publicKey, *secretKey
+	dsn.TLSCAFile, dsn.TLSCertFile, dsn.TLSKeyFile = *tlsCAFile, *tlsCertFile, *tlsKeyFile
+	dsnParts := []string{dsn.Protocol, dsn.Host, strconv.Itoa(dsn.Port)}
 	fmt.Printf("Connecting to %s://%s:%v\n", dsn.Protocol, dsn.Host, dsn.Port)
 
 	client, err := trisclient.NewClient(dsn)
 	err = client.Dial()
 	if err != nil {
+		fmt.Println("Could not connect:", err)
 		fmt.Println(command, ierr)
 	} else {
 		ps1 = fmt.Sprintf("%s:%v/[%s]> ", dsnParts[1], dsnParts[2], client.ActiveDb)
@@ -168,12 +176,37 @@ func main() {
 				var response *trisserver.Reply
 				var err error
 				// TODO: check arg count. type too? can we access the signature?
+				// database qualified commands (HAS@db key) go out as they are
+				if strings.Contains(cmdname, "@") {
+					response, err = client.Raw(strings.Join(append([]string{cmdname}, args[i]...), " "))
+					if err != nil {
+						fmt.Println("Error:", err)
+						break cmdexec
+					}
+					response.Print()
+					continue
+				}
 				switch cmdname {
 				case "SOURCE":
 					fmt.Println("Nested sourcing is currently not supported.")
 					break cmdexec
 				case "PING":
 					response, err = client.Ping()
+				case "READY":
+					response, err = client.Ready()
+				case "ROLE":
+					response, err = client.Role()
+				case "REPLICAOF":
+					response, err = client.Raw("REPLICAOF " + strings.Join(args[i], " "))
+				case "CLIENT":
+					response, err = client.Raw("CLIENT " + strings.Join(args[i], " "))
+				case "ACL":
+					response, err = client.Raw("ACL " + strings.Join(args[i], " "))
+				case "HELLO":
+					response, err = client.Hello()
+				case "AUTH":
+					// sent raw so the secret does not show up in the log
+					response, err = client.Raw("AUTH " + strings.Join(args[i], " "))
 				case "SELECT":
 					if len(args) < 1 {
 						fmt.Printf("Not enough arguments: %s, %s\n", cmdname)
@@ -186,25 +219,148 @@ func main() {
 				case "SAVE":
 					response, err = client.Save()
 				case "IMPORT":
-					response, err = client.ImportDb(args[i][0], args[i][1])
+					response, err = client.ImportDb(args[i][0], args[i][1], args[i][2:]...)
 				case "MERGE":
-					response, err = client.MergeDb(args[i][0])
+					response, err = client.MergeDb(args[i][0], args[i][1:]...)
+				case "BULKLOAD":
+					response, err = client.BulkLoad(args[i][0], args[i][1:]...)
+				case "UPLOAD":
+					// UPLOAD localfile [name]
+					if len(args[i]) < 1 {
+						fmt.Println("Not enough arguments: UPLOAD localfile [name]")
+						break cmdexec
+					}
+					name := path.Base(args[i][0])
+					if len(args[i]) > 1 {
+						name = args[i][1]
+					}
+					f, ferr := os.Open(args[i][0])
+					if ferr != nil {
+						fmt.Println("Error:", ferr)
+						break cmdexec
+					}
+					response, err = client.Upload(name, f)
+					f.Close()
+				case "EXPORT":
+					response, err = client.ExportDb(args[i][0], args[i][1:]...)
 				case "CREATE":
-					response, err = client.Create(args[i][0])
+					response, err = client.Create(args[i][0], args[i][1:]...)
 				case "ADD":
 					response, err = client.Add(args[i][0])
 				case "DEL":
 					response, err = client.Del(args[i][0])
+				case "MADD":
+					response, err = client.MAdd(args[i])
+				case "MDEL":
+					response, err = client.MDel(args[i])
+				case "MHAS":
+					response, err = client.MHas(args[i])
 				case "HAS":
-					response, err = client.Has(args[i][0])
+					if dbs, merge, in := cliInArgs(args[i]); in {
+						response, err = client.HasIn(args[i][0], dbs, merge)
+					} else {
+						response, err = client.Has(args[i][0])
+					}
 				case "HASCOUNT":
-					response, err = client.HasCount(args[i][0])
+					if dbs, merge, in := cliInArgs(args[i]); in {
+						response, err = client.HasCountIn(args[i][0], dbs, merge)
+					} else {
+						response, err = client.HasCount(args[i][0])
+					}
+				case "GETCOUNT":
+					response, err = client.GetCount(args[i][0])
+				case "INCRBY":
+					n, _ := strconv.ParseInt(args[i][1], 10, 64)
+					response, err = client.IncrBy(args[i][0], n)
+				case "SETCOUNT":
+					n, _ := strconv.ParseInt(args[i][1], 10, 64)
+					response, err = client.SetCount(args[i][0], n)
 				case "HASPREFIX":
 					response, err = client.HasPrefix(args[i][0])
+				case "DELPREFIX":
+					response, err = client.DelPrefix(args[i][0])
+				case "COUNTPREFIX":
+					response, err = client.CountPrefix(args[i][0])
+				case "SET":
+					response, err = client.Set(args[i][0], strings.Join(args[i][1:], " "))
+				case "GET":
+					response, err = client.Get(args[i][0])
+				case "PREFIXGET":
+					response, err = client.PrefixGet(args[i][0])
+				case "ADDEX":
+					n, _ := strconv.ParseInt(args[i][1], 10, 64)
+					response, err = client.AddEx(args[i][0], n)
+				case "EXPIRE":
+					n, _ := strconv.ParseInt(args[i][1], 10, 64)
+					response, err = client.Expire(args[i][0], n)
+				case "TTL":
+					response, err = client.TTL(args[i][0])
+				case "PERSIST":
+					response, err = client.Persist(args[i][0])
 				case "MEMBERS":
-					response, err = client.Members()
+					response, err = client.Members(args[i]...)
 				case "PREFIXMEMBERS":
-					response, err = client.PrefixMembers(args[i][0])
+					if dbs, merge, in := cliInArgs(args[i]); in {
+						response, err = client.PrefixMembersIn(args[i][0], dbs, merge)
+					} else {
+						response, err = client.PrefixMembers(args[i][0], args[i][1:]...)
+					}
+				case "SUFFIXMEMBERS":
+					response, err = client.SuffixMembers(args[i][0], args[i][1:]...)
+				case "CONTAINS":
+					response, err = client.Contains(args[i][0], args[i][1:]...)
+				case "LONGESTPREFIX":
+					response, err = client.LongestPrefix(args[i][0])
+				case "ALLPREFIXES":
+					response, err = client.AllPrefixes(args[i][0])
+				case "UNION":
+					srcs, combine := cliSetOpArgs(args[i])
+					response, err = client.Union(srcs, combine)
+				case "UNIONSTORE":
+					srcs, combine := cliSetOpArgs(args[i])
+					if len(srcs) == 0 {
+						fmt.Println("Expected a destination database.")
+						break cmdexec
+					}
+					response, err = client.UnionStore(srcs[0], srcs[1:], combine)
+				case "INTERSECT":
+					srcs, combine := cliSetOpArgs(args[i])
+					response, err = client.Intersect(srcs, combine)
+				case "INTERSECTSTORE":
+					srcs, combine := cliSetOpArgs(args[i])
+					if len(srcs) == 0 {
+						fmt.Println("Expected a destination database.")
+						break cmdexec
+					}
+					response, err = client.IntersectStore(srcs[0], srcs[1:], combine)
+				case "DIFF":
+					srcs, combine := cliSetOpArgs(args[i])
+					response, err = client.Diff(srcs, combine)
+				case "DIFFSTORE":
+					srcs, combine := cliSetOpArgs(args[i])
+					if len(srcs) == 0 {
+						fmt.Println("Expected a destination database.")
+						break cmdexec
+					}
+					response, err = client.DiffStore(srcs[0], srcs[1:], combine)
+				case "COPY":
+					if len(args[i]) != 2 {
+						fmt.Println("Expected two database names.")
+						break cmdexec
+					}
+					response, err = client.CopyDb(args[i][0], args[i][1])
+				case "RENAME":
+					if len(args[i]) != 2 {
+						fmt.Println("Expected two database names.")
+						break cmdexec
+					}
+					response, err = client.RenameDb(args[i][0], args[i][1])
+				case "SWAP":
+					if len(args[i]) != 2 {
+						fmt.Println("Expected two database names.")
+						break cmdexec
+					}
+					response, err = client.SwapDb(args[i][0], args[i][1])
 				case "TREE":
 					response, err = client.Tree()
 				case "TIMING":
@@ -227,3 +383,30 @@ func main() {
 		}
 	}
 }
+
+/*
+cliInArgs finds "IN db1,db2 [MERGE]" in the arguments of a command.
+*/
+func cliInArgs(args []string) (dbs []string, merge bool, in bool) {
+	for i, arg := range args {
+		if strings.ToUpper(arg) == "IN" && i+1 < len(args) {
+			dbs = strings.Split(args[i+1], ",")
+			merge = i+2 < len(args) && strings.ToUpper(args[i+2]) == "MERGE"
+			in = true
+			return
+		}
+	}
+	return
+}
+
+func cliSetOpArgs(args []string) (dbs []string, combine string) {
+	for i := 0; i < len(args); i++ {
+		if strings.ToUpper(args[i]) == "COMBINE" && i+1 < len(args) {
+			combine = args[i+1]
+			i++
+			continue
+		}
+		dbs = append(dbs, args[i])
+	}
+	return
+}
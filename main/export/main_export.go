@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	trisserver "github.com/fvbock/tris/server"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+tris-export converts a TriS data file (trie_<name> and its .meta file)
+into the text formats of the EXPORT command without a running server.
+
+	main_export [-f csv|tsv|jsonl] [-o outfile] <datafile>
+*/
+
+var (
+	format  = flag.String("f", "csv", "output format: csv, tsv or jsonl")
+	outFile = flag.String("o", "", "output file. defaults to stdout")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-f csv|tsv|jsonl] [-o outfile] <datafile>\n", os.Args[0])
+		os.Exit(2)
+	}
+	fname := flag.Arg(0)
+	exportFormat, err := trisserver.ParseExportFormat(*format)
+	if err == nil && exportFormat == trisserver.EXPORT_FORMAT_TRIE {
+		err = fmt.Errorf("the data file already is in the TRIE format")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	name := strings.TrimPrefix(filepath.Base(fname), "trie_")
+	d, err := trisserver.LoadDatabaseFile(name, fname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load %s: %v\n", fname, err)
+		os.Exit(1)
+	}
+
+	var n int64
+	if *outFile == "" {
+		n, err = d.Export(os.Stdout, exportFormat)
+	} else {
+		n, err = d.ExportFile(*outFile, exportFormat)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d members of %s.\n", n, name)
+}
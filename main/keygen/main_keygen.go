@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	trisserver "github.com/fvbock/tris/server"
+	"os"
+	"strings"
+)
+
+var (
+	certHosts = flag.String("cert", "", "also write a self signed TLS certificate for these comma separated hosts")
+	certFile  = flag.String("certfile", "tris.crt", "where to write the certificate")
+	keyFile   = flag.String("keyfile", "tris.key", "where to write the key of the certificate")
+)
+
+/*
+main_keygen prints a CURVE key pair for ServerConfig.CurveSecretKey and
+the DSN keys. with -cert it writes a self signed TLS certificate as well.
+*/
+func main() {
+	flag.Parse()
+	public, secret, err := trisserver.GenerateCurveKeyPair()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not generate the key pair: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("public:", public)
+	fmt.Println("secret:", secret)
+	if *certHosts == "" {
+		return
+	}
+	err = trisserver.GenerateSelfSignedCert(strings.Split(*certHosts, ","), *certFile, *keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not generate the certificate: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("wrote %s and %s\n", *certFile, *keyFile)
+}
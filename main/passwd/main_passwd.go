@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	trisserver "github.com/fvbock/tris/server"
+	"os"
+)
+
+/*
+main_passwd prints the hash of a secret for ServerConfig.Users.
+
+	main_passwd <secret>
+*/
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s <secret>\n", os.Args[0])
+		os.Exit(2)
+	}
+	hash, err := trisserver.HashSecret(os.Args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not hash the secret: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(hash)
+}
@@ -14,13 +14,14 @@ var (
 func init() {
 	runtime.GOMAXPROCS(4)
 	config = &tris.ServerConfig{
-		Protocol:          "tcp",
-		Host:              "127.0.0.1",
-		Port:              6000,
-		DataDir:           "/home/morpheus/tris_data",
-		StorageFilePrefix: "trie_",
-		PersistOpsLimit:   100,
-		PersistInterval:   300 * time.Second,
+		Protocol:            "tcp",
+		Host:                "127.0.0.1",
+		Port:                6000,
+		DataDir:             "/home/morpheus/tris_data",
+		StorageFilePrefix:   "trie_",
+		PersistOpsLimit:     100,
+		PersistInterval:     300 * time.Second,
+		ExpireSweepInterval: 1 * time.Second,
 	}
 }
 
@@ -37,6 +38,7 @@ func main() {
 	server, err := tris.NewServer(config)
 	if err != nil {
 		server.Log.Printf("Could not initialize server: %v\n", err)
+		return
 	}
 	server.Start() // Blocks until the server Stop()s
 
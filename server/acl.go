@@ -0,0 +1,286 @@
+package tris
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+ACL rules limit what an authenticated user may do:
+
+	Flags       the COMMAND_FLAG_* classes the user may run. a command is
+	            allowed if all of its flags are in Flags
+	DbPatterns  path.Match patterns of the databases the user may select
+	            or touch
+
+read and write commands also need the active database to match.
+ACLExemptCommands are not checked against Flags, SELECT only against
+DbPatterns. the rules are managed with ACL LIST, ACL SETUSER and ACL
+DELUSER and stored in DataDir/ACL_FILE_NAME.
+
+rules only apply to users from ServerConfig.Users. as long as there is
+no rule every user may do everything, once there is one users without a
+rule may only run ACLExemptCommands. the first rule has to give ADMIN to
+the user who sets it so nobody is locked out. the last rule can not be
+deleted, that would open the server to every user again.
+*/
+const (
+	ACL_FILE_NAME = "acl.json"
+)
+
+var (
+	// names of the flag classes in ACL SETUSER
+	ACLFlagNames = map[string]int{
+		"READ":  COMMAND_FLAG_READ,
+		"WRITE": COMMAND_FLAG_WRITE,
+		"ADMIN": COMMAND_FLAG_ADMIN,
+		"ALL":   COMMAND_FLAG_READ | COMMAND_FLAG_WRITE | COMMAND_FLAG_ADMIN,
+	}
+
+	// commands every user may run. pools need ROLE to find the primary
+	ACLExemptCommands = map[string]bool{
+		"PING":   true,
+		"HELLO":  true,
+		"AUTH":   true,
+		"EXIT":   true,
+		"READY":  true,
+		"HELP":   true,
+		"SELECT": true,
+		"ROLE":   true,
+	}
+)
+
+type ACLRule struct {
+	Flags      int
+	DbPatterns []string
+}
+
+func (r *ACLRule) allowsDb(name string) bool {
+	for _, pattern := range r.DbPatterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ACL holds the rules of all users.
+*/
+type ACL struct {
+	sync.RWMutex
+	Rules map[string]*ACLRule
+}
+
+func NewACL() *ACL {
+	return &ACL{
+		Rules: make(map[string]*ACLRule),
+	}
+}
+
+/*
+ParseACLFlags parses a comma separated list of ACLFlagNames.
+*/
+func ParseACLFlags(spec string) (flags int, err error) {
+	for _, name := range strings.Split(spec, ",") {
+		flag, exists := ACLFlagNames[strings.ToUpper(strings.TrimSpace(name))]
+		if !exists {
+			return 0, errors.New(fmt.Sprintf("Unknown flag class %s", name))
+		}
+		flags |= flag
+	}
+	return
+}
+
+/*
+ACLFlagsString returns the names of the flag classes in flags.
+*/
+func ACLFlagsString(flags int) string {
+	var names []string
+	for _, name := range []string{"READ", "WRITE", "ADMIN"} {
+		if flags&ACLFlagNames[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (s *Server) aclFilePath() string {
+	return fmt.Sprintf("%s/%s", s.Config.DataDir, ACL_FILE_NAME)
+}
+
+/*
+LoadACL reads the rules from DataDir. a missing file means no rules.
+*/
+func (s *Server) LoadACL() (err error) {
+	data, err := ioutil.ReadFile(s.aclFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	rules := make(map[string]*ACLRule)
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not read the ACL file %s: %v", s.aclFilePath(), err))
+	}
+	s.ACL.Lock()
+	s.ACL.Rules = rules
+	s.ACL.Unlock()
+	return
+}
+
+/*
+persistACL writes the rules to DataDir. the caller has to hold the ACL
+lock.
+*/
+func (s *Server) persistACL() (err error) {
+	data, err := json.MarshalIndent(s.ACL.Rules, "", "  ")
+	if err != nil {
+		return
+	}
+	tmpName := s.aclFilePath() + ".tmp"
+	err = ioutil.WriteFile(tmpName, data, 0600)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmpName, s.aclFilePath())
+}
+
+/*
+SetACLRule sets the rule of user for c and persists the rules. a nil c
+is the server itself.
+*/
+func (s *Server) SetACLRule(c *ClientConnection, user string, rule *ACLRule) error {
+	if !s.AuthRequired() {
+		return errors.New("ACL rules need ServerConfig.Users.")
+	}
+	s.ACL.Lock()
+	defer s.ACL.Unlock()
+	if len(s.ACL.Rules) == 0 && c != nil && (user != c.User || rule.Flags&COMMAND_FLAG_ADMIN == 0) {
+		return errors.New(fmt.Sprintf("The first ACL rule has to give ADMIN to %s.", c.User))
+	}
+	s.ACL.Rules[user] = rule
+	return s.persistACL()
+}
+
+/*
+DeleteACLRule removes the rule of user and persists the rules. it returns
+false if the user had no rule. the last rule is not deleted.
+*/
+func (s *Server) DeleteACLRule(user string) (bool, error) {
+	s.ACL.Lock()
+	defer s.ACL.Unlock()
+	if _, exists := s.ACL.Rules[user]; !exists {
+		return false, nil
+	}
+	if len(s.ACL.Rules) == 1 {
+		return false, errors.New(fmt.Sprintf("The rule of %s is the last ACL rule. Deleting it would give every user all rights.", user))
+	}
+	delete(s.ACL.Rules, user)
+	return true, s.persistACL()
+}
+
+// the rule of users without one once there are rules
+var noACLRule = &ACLRule{}
+
+/*
+aclRule returns the rule c is checked against or nil if c is not
+restricted.
+*/
+func (s *Server) aclRule(c *ClientConnection) *ACLRule {
+	if c == nil || !c.Authenticated {
+		return nil
+	}
+	s.ACL.RLock()
+	defer s.ACL.RUnlock()
+	if len(s.ACL.Rules) == 0 {
+		return nil
+	}
+	if rule, exists := s.ACL.Rules[c.User]; exists {
+		return rule
+	}
+	return noACLRule
+}
+
+/*
+checkCommandAccess tells whether c may run cmd against its active db.
+*/
+func (s *Server) checkCommandAccess(c *ClientConnection, cmd Command) error {
+	rule := s.aclRule(c)
+	if rule == nil {
+		return nil
+	}
+	name := cmd.Name()
+	if !ACLExemptCommands[name] && cmd.Flags()&^rule.Flags != 0 {
+		return errors.New(fmt.Sprintf("NOPERM User %s may not run %s.", c.User, name))
+	}
+	dataCmd := cmd.Flags()&(COMMAND_FLAG_READ|COMMAND_FLAG_WRITE) != 0
+	if !ACLExemptCommands[name] && dataCmd && !rule.allowsDb(c.ActiveDb.Name) {
+		return errors.New(fmt.Sprintf("NOPERM User %s may not access db %s.", c.User, c.ActiveDb.Name))
+	}
+	return nil
+}
+
+/*
+checkDbAccess tells whether c may select or touch all dbNames. a nil c
+is the server itself.
+*/
+func (s *Server) checkDbAccess(c *ClientConnection, dbNames ...string) error {
+	rule := s.aclRule(c)
+	if rule == nil {
+		return nil
+	}
+	for _, name := range dbNames {
+		if !rule.allowsDb(name) {
+			return errors.New(fmt.Sprintf("NOPERM User %s may not access db %s.", c.User, name))
+		}
+	}
+	return nil
+}
+
+/*
+checkCreateAccess tells whether c may create the db name. like CREATE
+this needs ADMIN.
+*/
+func (s *Server) checkCreateAccess(c *ClientConnection, name string) error {
+	rule := s.aclRule(c)
+	if rule == nil {
+		return nil
+	}
+	if rule.Flags&COMMAND_FLAG_ADMIN == 0 {
+		return errors.New(fmt.Sprintf("NOPERM User %s may not create db %s.", c.User, name))
+	}
+	return nil
+}
+
+func permissionReply(err error) *Reply {
+	return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+}
+
+/*
+aclListReply replies one row of user, flags and db patterns per rule.
+*/
+func (s *Server) aclListReply() *Reply {
+	s.ACL.RLock()
+	defer s.ACL.RUnlock()
+	var users sort.StringSlice
+	for user, _ := range s.ACL.Rules {
+		users = append(users, user)
+	}
+	sort.Sort(users)
+	var rows [][]byte
+	for _, user := range users {
+		rule := s.ACL.Rules[user]
+		rows = append(rows, []byte(user), []byte(ACLFlagsString(rule.Flags)), []byte(strings.Join(rule.DbPatterns, ",")))
+	}
+	return NewReply(rows, COMMAND_OK, 3, []int{REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_STRING})
+}
@@ -0,0 +1,101 @@
+package tris
+
+import (
+	"testing"
+)
+
+func TestCheckCommandAccess(t *testing.T) {
+	s := &Server{
+		Config: &ServerConfig{DataDir: t.TempDir(), Users: map[string]string{"alice": "", "bob": "", "carol": ""}},
+		ACL:    NewACL(),
+	}
+	db := newDetachedDatabase("users")
+	alice := &ClientConnection{User: "alice", Authenticated: true, ActiveDb: db}
+	bob := &ClientConnection{User: "bob", Authenticated: true, ActiveDb: db}
+	carol := &ClientConnection{User: "carol", Authenticated: true, ActiveDb: db}
+
+	// without rules every user may do everything
+	if err := s.checkCommandAccess(bob, &CommandACL{}); err != nil {
+		t.Fatalf("ACL without rules: %v", err)
+	}
+	if err := s.SetACLRule(bob, "bob", &ACLRule{Flags: COMMAND_FLAG_READ, DbPatterns: []string{"*"}}); err == nil {
+		t.Fatal("a first rule without ADMIN was set")
+	}
+	if err := s.SetACLRule(alice, "bob", &ACLRule{Flags: ACLFlagNames["ALL"], DbPatterns: []string{"*"}}); err == nil {
+		t.Fatal("a first rule for another user was set")
+	}
+	if err := s.SetACLRule(alice, "alice", &ACLRule{Flags: ACLFlagNames["ALL"], DbPatterns: []string{"*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetACLRule(alice, "bob", &ACLRule{Flags: COMMAND_FLAG_READ, DbPatterns: []string{"user*"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		c       *ClientConnection
+		cmd     Command
+		allowed bool
+	}{
+		{alice, &CommandACL{}, true},
+		{alice, &CommandSet{}, true},
+		{bob, &CommandGet{}, true},
+		{bob, &CommandSet{}, false},
+		{bob, &CommandACL{}, false},
+		{bob, &CommandPing{}, true},
+		{bob, &CommandRole{}, true},
+		// users without a rule
+		{carol, &CommandGet{}, false},
+		{carol, &CommandACL{}, false},
+		{carol, &CommandPing{}, true},
+		// the server itself
+		{nil, &CommandACL{}, true},
+	}
+	for _, tt := range tests {
+		c := tt.c
+		if c == nil {
+			c = &ClientConnection{ActiveDb: db}
+		}
+		err := s.checkCommandAccess(c, tt.cmd)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s %s: allowed %v, got %v", c.User, tt.cmd.Name(), tt.allowed, err)
+		}
+	}
+	if err := s.checkDbAccess(carol, "users"); err == nil {
+		t.Error("carol may access db users without a rule")
+	}
+	if err := s.checkCreateAccess(carol, "new"); err == nil {
+		t.Error("carol may create a db without a rule")
+	}
+}
+
+func TestDeleteACLRule(t *testing.T) {
+	s := &Server{
+		Config: &ServerConfig{DataDir: t.TempDir(), Users: map[string]string{"alice": "", "bob": ""}},
+		ACL:    NewACL(),
+	}
+	db := newDetachedDatabase("users")
+	alice := &ClientConnection{User: "alice", Authenticated: true, ActiveDb: db}
+	bob := &ClientConnection{User: "bob", Authenticated: true, ActiveDb: db}
+	if err := s.SetACLRule(alice, "alice", &ACLRule{Flags: ACLFlagNames["ALL"], DbPatterns: []string{"*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetACLRule(alice, "bob", &ACLRule{Flags: COMMAND_FLAG_READ, DbPatterns: []string{"*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := s.DeleteACLRule("carol"); deleted || err != nil {
+		t.Errorf("deleting a missing rule: %v, %v", deleted, err)
+	}
+	if deleted, err := s.DeleteACLRule("alice"); !deleted || err != nil {
+		t.Fatalf("deleting the rule of alice: %v, %v", deleted, err)
+	}
+	// the last rule stays so users without one are still denied
+	if deleted, err := s.DeleteACLRule("bob"); deleted || err == nil {
+		t.Fatalf("the last rule was deleted: %v, %v", deleted, err)
+	}
+	if err := s.checkCommandAccess(alice, &CommandGet{}); err == nil {
+		t.Error("alice may read without a rule")
+	}
+	if err := s.checkCommandAccess(bob, &CommandSet{}); err == nil {
+		t.Error("bob may write with a READ rule")
+	}
+}
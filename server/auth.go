@@ -0,0 +1,113 @@
+package tris
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"strconv"
+	"strings"
+)
+
+/*
+If ServerConfig.Users is set clients have to AUTH before they can run
+anything but the UnauthenticatedCommands, and those not qualified with a
+db. secrets are stored as
+
+	pbkdf2-sha256$<iterations>$<salt hex>$<key hex>
+
+HashSecret creates them, main/passwd prints them for the config.
+*/
+const (
+	SECRET_HASH_SCHEME     = "pbkdf2-sha256"
+	SECRET_HASH_ITERATIONS = 20000
+	SECRET_SALT_BYTES      = 16
+)
+
+var (
+	// commands that clients can run before they AUTH
+	UnauthenticatedCommands = map[string]bool{
+		"PING":  true,
+		"HELLO": true,
+		"AUTH":  true,
+		"EXIT":  true,
+	}
+)
+
+/*
+secretKey derives a sha256 sized key from secret and salt with PBKDF2
+(RFC 2898).
+*/
+func secretKey(secret []byte, salt []byte, iterations int) []byte {
+	return pbkdf2.Key(secret, salt, iterations, sha256.Size, sha256.New)
+}
+
+/*
+HashSecret returns the hash of secret with a random salt in the format
+expected in ServerConfig.Users.
+*/
+func HashSecret(secret string) (hash string, err error) {
+	salt := make([]byte, SECRET_SALT_BYTES)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	key := secretKey([]byte(secret), salt, SECRET_HASH_ITERATIONS)
+	hash = fmt.Sprintf("%s$%d$%s$%s", SECRET_HASH_SCHEME, SECRET_HASH_ITERATIONS, hex.EncodeToString(salt), hex.EncodeToString(key))
+	return
+}
+
+/*
+CheckSecret tells whether secret matches hash.
+*/
+func CheckSecret(hash string, secret string) (ok bool, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != SECRET_HASH_SCHEME {
+		return false, errors.New("Unknown secret hash format")
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false, errors.New("Invalid iteration count in secret hash")
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false, errors.New("Invalid salt in secret hash")
+	}
+	expected, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false, errors.New("Invalid key in secret hash")
+	}
+	key := secretKey([]byte(secret), salt, iterations)
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+/*
+AuthRequired tells whether clients have to AUTH.
+*/
+func (s *Server) AuthRequired() bool {
+	return len(s.Config.Users) > 0
+}
+
+/*
+Authenticate checks user and secret against ServerConfig.Users.
+*/
+func (s *Server) Authenticate(user string, secret string) bool {
+	hash, exists := s.Config.Users[user]
+	if !exists {
+		// do the work anyway so unknown users take as long as known ones
+		CheckSecret(fmt.Sprintf("%s$%d$00$00", SECRET_HASH_SCHEME, SECRET_HASH_ITERATIONS), secret)
+		return false
+	}
+	ok, err := CheckSecret(hash, secret)
+	if err != nil {
+		s.Log.Printf("Could not check the secret of user %s: %v\n", user, err)
+		return false
+	}
+	return ok
+}
+
+func noAuthReply() *Reply {
+	return NewReply([][]byte{[]byte("NOAUTH Authentication required.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+}
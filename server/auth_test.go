@@ -0,0 +1,69 @@
+package tris
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"testing"
+)
+
+// RFC 6070 test vectors for PBKDF2-HMAC-SHA1. the 16777216 iterations
+// case is left out
+var pbkdf2Vectors = []struct {
+	secret     string
+	salt       string
+	iterations int
+	key        string
+}{
+	{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+	{"password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+	{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+	{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+	{"pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+}
+
+func TestPbkdf2RFC6070(t *testing.T) {
+	for _, v := range pbkdf2Vectors {
+		want, _ := hex.DecodeString(v.key)
+		key := pbkdf2.Key([]byte(v.secret), []byte(v.salt), v.iterations, len(want), sha1.New)
+		if hex.EncodeToString(key) != v.key {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x, want %s", v.secret, v.salt, v.iterations, key, v.key)
+		}
+	}
+}
+
+func TestSecretKey(t *testing.T) {
+	// first 32 bytes of the PBKDF2-HMAC-SHA256 vector in RFC 7914
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"
+	if key := hex.EncodeToString(secretKey([]byte("passwd"), []byte("salt"), 1)); key != want {
+		t.Errorf("secretKey = %s, want %s", key, want)
+	}
+}
+
+func TestCheckSecret(t *testing.T) {
+	hash, err := HashSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hash   string
+		secret string
+		ok     bool
+		err    bool
+	}{
+		{hash, "secret", true, false},
+		{hash, "Secret", false, false},
+		{hash, "", false, false},
+		{fmt.Sprintf("%s$1$73616c74$55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc", SECRET_HASH_SCHEME), "passwd", true, false},
+		{"md5$1$00$00", "secret", false, true},
+		{SECRET_HASH_SCHEME + "$0$00$00", "secret", false, true},
+		{SECRET_HASH_SCHEME + "$1$zz$00", "secret", false, true},
+	}
+	for _, tt := range tests {
+		ok, err := CheckSecret(tt.hash, tt.secret)
+		if ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("CheckSecret(%q, %q) = %v, %v", tt.hash, tt.secret, ok, err)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package tris
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+BULKLOAD streams a key file into a new trie in the background. reads keep
+going against the old contents of the database until the file is done,
+then the new contents are swapped in and the old ones are dropped. writes
+to the database are rejected while the load runs since they would be
+dropped with the old contents. loads still running on shutdown are
+cancelled.
+
+the file is either one key per line (LINES) or one of the text export
+formats. gzipped files are detected by their magic bytes. duplicate keys
+add up their counts.
+*/
+const (
+	EXPORT_FORMAT_LINES = "LINES"
+
+	// records read between two progress updates
+	BULK_LOAD_CHUNK_SIZE = 10000
+
+	BULK_LOAD_RUNNING = "running"
+	BULK_LOAD_DONE    = "done"
+	BULK_LOAD_FAILED  = "failed"
+)
+
+var (
+	// write commands that do not change the active db. SWAP and the set
+	// operation stores check the dbs they change themselves
+	BulkLoadExemptCommands = map[string]bool{
+		"CREATE":         true,
+		"COPY":           true,
+		"RENAME":         true,
+		"SWAP":           true,
+		"UNIONSTORE":     true,
+		"INTERSECTSTORE": true,
+		"DIFFSTORE":      true,
+		"IMPORT":         true,
+		"BULKLOAD":       true,
+		"UPLOAD":         true,
+		"SAVE":           true,
+	}
+
+	errBulkLoadCancelled = errors.New("cancelled by the server shutdown")
+)
+
+/*
+BulkLoadProgress is the state of the last bulk load of a database.
+*/
+type BulkLoadProgress struct {
+	sync.RWMutex
+	File       string
+	State      string
+	Records    int64
+	Bytes      int64
+	TotalBytes int64
+	Started    time.Time
+	Finished   time.Time
+	Err        error
+}
+
+func (p *BulkLoadProgress) String() string {
+	p.RLock()
+	defer p.RUnlock()
+	var pct float64
+	if p.TotalBytes > 0 {
+		pct = float64(p.Bytes) * 100 / float64(p.TotalBytes)
+	}
+	info := fmt.Sprintf(" BulkLoad: %s %s, %v records, %v/%v bytes (%.1f%%)", p.State, p.File, p.Records, p.Bytes, p.TotalBytes, pct)
+	switch p.State {
+	case BULK_LOAD_RUNNING:
+		info += fmt.Sprintf(", running for %v", time.Since(p.Started))
+	case BULK_LOAD_DONE:
+		info += fmt.Sprintf(", took %v", p.Finished.Sub(p.Started))
+	case BULK_LOAD_FAILED:
+		info += fmt.Sprintf(": %v", p.Err)
+	}
+	return info + "\n"
+}
+
+func (p *BulkLoadProgress) running() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.State == BULK_LOAD_RUNNING
+}
+
+func (p *BulkLoadProgress) update(records int64, bytes int64) {
+	p.Lock()
+	p.Records = records
+	p.Bytes = bytes
+	p.Unlock()
+}
+
+func (p *BulkLoadProgress) finish(err error) {
+	p.Lock()
+	p.Finished = time.Now()
+	if err != nil {
+		p.State = BULK_LOAD_FAILED
+		p.Err = err
+	} else {
+		p.State = BULK_LOAD_DONE
+	}
+	p.Unlock()
+}
+
+/*
+bulkLoading tells whether a bulk load into d runs. the caller has to
+hold the db lock or bulkGate.
+*/
+func (d *Database) bulkLoading() bool {
+	return d.BulkLoad != nil && d.BulkLoad.running()
+}
+
+func bulkLoadingError(d *Database) error {
+	return errors.New(fmt.Sprintf("BUSY Db %s is being bulk loaded. Writes are rejected until the load is done.", d.Name))
+}
+
+/*
+countingReader counts the bytes read from the underlying reader. it
+fails once cancel is closed.
+*/
+type countingReader struct {
+	r      io.Reader
+	count  int64
+	cancel <-chan struct{}
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	select {
+	case <-cr.cancel:
+		return 0, errBulkLoadCancelled
+	default:
+	}
+	n, err = cr.r.Read(p)
+	atomic.AddInt64(&cr.count, int64(n))
+	return
+}
+
+/*
+bulkLoadFormat is like splitFormatArg but defaults to LINES instead of
+TRIE, which can not be streamed.
+*/
+func bulkLoadFormat(path string, args []string) (format string, err error) {
+	for i := 0; i < len(args); i++ {
+		if strings.ToUpper(args[i]) != "FORMAT" {
+			return "", errors.New(fmt.Sprintf("Unknown argument %s", args[i]))
+		}
+		if i+1 >= len(args) {
+			return "", errors.New("FORMAT needs LINES, CSV, TSV or JSONL")
+		}
+		format = strings.ToUpper(args[i+1])
+		if format != EXPORT_FORMAT_LINES {
+			format, err = ParseExportFormat(format)
+		}
+		if err == nil && format == EXPORT_FORMAT_TRIE {
+			err = errors.New("The TRIE format can not be bulk loaded. Use IMPORT.")
+		}
+		return
+	}
+	format = ExportFormatFromPath(strings.TrimSuffix(path, ".gz"))
+	if format == EXPORT_FORMAT_TRIE {
+		format = EXPORT_FORMAT_LINES
+	}
+	return
+}
+
+/*
+StartBulkLoad opens fname and loads it into d in the background. only
+one bulk load per database can run at a time. with consume the file is
+removed after a successful load.
+*/
+func (s *Server) StartBulkLoad(d *Database, fname string, format string, consume bool) (err error) {
+	select {
+	case <-s.bulkCancel:
+		return errors.New("The server is shutting down.")
+	default:
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+	progress := &BulkLoadProgress{
+		File:       fname,
+		State:      BULK_LOAD_RUNNING,
+		TotalBytes: stat.Size(),
+		Started:    time.Now(),
+	}
+	// wait for the writes that are running
+	d.bulkGate.Lock()
+	d.Lock()
+	if d.bulkLoading() {
+		d.Unlock()
+		d.bulkGate.Unlock()
+		f.Close()
+		return errors.New(fmt.Sprintf("A bulk load into db %s is already running.", d.Name))
+	}
+	d.BulkLoad = progress
+	opts := d.Options
+	d.Unlock()
+	d.bulkGate.Unlock()
+
+	s.bulkLoads.Add(1)
+	go func() {
+		defer s.bulkLoads.Done()
+		defer f.Close()
+		err := s.bulkLoad(d, f, format, opts, progress)
+		if err != nil {
+			s.Log.Printf("Bulk load of %s into db %s failed: %v\n", fname, d.Name, err)
+		} else {
+			s.Log.Printf("Bulk loaded %s into db %s.\n", fname, d.Name)
+			s.replicateDatabase(d)
+			if consume {
+				s.removeUpload(fname)
+			}
+		}
+		progress.finish(err)
+	}()
+	return
+}
+
+func (s *Server) bulkLoad(d *Database, f io.Reader, format string, opts DatabaseOptions, progress *BulkLoadProgress) (err error) {
+	counter := &countingReader{r: f, cancel: s.bulkCancel}
+	br := bufio.NewReader(counter)
+	var r io.Reader = br
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// the staging db is not visible to anyone else, it needs no locking
+	staging := newDetachedDatabase(d.Name)
+	staging.Options = opts
+	var records int64
+	add := func(rec *ExportRecord) error {
+		if _, err := staging.IncrBy(rec.Key, rec.Count); err != nil {
+			return errors.New(fmt.Sprintf("Record %d: %v", records+1, err))
+		}
+		if rec.Value != "" {
+			staging.SetValue(rec.Key, []byte(rec.Value))
+		}
+		records++
+		if records%BULK_LOAD_CHUNK_SIZE == 0 {
+			progress.update(records, atomic.LoadInt64(&counter.count))
+		}
+		return nil
+	}
+	if format == EXPORT_FORMAT_LINES {
+		err = readLines(r, add)
+	} else {
+		err = ReadExport(r, format, add)
+	}
+	progress.update(records, atomic.LoadInt64(&counter.count))
+	if err != nil {
+		return
+	}
+	staging.RebuildSuffixIndex()
+
+	d.Lock()
+	swapContents(d, staging)
+	d.OpsCount += 1
+	d.Unlock()
+	return d.Persist(s.dbFilePath(d.Name))
+}
+
+/*
+stopBulkLoads cancels the running bulk loads and waits for them.
+*/
+func (s *Server) stopBulkLoads() {
+	close(s.bulkCancel)
+	s.bulkLoads.Wait()
+}
+
+/*
+readLines calls fn for every non empty line of r.
+*/
+func readLines(r io.Reader, fn func(rec *ExportRecord) error) (err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, rerr := br.ReadString('\n')
+		key := strings.TrimRight(line, "\r\n")
+		if key != "" {
+			if err = fn(&ExportRecord{Key: key, Count: 1}); err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
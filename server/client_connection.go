@@ -9,10 +9,20 @@ type ClientConnection struct {
 	Msg          []byte
 	ActiveDb     *Database
 	ShowExecTime bool
+	// reply protocol version chosen with HELLO
+	Protocol int
+	// set by a successful AUTH
+	User          string
+	Authenticated bool
+	// token buckets of ServerConfig.RateLimits. nil without limits
+	limiter *rateLimiter
+	// commands run and commands rejected by rate limits
+	Commands    int64
+	RateLimited int64
 }
 
 func (c *ClientConnection) String() string {
-	return fmt.Sprintf("Client ID: %v\nActive Db: %v\n", c.Id, c.ActiveDb.Name)
+	return fmt.Sprintf("Client ID: %v\nUser: %s\nActive Db: %v\n", c.Id, c.User, c.ActiveDb.Name)
 }
 
 func NewClientConnection(s *Server, id []byte) *ClientConnection {
@@ -20,5 +30,7 @@ func NewClientConnection(s *Server, id []byte) *ClientConnection {
 		Id:           id,
 		ActiveDb:     s.Databases[DEFAULT_DB],
 		ShowExecTime: false,
+		Protocol:     MIN_PROTOCOL_VERSION,
+		limiter:      newRateLimiter(s.Config.RateLimits),
 	}
 }
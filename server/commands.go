@@ -1,11 +1,14 @@
 package tris
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/fvbock/trie"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -58,6 +61,8 @@ func (cmd *CommandInfo) Help() string             { return "TODO: CommandInfo te
 func (cmd *CommandInfo) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
 	var dbNames sort.StringSlice
 	var dbList string
+	s.RLock()
+	defer s.RUnlock()
 	for name, _ := range s.Databases {
 		if name != DEFAULT_DB {
 			dbNames = append(dbNames, name)
@@ -72,23 +77,39 @@ func (cmd *CommandInfo) Function(s *Server, c *ClientConnection, args ...interfa
 		} else {
 			marker = ""
 		}
-		dbList += fmt.Sprintf("    %v) %s%s\n", n, marker, name)
+		dbList += fmt.Sprintf("    %v) %s%s (%s)\n", n, marker, name, dbStatsInfo(s.Databases[name]))
 		n += 1
 	}
+	maxMemory := "unlimited"
+	if s.Config.MaxMemory > 0 {
+		maxMemory = fmt.Sprintf("%v bytes, policy %s", s.Config.MaxMemory, s.maxMemoryPolicy())
+	}
+	writes := "accepted"
+	if atomic.LoadInt32(&s.memoryFull) == 1 {
+		writes = "rejected, the heap is over MaxMemory"
+	}
 	serverStr := fmt.Sprintf(`Tris %s.
 Host: %s
 Port: %v
 DataDir: %s
+Loading: %s
 
+Memory:
+  HeapAlloc: %v bytes
+  MaxMemory: %s
+  Writes: %s
+
+Replication:
+%s
 Databases:
-  Default DB: %s
+  Default DB: %s (%s)
   User DBs:
 %v
 
 ActiveClients: %v
 Commands Processed: %v
 Commands Running: %v
-`, VERSION, s.Config.Host, s.Config.Port, s.Config.DataDir, DEFAULT_DB, dbList, len(s.ActiveClients), s.CommandsProcessed, s.RequestsRunning)
+`, VERSION, s.Config.Host, s.Config.Port, s.Config.DataDir, s.Loading.String(), heapAlloc(), maxMemory, writes, s.replicationInfo(), DEFAULT_DB, dbStatsInfo(s.Databases[DEFAULT_DB]), dbList, len(s.ActiveClients), s.CommandsProcessed, s.RequestsRunning)
 
 	reply = NewReply([][]byte{[]byte(fmt.Sprintf("SERVER\n%v\nCLIENT\n%s", serverStr, c))}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 	return
@@ -106,13 +127,29 @@ func (cmd *CommandDbInfo) ResponseLength() int64    { return 1 }
 func (cmd *CommandDbInfo) ResponseSignature() []int { return []int{REPLY_TYPE_STRING} }
 func (cmd *CommandDbInfo) Help() string             { return "TODO: CommandDbInfo text" }
 func (cmd *CommandDbInfo) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	c.ActiveDb.RLock()
+	var suffixInfo string = " SuffixIndex: off\n"
+	if c.ActiveDb.Suffixes != nil {
+		suffixInfo = fmt.Sprintf(" SuffixIndex: %v entries, ~%v bytes\n", c.ActiveDb.Suffixes.Entries, c.ActiveDb.Suffixes.Bytes)
+	}
+	if c.ActiveDb.BulkLoad != nil {
+		suffixInfo += c.ActiveDb.BulkLoad.String()
+	}
+	stats := c.ActiveDb.Stats()
+	c.ActiveDb.RUnlock()
 	dbInfo := fmt.Sprintf(`DBINFO for database %s:
  OpsCount: %v
  LastPersistOpsCount: %v
  PersistOpsLimit: %v
  LastPersistTime: %v
  PersistInterval: %v
-`, c.ActiveDb.Name, c.ActiveDb.OpsCount, c.ActiveDb.LastPersistOpsCount, c.ActiveDb.PersistOpsLimit, c.ActiveDb.LastPersistTime, c.ActiveDb.PersistInterval)
+ DecayHalfLife: %v
+ Normalization: %s
+ Members: %v
+ CountSum: %v
+ Nodes: %v
+ EstimatedBytes: %v
+%s`, c.ActiveDb.Name, c.ActiveDb.OpsCount, c.ActiveDb.LastPersistOpsCount, c.ActiveDb.PersistOpsLimit, c.ActiveDb.LastPersistTime, c.ActiveDb.PersistInterval, c.ActiveDb.Options.DecayHalfLife, NormalizationString(c.ActiveDb.Options.Normalization), stats.Members, stats.CountSum, stats.Nodes, stats.Bytes, suffixInfo)
 
 	reply = NewReply([][]byte{[]byte(dbInfo)}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 	return
@@ -130,6 +167,7 @@ func (cmd *CommandExit) ResponseLength() int64    { return 0 }
 func (cmd *CommandExit) ResponseSignature() []int { return []int{} }
 func (cmd *CommandExit) Help() string             { return "TODO: CommandExit text" }
 func (cmd *CommandExit) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	s.removeConnectionUploads(c)
 	s.InactiveClientIds <- string(c.Id)
 	reply = NewReply([][]byte{[]byte("")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 	return
@@ -151,6 +189,125 @@ func (cmd *CommandPing) Function(s *Server, c *ClientConnection, args ...interfa
 	return
 }
 
+/*
+CommandHello tells the server version and whether AUTH is needed
+*/
+type CommandHello struct{}
+
+func (cmd *CommandHello) Name() string             { return "HELLO" }
+func (cmd *CommandHello) Flags() int               { return COMMAND_FLAG_ADMIN }
+func (cmd *CommandHello) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandHello) ResponseLength() int64    { return 1 }
+func (cmd *CommandHello) ResponseSignature() []int { return []int{REPLY_TYPE_STRING} }
+func (cmd *CommandHello) Help() string             { return "HELLO [protocol]" }
+func (cmd *CommandHello) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) > 0 {
+		protocol, err := strconv.Atoi(args[0].(string))
+		if err != nil || protocol < MIN_PROTOCOL_VERSION || protocol > PROTOCOL_VERSION {
+			errMsg := fmt.Sprintf("Unsupported protocol %s. Supported are %d to %d.", args[0], MIN_PROTOCOL_VERSION, PROTOCOL_VERSION)
+			return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+		}
+		c.Protocol = protocol
+	}
+	hello := fmt.Sprintf("TriS %s protocol %d", VERSION, c.Protocol)
+	if s.AuthRequired() && !c.Authenticated {
+		hello += " AUTH required"
+	}
+	return NewReply([][]byte{[]byte(hello)}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandAuth authenticates the connection as a user
+*/
+type CommandAuth struct{}
+
+func (cmd *CommandAuth) Name() string             { return "AUTH" }
+func (cmd *CommandAuth) Flags() int               { return COMMAND_FLAG_ADMIN }
+func (cmd *CommandAuth) ResponseType() int        { return COMMAND_REPLY_EMPTY }
+func (cmd *CommandAuth) ResponseLength() int64    { return 0 }
+func (cmd *CommandAuth) ResponseSignature() []int { return []int{} }
+func (cmd *CommandAuth) Help() string             { return "AUTH user secret" }
+func (cmd *CommandAuth) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 2 {
+		return NewReply([][]byte{[]byte("Expected a user and a secret.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	if !s.AuthRequired() {
+		return NewReply([][]byte{[]byte("No users are configured.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	user := args[0].(string)
+	if !s.Authenticate(user, args[1].(string)) {
+		c.User, c.Authenticated = "", false
+		s.Log.Printf("Failed AUTH for user %s\n", user)
+		return NewReply([][]byte{[]byte("Invalid user or secret.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	c.User, c.Authenticated = user, true
+	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandACL lists and changes the ACL rules
+*/
+type CommandACL struct{}
+
+func (cmd *CommandACL) Name() string          { return "ACL" }
+func (cmd *CommandACL) Flags() int            { return COMMAND_FLAG_ADMIN }
+func (cmd *CommandACL) ResponseType() int     { return COMMAND_REPLY_MULTI }
+func (cmd *CommandACL) ResponseLength() int64 { return 3 }
+func (cmd *CommandACL) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_STRING}
+}
+func (cmd *CommandACL) Help() string {
+	return "ACL LIST | ACL SETUSER user READ,WRITE,ADMIN|ALL pattern,pattern | ACL DELUSER user"
+}
+func (cmd *CommandACL) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) == 0 {
+		return NewReply([][]byte{[]byte("Expected LIST, SETUSER or DELUSER.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	var err error
+	switch sub := strings.ToUpper(args[0].(string)); {
+	case sub == "LIST" && len(args) == 1:
+		return s.aclListReply()
+	case sub == "SETUSER" && len(args) == 4:
+		var flags int
+		flags, err = ParseACLFlags(args[2].(string))
+		if err == nil {
+			rule := &ACLRule{Flags: flags, DbPatterns: strings.Split(args[3].(string), ",")}
+			err = s.SetACLRule(c, args[1].(string), rule)
+		}
+	case sub == "DELUSER" && len(args) == 2:
+		var deleted bool
+		deleted, err = s.DeleteACLRule(args[1].(string))
+		if err == nil && !deleted {
+			err = errors.New(fmt.Sprintf("User %s has no ACL rule.", args[1]))
+		}
+	default:
+		err = errors.New(fmt.Sprintf("Usage: %s", cmd.Help()))
+	}
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{}, COMMAND_OK, 0, []int{})
+}
+
+/*
+CommandReady tells whether the server has loaded all data files. it
+fails with the loading progress until then
+*/
+type CommandReady struct{}
+
+func (cmd *CommandReady) Name() string             { return "READY" }
+func (cmd *CommandReady) Flags() int               { return COMMAND_FLAG_ADMIN }
+func (cmd *CommandReady) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandReady) ResponseLength() int64    { return 1 }
+func (cmd *CommandReady) ResponseSignature() []int { return []int{REPLY_TYPE_STRING} }
+func (cmd *CommandReady) Help() string             { return "READY" }
+func (cmd *CommandReady) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if !s.Ready() {
+		return s.loadingReply()
+	}
+	return NewReply([][]byte{[]byte(s.Loading.String())}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
 /*
 CommandSelect sets the actuve database on the server client (the connection)
 */
@@ -165,10 +322,16 @@ func (cmd *CommandSelect) Help() string             { return "TODO: CommandSelec
 func (cmd *CommandSelect) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
 	// name := string(args[0].([]byte))
 	name := args[0].(string)
+	if err := s.checkDbAccess(c, name); err != nil {
+		return permissionReply(err)
+	}
 	if !s.dbExists(name) {
 		err := fmt.Sprintf("Databases %s does not exist.", name)
 		return NewReply([][]byte{[]byte(err)}, COMMAND_FAIL, 1, cmd.ResponseSignature())
 	}
+	if err := s.ensureLoaded(s.Databases[name]); err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+	}
 	c.ActiveDb = s.Databases[name]
 	// c.ActiveDbName = name
 	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
@@ -184,10 +347,27 @@ func (cmd *CommandCreateTrie) Flags() int               { return COMMAND_FLAG_AD
 func (cmd *CommandCreateTrie) ResponseType() int        { return COMMAND_REPLY_EMPTY }
 func (cmd *CommandCreateTrie) ResponseLength() int64    { return 0 }
 func (cmd *CommandCreateTrie) ResponseSignature() []int { return []int{} }
-func (cmd *CommandCreateTrie) Help() string             { return "TODO: CommandCreateTrie text" }
+func (cmd *CommandCreateTrie) Help() string {
+	return "CREATE name [DECAY seconds] [NORMALIZE list] [SUFFIX]"
+}
 func (cmd *CommandCreateTrie) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
 	// name := string(args[0].([]byte))
 	name := args[0].(string)
+	if err := CheckDbName(name); err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	if err := s.checkDbAccess(c, name); err != nil {
+		return permissionReply(err)
+	}
+	var optArgs []string
+	for _, arg := range args[1:] {
+		optArgs = append(optArgs, arg.(string))
+	}
+	opts, err := ParseDatabaseOptions(optArgs)
+	if err != nil {
+		errMsg := fmt.Sprintf("Could not create db %s: %v", name, err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+	}
 	s.Lock()
 	defer s.Unlock()
 	if s.dbExists(name) {
@@ -195,7 +375,11 @@ func (cmd *CommandCreateTrie) Function(s *Server, c *ClientConnection, args ...i
 		return NewReply([][]byte{[]byte(err)}, COMMAND_FAIL, 1, cmd.ResponseSignature())
 	}
 	s.NewDatabase(name)
-	err := s.Databases[name].Persist(fmt.Sprintf("%s/%s%s", s.Config.DataDir, s.Config.StorageFilePrefix, name))
+	s.Databases[name].Options = opts
+	s.Databases[name].RebuildSuffixIndex()
+	// make sure the new db gets written even though nothing was added yet
+	s.Databases[name].OpsCount += 1
+	err = s.Databases[name].Persist(fmt.Sprintf("%s/%s%s", s.Config.DataDir, s.Config.StorageFilePrefix, name))
 	if err != nil {
 		errMsg := fmt.Sprintf("Could persist the new db %s: %v", name, err)
 		s.Log.Println(errMsg)
@@ -204,6 +388,84 @@ func (cmd *CommandCreateTrie) Function(s *Server, c *ClientConnection, args ...i
 	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 }
 
+/*
+CommandCopyDb copies a database to a new name
+*/
+type CommandCopyDb struct{}
+
+func (cmd *CommandCopyDb) Name() string             { return "COPY" }
+func (cmd *CommandCopyDb) Flags() int               { return COMMAND_FLAG_ADMIN | COMMAND_FLAG_WRITE }
+func (cmd *CommandCopyDb) ResponseType() int        { return COMMAND_REPLY_EMPTY }
+func (cmd *CommandCopyDb) ResponseLength() int64    { return 0 }
+func (cmd *CommandCopyDb) ResponseSignature() []int { return []int{} }
+func (cmd *CommandCopyDb) Help() string             { return "COPY src dst" }
+func (cmd *CommandCopyDb) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 2 {
+		return NewReply([][]byte{[]byte("Expected two database names.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	if err := s.checkDbAccess(c, args[0].(string), args[1].(string)); err != nil {
+		return permissionReply(err)
+	}
+	err := s.CopyDatabase(args[0].(string), args[1].(string))
+	if err != nil {
+		s.Log.Println(err)
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandRenameDb moves a database to a new name
+*/
+type CommandRenameDb struct{}
+
+func (cmd *CommandRenameDb) Name() string             { return "RENAME" }
+func (cmd *CommandRenameDb) Flags() int               { return COMMAND_FLAG_ADMIN | COMMAND_FLAG_WRITE }
+func (cmd *CommandRenameDb) ResponseType() int        { return COMMAND_REPLY_EMPTY }
+func (cmd *CommandRenameDb) ResponseLength() int64    { return 0 }
+func (cmd *CommandRenameDb) ResponseSignature() []int { return []int{} }
+func (cmd *CommandRenameDb) Help() string             { return "RENAME src dst" }
+func (cmd *CommandRenameDb) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 2 {
+		return NewReply([][]byte{[]byte("Expected two database names.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	if err := s.checkDbAccess(c, args[0].(string), args[1].(string)); err != nil {
+		return permissionReply(err)
+	}
+	err := s.RenameDatabase(args[0].(string), args[1].(string))
+	if err != nil {
+		s.Log.Println(err)
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandSwapDb exchanges the contents of two databases
+*/
+type CommandSwapDb struct{}
+
+func (cmd *CommandSwapDb) Name() string             { return "SWAP" }
+func (cmd *CommandSwapDb) Flags() int               { return COMMAND_FLAG_ADMIN | COMMAND_FLAG_WRITE }
+func (cmd *CommandSwapDb) ResponseType() int        { return COMMAND_REPLY_EMPTY }
+func (cmd *CommandSwapDb) ResponseLength() int64    { return 0 }
+func (cmd *CommandSwapDb) ResponseSignature() []int { return []int{} }
+func (cmd *CommandSwapDb) Help() string             { return "SWAP a b" }
+func (cmd *CommandSwapDb) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 2 {
+		return NewReply([][]byte{[]byte("Expected two database names.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	if err := s.checkDbAccess(c, args[0].(string), args[1].(string)); err != nil {
+		return permissionReply(err)
+	}
+	err := s.SwapDatabases(args[0].(string), args[1].(string))
+	if err != nil {
+		s.Log.Println(err)
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
 /*
 CommandAdd maps to Trie.Add()
 */
@@ -217,7 +479,9 @@ func (cmd *CommandAdd) ResponseSignature() []int { return []int{REPLY_TYPE_INT}
 func (cmd *CommandAdd) Help() string             { return "TODO: CommandAdd text" }
 func (cmd *CommandAdd) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
 	key := args[0].(string)
-	b := c.ActiveDb.Db.Add(key)
+	c.ActiveDb.Lock()
+	b := c.ActiveDb.Add(key)
+	c.ActiveDb.Unlock()
 	return NewReply([][]byte{[]byte(encodeIntReply(b.Count))}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 }
 
@@ -234,12 +498,99 @@ func (cmd *CommandDel) ResponseSignature() []int { return []int{REPLY_TYPE_BOOL}
 func (cmd *CommandDel) Help() string             { return "TODO: CommandDel text" }
 func (cmd *CommandDel) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
 	key := args[0].(string)
-	if c.ActiveDb.Db.Delete(key) {
+	c.ActiveDb.Lock()
+	deleted := c.ActiveDb.Delete(key)
+	c.ActiveDb.Unlock()
+	if deleted {
 		return NewReply([][]byte{[]byte("TRUE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 	}
 	return NewReply([][]byte{[]byte("FALSE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 }
 
+/*
+CommandMAdd maps to Trie.Add() for a batch of keys
+*/
+type CommandMAdd struct{}
+
+func (cmd *CommandMAdd) Name() string             { return "MADD" }
+func (cmd *CommandMAdd) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandMAdd) ResponseType() int        { return COMMAND_REPLY_MULTI }
+func (cmd *CommandMAdd) ResponseLength() int64    { return 2 }
+func (cmd *CommandMAdd) ResponseSignature() []int { return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT} }
+func (cmd *CommandMAdd) Help() string             { return "MADD key [key ...]: add keys, reply count per key" }
+func (cmd *CommandMAdd) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) == 0 {
+		return NewReply([][]byte{[]byte("MADD needs at least one key.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	var mrep [][]byte
+	c.ActiveDb.Lock()
+	for _, arg := range args {
+		key := arg.(string)
+		b := c.ActiveDb.Add(key)
+		mrep = append(mrep, []byte(key), encodeIntReply(b.Count))
+	}
+	c.ActiveDb.Unlock()
+	return NewReply(mrep, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandMDel maps to Trie.Delete() for a batch of keys
+*/
+type CommandMDel struct{}
+
+func (cmd *CommandMDel) Name() string             { return "MDEL" }
+func (cmd *CommandMDel) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandMDel) ResponseType() int        { return COMMAND_REPLY_MULTI }
+func (cmd *CommandMDel) ResponseLength() int64    { return 2 }
+func (cmd *CommandMDel) ResponseSignature() []int { return []int{REPLY_TYPE_STRING, REPLY_TYPE_BOOL} }
+func (cmd *CommandMDel) Help() string             { return "MDEL key [key ...]: delete keys, reply per key" }
+func (cmd *CommandMDel) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) == 0 {
+		return NewReply([][]byte{[]byte("MDEL needs at least one key.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	var mrep [][]byte
+	c.ActiveDb.Lock()
+	for _, arg := range args {
+		key := arg.(string)
+		if c.ActiveDb.Delete(key) {
+			mrep = append(mrep, []byte(key), []byte("TRUE"))
+		} else {
+			mrep = append(mrep, []byte(key), []byte("FALSE"))
+		}
+	}
+	c.ActiveDb.Unlock()
+	return NewReply(mrep, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandMHas maps to Trie.Has() for a batch of keys
+*/
+type CommandMHas struct{}
+
+func (cmd *CommandMHas) Name() string             { return "MHAS" }
+func (cmd *CommandMHas) Flags() int               { return COMMAND_FLAG_READ }
+func (cmd *CommandMHas) ResponseType() int        { return COMMAND_REPLY_MULTI }
+func (cmd *CommandMHas) ResponseLength() int64    { return 2 }
+func (cmd *CommandMHas) ResponseSignature() []int { return []int{REPLY_TYPE_STRING, REPLY_TYPE_BOOL} }
+func (cmd *CommandMHas) Help() string             { return "MHAS key [key ...]: check keys, reply per key" }
+func (cmd *CommandMHas) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) == 0 {
+		return NewReply([][]byte{[]byte("MHAS needs at least one key.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	var mrep [][]byte
+	c.ActiveDb.RLock()
+	for _, arg := range args {
+		key := arg.(string)
+		if c.ActiveDb.Has(key) {
+			mrep = append(mrep, []byte(key), []byte("TRUE"))
+		} else {
+			mrep = append(mrep, []byte(key), []byte("FALSE"))
+		}
+	}
+	c.ActiveDb.RUnlock()
+	return NewReply(mrep, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
 /*
 CommandHas maps to Trie.Has()
 */
@@ -250,10 +601,25 @@ func (cmd *CommandHas) Flags() int               { return COMMAND_FLAG_READ }
 func (cmd *CommandHas) ResponseType() int        { return COMMAND_REPLY_SINGLE }
 func (cmd *CommandHas) ResponseLength() int64    { return 1 }
 func (cmd *CommandHas) ResponseSignature() []int { return []int{REPLY_TYPE_BOOL} }
-func (cmd *CommandHas) Help() string             { return "TODO: CommandHas text" }
+func (cmd *CommandHas) Help() string             { return "HAS key [IN db,db [MERGE]]" }
 func (cmd *CommandHas) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	args, dbNames, merge := splitInArgs(args)
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("HAS needs a key.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
 	key := args[0].(string)
-	if c.ActiveDb.Db.Has(key) {
+	if dbNames != nil {
+		dbs, err := s.databasesByName(c, dbNames)
+		if err != nil {
+			return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+		}
+		defer releaseDatabases(dbs)
+		return multiHasReply(dbs, key, merge)
+	}
+	c.ActiveDb.RLock()
+	exists := c.ActiveDb.Has(key)
+	c.ActiveDb.RUnlock()
+	if exists {
 		return NewReply([][]byte{[]byte("TRUE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 	}
 	return NewReply([][]byte{[]byte("FALSE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
@@ -269,10 +635,100 @@ func (cmd *CommandHasCount) Flags() int               { return COMMAND_FLAG_READ
 func (cmd *CommandHasCount) ResponseType() int        { return COMMAND_REPLY_SINGLE }
 func (cmd *CommandHasCount) ResponseLength() int64    { return 1 }
 func (cmd *CommandHasCount) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
-func (cmd *CommandHasCount) Help() string             { return "TODO: CommandHasCount text" }
+func (cmd *CommandHasCount) Help() string             { return "HASCOUNT key [IN db,db [MERGE]]" }
 func (cmd *CommandHasCount) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	args, dbNames, merge := splitInArgs(args)
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("HASCOUNT needs a key.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	key := args[0].(string)
+	if dbNames != nil {
+		dbs, err := s.databasesByName(c, dbNames)
+		if err != nil {
+			return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+		}
+		defer releaseDatabases(dbs)
+		return multiHasCountReply(dbs, key, merge)
+	}
+	c.ActiveDb.RLock()
+	_, count := c.ActiveDb.HasCount(key)
+	c.ActiveDb.RUnlock()
+	return NewReply([][]byte{[]byte(encodeIntReply(count))}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandGetCount returns the count of a key - 0 for keys that do not exist
+*/
+type CommandGetCount struct{}
+
+func (cmd *CommandGetCount) Name() string             { return "GETCOUNT" }
+func (cmd *CommandGetCount) Flags() int               { return COMMAND_FLAG_READ }
+func (cmd *CommandGetCount) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandGetCount) ResponseLength() int64    { return 1 }
+func (cmd *CommandGetCount) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandGetCount) Help() string             { return "GETCOUNT key: reply the count of key" }
+func (cmd *CommandGetCount) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("GETCOUNT needs a key.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
 	key := args[0].(string)
-	_, count := c.ActiveDb.Db.HasCount(key)
+	c.ActiveDb.RLock()
+	_, count := c.ActiveDb.HasCount(key)
+	c.ActiveDb.RUnlock()
+	return NewReply([][]byte{[]byte(encodeIntReply(count))}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandIncrBy adds n to the count of a key. keys reaching a count of zero get deleted.
+*/
+type CommandIncrBy struct{}
+
+func (cmd *CommandIncrBy) Name() string             { return "INCRBY" }
+func (cmd *CommandIncrBy) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandIncrBy) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandIncrBy) ResponseLength() int64    { return 1 }
+func (cmd *CommandIncrBy) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandIncrBy) Help() string             { return "INCRBY key n: add n to the count of key" }
+func (cmd *CommandIncrBy) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	key, n, err := keyCountArgs(args)
+	if err != nil {
+		errMsg := fmt.Sprintf("INCRBY: %v", err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	c.ActiveDb.Lock()
+	count, err := c.ActiveDb.IncrBy(key, n)
+	c.ActiveDb.Unlock()
+	if err != nil {
+		errMsg := fmt.Sprintf("INCRBY: %v", err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{[]byte(encodeIntReply(count))}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandSetCount sets the count of a key. a count of zero deletes the key.
+*/
+type CommandSetCount struct{}
+
+func (cmd *CommandSetCount) Name() string             { return "SETCOUNT" }
+func (cmd *CommandSetCount) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandSetCount) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandSetCount) ResponseLength() int64    { return 1 }
+func (cmd *CommandSetCount) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandSetCount) Help() string             { return "SETCOUNT key n: set the count of key to n" }
+func (cmd *CommandSetCount) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	key, n, err := keyCountArgs(args)
+	if err != nil {
+		errMsg := fmt.Sprintf("SETCOUNT: %v", err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	c.ActiveDb.Lock()
+	count, err := c.ActiveDb.SetCount(key, n)
+	c.ActiveDb.Unlock()
+	if err != nil {
+		errMsg := fmt.Sprintf("SETCOUNT: %v", err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
 	return NewReply([][]byte{[]byte(encodeIntReply(count))}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 }
 
@@ -289,12 +745,445 @@ func (cmd *CommandHasPrefix) ResponseSignature() []int { return []int{REPLY_TYPE
 func (cmd *CommandHasPrefix) Help() string             { return "TODO: CommandHasPrefix text" }
 func (cmd *CommandHasPrefix) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
 	key := args[0].(string)
-	if c.ActiveDb.Db.HasPrefix(key) {
+	c.ActiveDb.RLock()
+	exists := c.ActiveDb.HasPrefix(key)
+	c.ActiveDb.RUnlock()
+	if exists {
 		return NewReply([][]byte{[]byte("TRUE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 	}
 	return NewReply([][]byte{[]byte("FALSE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 }
 
+/*
+CommandDelPrefix deletes all keys starting with a prefix
+*/
+type CommandDelPrefix struct{}
+
+func (cmd *CommandDelPrefix) Name() string             { return "DELPREFIX" }
+func (cmd *CommandDelPrefix) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandDelPrefix) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandDelPrefix) ResponseLength() int64    { return 1 }
+func (cmd *CommandDelPrefix) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandDelPrefix) Help() string             { return "DELPREFIX prefix: delete all keys under prefix" }
+func (cmd *CommandDelPrefix) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("DELPREFIX needs a prefix.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	prefix := args[0].(string)
+	c.ActiveDb.Lock()
+	deleted := c.ActiveDb.DelPrefix(prefix)
+	c.ActiveDb.Unlock()
+	return NewReply([][]byte{encodeIntReply(deleted)}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandCountPrefix returns the number of keys under a prefix and the sum of their counts
+*/
+type CommandCountPrefix struct{}
+
+func (cmd *CommandCountPrefix) Name() string          { return "COUNTPREFIX" }
+func (cmd *CommandCountPrefix) Flags() int            { return COMMAND_FLAG_READ }
+func (cmd *CommandCountPrefix) ResponseType() int     { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandCountPrefix) ResponseLength() int64 { return 2 }
+func (cmd *CommandCountPrefix) ResponseSignature() []int {
+	return []int{REPLY_TYPE_INT, REPLY_TYPE_INT}
+}
+func (cmd *CommandCountPrefix) Help() string { return "COUNTPREFIX prefix: reply key nr and count sum" }
+func (cmd *CommandCountPrefix) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("COUNTPREFIX needs a prefix.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	prefix := args[0].(string)
+	c.ActiveDb.RLock()
+	keys, sum := c.ActiveDb.CountPrefix(prefix)
+	c.ActiveDb.RUnlock()
+	return NewReply([][]byte{encodeIntReply(keys), encodeIntReply(sum)}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandSet attaches a value to a key
+*/
+type CommandSet struct{}
+
+func (cmd *CommandSet) Name() string             { return "SET" }
+func (cmd *CommandSet) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandSet) ResponseType() int        { return COMMAND_REPLY_EMPTY }
+func (cmd *CommandSet) ResponseLength() int64    { return 0 }
+func (cmd *CommandSet) ResponseSignature() []int { return []int{} }
+func (cmd *CommandSet) Help() string             { return "SET key value: attach value to key" }
+func (cmd *CommandSet) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) < 2 {
+		return NewReply([][]byte{[]byte("SET needs a key and a value.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	key := args[0].(string)
+	var parts []string
+	for _, arg := range args[1:] {
+		parts = append(parts, arg.(string))
+	}
+	c.ActiveDb.Lock()
+	c.ActiveDb.SetValue(key, []byte(strings.Join(parts, " ")))
+	c.ActiveDb.Unlock()
+	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandGet returns the value attached to a key
+*/
+type CommandGet struct{}
+
+func (cmd *CommandGet) Name() string             { return "GET" }
+func (cmd *CommandGet) Flags() int               { return COMMAND_FLAG_READ }
+func (cmd *CommandGet) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandGet) ResponseLength() int64    { return 1 }
+func (cmd *CommandGet) ResponseSignature() []int { return []int{REPLY_TYPE_BYTES} }
+func (cmd *CommandGet) Help() string             { return "GET key: reply the value of key" }
+func (cmd *CommandGet) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("GET needs a key.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	key := args[0].(string)
+	c.ActiveDb.RLock()
+	value, exists := c.ActiveDb.Value(key)
+	c.ActiveDb.RUnlock()
+	if !exists {
+		err := fmt.Sprintf("Key %s does not exist.", key)
+		return NewReply([][]byte{[]byte(err)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{value}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandPrefixGet returns all keys under a prefix that have a value attached
+*/
+type CommandPrefixGet struct{}
+
+func (cmd *CommandPrefixGet) Name() string          { return "PREFIXGET" }
+func (cmd *CommandPrefixGet) Flags() int            { return COMMAND_FLAG_READ }
+func (cmd *CommandPrefixGet) ResponseType() int     { return COMMAND_REPLY_MULTI }
+func (cmd *CommandPrefixGet) ResponseLength() int64 { return 2 }
+func (cmd *CommandPrefixGet) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_BYTES}
+}
+func (cmd *CommandPrefixGet) Help() string { return "PREFIXGET prefix: reply keys with values" }
+func (cmd *CommandPrefixGet) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("PREFIXGET needs a prefix.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	prefix := args[0].(string)
+	var mrep [][]byte
+	c.ActiveDb.RLock()
+	defer c.ActiveDb.RUnlock()
+	for _, m := range c.ActiveDb.PrefixMembers(prefix) {
+		if value, exists := c.ActiveDb.Values[m.Value]; exists {
+			mrep = append(mrep, []byte(c.ActiveDb.DisplayKey(m.Value)), value)
+		}
+	}
+	return NewReply(mrep, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandAddEx maps to Trie.Add() and sets a ttl on the key
+*/
+type CommandAddEx struct{}
+
+func (cmd *CommandAddEx) Name() string             { return "ADDEX" }
+func (cmd *CommandAddEx) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandAddEx) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandAddEx) ResponseLength() int64    { return 1 }
+func (cmd *CommandAddEx) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandAddEx) Help() string             { return "ADDEX key seconds: add key with a ttl" }
+func (cmd *CommandAddEx) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	key, seconds, err := keyCountArgs(args)
+	if err != nil {
+		errMsg := fmt.Sprintf("ADDEX: %v", err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	c.ActiveDb.Lock()
+	b := c.ActiveDb.Add(key)
+	c.ActiveDb.Expire(key, time.Duration(seconds)*time.Second)
+	c.ActiveDb.Unlock()
+	return NewReply([][]byte{encodeIntReply(b.Count)}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandExpire sets the ttl of a key
+*/
+type CommandExpire struct{}
+
+func (cmd *CommandExpire) Name() string             { return "EXPIRE" }
+func (cmd *CommandExpire) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandExpire) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandExpire) ResponseLength() int64    { return 1 }
+func (cmd *CommandExpire) ResponseSignature() []int { return []int{REPLY_TYPE_BOOL} }
+func (cmd *CommandExpire) Help() string             { return "EXPIRE key seconds: set the ttl of key" }
+func (cmd *CommandExpire) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	key, seconds, err := keyCountArgs(args)
+	if err != nil {
+		errMsg := fmt.Sprintf("EXPIRE: %v", err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	c.ActiveDb.Lock()
+	exists := c.ActiveDb.Expire(key, time.Duration(seconds)*time.Second)
+	c.ActiveDb.Unlock()
+	if exists {
+		return NewReply([][]byte{[]byte("TRUE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+	}
+	return NewReply([][]byte{[]byte("FALSE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandTTL returns the remaining ttl of a key in seconds. -1 means the
+key does not expire, -2 that it does not exist.
+*/
+type CommandTTL struct{}
+
+func (cmd *CommandTTL) Name() string             { return "TTL" }
+func (cmd *CommandTTL) Flags() int               { return COMMAND_FLAG_READ }
+func (cmd *CommandTTL) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandTTL) ResponseLength() int64    { return 1 }
+func (cmd *CommandTTL) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandTTL) Help() string             { return "TTL key: reply the ttl of key in seconds" }
+func (cmd *CommandTTL) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("TTL needs a key.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	key := args[0].(string)
+	c.ActiveDb.RLock()
+	ttl := c.ActiveDb.TTL(key)
+	c.ActiveDb.RUnlock()
+	return NewReply([][]byte{encodeIntReply(ttl)}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandPersistKey removes the ttl of a key
+*/
+type CommandPersistKey struct{}
+
+func (cmd *CommandPersistKey) Name() string             { return "PERSIST" }
+func (cmd *CommandPersistKey) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandPersistKey) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandPersistKey) ResponseLength() int64    { return 1 }
+func (cmd *CommandPersistKey) ResponseSignature() []int { return []int{REPLY_TYPE_BOOL} }
+func (cmd *CommandPersistKey) Help() string             { return "PERSIST key: remove the ttl of key" }
+func (cmd *CommandPersistKey) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("PERSIST needs a key.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	key := args[0].(string)
+	c.ActiveDb.Lock()
+	removed := c.ActiveDb.PersistKey(key)
+	c.ActiveDb.Unlock()
+	if removed {
+		return NewReply([][]byte{[]byte("TRUE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+	}
+	return NewReply([][]byte{[]byte("FALSE")}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandSuffixMembers returns all keys ending with a suffix
+*/
+type CommandSuffixMembers struct{}
+
+func (cmd *CommandSuffixMembers) Name() string          { return "SUFFIXMEMBERS" }
+func (cmd *CommandSuffixMembers) Flags() int            { return COMMAND_FLAG_READ }
+func (cmd *CommandSuffixMembers) ResponseType() int     { return COMMAND_REPLY_MULTI }
+func (cmd *CommandSuffixMembers) ResponseLength() int64 { return 3 }
+func (cmd *CommandSuffixMembers) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT, REPLY_TYPE_BYTES}
+}
+func (cmd *CommandSuffixMembers) Help() string { return "SUFFIXMEMBERS suffix [SORT COUNT|SCORE]" }
+func (cmd *CommandSuffixMembers) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	return suffixIndexReply(c.ActiveDb, cmd.Name(), cmd.ResponseSignature(), args, c.ActiveDb.SuffixMembers, c.Protocol)
+}
+
+/*
+CommandContains returns all keys containing a string
+*/
+type CommandContains struct{}
+
+func (cmd *CommandContains) Name() string          { return "CONTAINS" }
+func (cmd *CommandContains) Flags() int            { return COMMAND_FLAG_READ }
+func (cmd *CommandContains) ResponseType() int     { return COMMAND_REPLY_MULTI }
+func (cmd *CommandContains) ResponseLength() int64 { return 3 }
+func (cmd *CommandContains) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT, REPLY_TYPE_BYTES}
+}
+func (cmd *CommandContains) Help() string { return "CONTAINS string [SORT COUNT|SCORE]" }
+func (cmd *CommandContains) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	return suffixIndexReply(c.ActiveDb, cmd.Name(), cmd.ResponseSignature(), args, c.ActiveDb.ContainsMembers, c.Protocol)
+}
+
+/*
+suffixIndexReply runs the suffix index lookup of SUFFIXMEMBERS and
+CONTAINS.
+*/
+func suffixIndexReply(d *Database, name string, signature []int, args []interface{}, lookup func(string) []*trie.MemberInfo, protocol int) (reply *Reply) {
+	if len(args) == 0 {
+		errMsg := fmt.Sprintf("%s needs a search string.", name)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	d.RLock()
+	defer d.RUnlock()
+	if d.Suffixes == nil {
+		errMsg := fmt.Sprintf("Database %s has no suffix index.", d.Name)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	sortBy, err := parseSortArgs(d, args[1:])
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	mrep, signature := memberRows(d, lookup(args[0].(string)), sortBy, signature, protocol)
+	return NewReply(mrep, COMMAND_OK, int64(len(signature)), signature)
+}
+
+/*
+CommandLongestPrefix returns the longest key that is a prefix of the input
+*/
+type CommandLongestPrefix struct{}
+
+func (cmd *CommandLongestPrefix) Name() string          { return "LONGESTPREFIX" }
+func (cmd *CommandLongestPrefix) Flags() int            { return COMMAND_FLAG_READ }
+func (cmd *CommandLongestPrefix) ResponseType() int     { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandLongestPrefix) ResponseLength() int64 { return 3 }
+func (cmd *CommandLongestPrefix) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT, REPLY_TYPE_BYTES}
+}
+func (cmd *CommandLongestPrefix) Help() string { return "LONGESTPREFIX input" }
+func (cmd *CommandLongestPrefix) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("LONGESTPREFIX needs an input.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	c.ActiveDb.RLock()
+	defer c.ActiveDb.RUnlock()
+	prefixes := c.ActiveDb.PrefixesOf(args[0].(string))
+	if len(prefixes) > 0 {
+		prefixes = prefixes[len(prefixes)-1:]
+	}
+	mrep, signature := memberRows(c.ActiveDb, prefixes, "", cmd.ResponseSignature(), c.Protocol)
+	return NewReply(mrep, COMMAND_OK, int64(len(signature)), signature)
+}
+
+/*
+CommandAllPrefixes returns all keys that are a prefix of the input, shortest first
+*/
+type CommandAllPrefixes struct{}
+
+func (cmd *CommandAllPrefixes) Name() string          { return "ALLPREFIXES" }
+func (cmd *CommandAllPrefixes) Flags() int            { return COMMAND_FLAG_READ }
+func (cmd *CommandAllPrefixes) ResponseType() int     { return COMMAND_REPLY_MULTI }
+func (cmd *CommandAllPrefixes) ResponseLength() int64 { return 3 }
+func (cmd *CommandAllPrefixes) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT, REPLY_TYPE_BYTES}
+}
+func (cmd *CommandAllPrefixes) Help() string { return "ALLPREFIXES input" }
+func (cmd *CommandAllPrefixes) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 {
+		return NewReply([][]byte{[]byte("ALLPREFIXES needs an input.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	c.ActiveDb.RLock()
+	defer c.ActiveDb.RUnlock()
+	mrep, signature := memberRows(c.ActiveDb, c.ActiveDb.PrefixesOf(args[0].(string)), "", cmd.ResponseSignature(), c.Protocol)
+	return NewReply(mrep, COMMAND_OK, int64(len(signature)), signature)
+}
+
+/*
+CommandUnion returns the union of databases
+*/
+type CommandUnion struct{}
+
+func (cmd *CommandUnion) Name() string             { return "UNION" }
+func (cmd *CommandUnion) Flags() int               { return COMMAND_FLAG_READ }
+func (cmd *CommandUnion) ResponseType() int        { return COMMAND_REPLY_MULTI }
+func (cmd *CommandUnion) ResponseLength() int64    { return 2 }
+func (cmd *CommandUnion) ResponseSignature() []int { return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT} }
+func (cmd *CommandUnion) Help() string             { return "UNION src src [src ...] [COMBINE SUM|MIN|MAX]" }
+func (cmd *CommandUnion) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	return setOpReply(s, c, SETOP_UNION, args)
+}
+
+/*
+CommandUnionStore stores the union of databases in a destination database
+*/
+type CommandUnionStore struct{}
+
+func (cmd *CommandUnionStore) Name() string             { return "UNIONSTORE" }
+func (cmd *CommandUnionStore) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandUnionStore) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandUnionStore) ResponseLength() int64    { return 1 }
+func (cmd *CommandUnionStore) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandUnionStore) Help() string {
+	return "UNIONSTORE dst src src [src ...] [COMBINE SUM|MIN|MAX]"
+}
+func (cmd *CommandUnionStore) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	return setOpStoreReply(s, c, SETOP_UNION, args)
+}
+
+/*
+CommandIntersect returns the keys that are in all databases
+*/
+type CommandIntersect struct{}
+
+func (cmd *CommandIntersect) Name() string          { return "INTERSECT" }
+func (cmd *CommandIntersect) Flags() int            { return COMMAND_FLAG_READ }
+func (cmd *CommandIntersect) ResponseType() int     { return COMMAND_REPLY_MULTI }
+func (cmd *CommandIntersect) ResponseLength() int64 { return 2 }
+func (cmd *CommandIntersect) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT}
+}
+func (cmd *CommandIntersect) Help() string {
+	return "INTERSECT src src [src ...] [COMBINE SUM|MIN|MAX]"
+}
+func (cmd *CommandIntersect) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	return setOpReply(s, c, SETOP_INTERSECT, args)
+}
+
+/*
+CommandIntersectStore stores the keys that are in all databases in a destination database
+*/
+type CommandIntersectStore struct{}
+
+func (cmd *CommandIntersectStore) Name() string             { return "INTERSECTSTORE" }
+func (cmd *CommandIntersectStore) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandIntersectStore) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandIntersectStore) ResponseLength() int64    { return 1 }
+func (cmd *CommandIntersectStore) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandIntersectStore) Help() string {
+	return "INTERSECTSTORE dst src src [src ...] [COMBINE SUM|MIN|MAX]"
+}
+func (cmd *CommandIntersectStore) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	return setOpStoreReply(s, c, SETOP_INTERSECT, args)
+}
+
+/*
+CommandDiff returns the keys of the first database that are in none of the others
+*/
+type CommandDiff struct{}
+
+func (cmd *CommandDiff) Name() string             { return "DIFF" }
+func (cmd *CommandDiff) Flags() int               { return COMMAND_FLAG_READ }
+func (cmd *CommandDiff) ResponseType() int        { return COMMAND_REPLY_MULTI }
+func (cmd *CommandDiff) ResponseLength() int64    { return 2 }
+func (cmd *CommandDiff) ResponseSignature() []int { return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT} }
+func (cmd *CommandDiff) Help() string             { return "DIFF src src [src ...]" }
+func (cmd *CommandDiff) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	return setOpReply(s, c, SETOP_DIFF, args)
+}
+
+/*
+CommandDiffStore stores the keys of the first database that are in none of the others in a destination database
+*/
+type CommandDiffStore struct{}
+
+func (cmd *CommandDiffStore) Name() string             { return "DIFFSTORE" }
+func (cmd *CommandDiffStore) Flags() int               { return COMMAND_FLAG_WRITE }
+func (cmd *CommandDiffStore) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandDiffStore) ResponseLength() int64    { return 1 }
+func (cmd *CommandDiffStore) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandDiffStore) Help() string             { return "DIFFSTORE dst src src [src ...]" }
+func (cmd *CommandDiffStore) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	return setOpStoreReply(s, c, SETOP_DIFF, args)
+}
+
 /*
 CommandTree maps to Trie.Dump()
 */
@@ -315,24 +1204,23 @@ CommandMembers maps to Trie.Members()
 */
 type CommandMembers struct{}
 
-func (cmd *CommandMembers) Name() string             { return "MEMBERS" }
-func (cmd *CommandMembers) Flags() int               { return COMMAND_FLAG_READ }
-func (cmd *CommandMembers) ResponseType() int        { return COMMAND_REPLY_MULTI }
-func (cmd *CommandMembers) ResponseLength() int64    { return 2 }
-func (cmd *CommandMembers) ResponseSignature() []int { return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT} }
-func (cmd *CommandMembers) Help() string             { return "TODO: CommandMembers text" }
+func (cmd *CommandMembers) Name() string          { return "MEMBERS" }
+func (cmd *CommandMembers) Flags() int            { return COMMAND_FLAG_READ }
+func (cmd *CommandMembers) ResponseType() int     { return COMMAND_REPLY_MULTI }
+func (cmd *CommandMembers) ResponseLength() int64 { return 3 }
+func (cmd *CommandMembers) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT, REPLY_TYPE_BYTES}
+}
+func (cmd *CommandMembers) Help() string { return "MEMBERS [SORT COUNT|SCORE]" }
 func (cmd *CommandMembers) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
-	var mrep [][]byte
-	for _, m := range c.ActiveDb.Db.Members() {
-		mrep = append(mrep, []byte(m.Value), encodeIntReply(m.Count))
-		// count := make([]byte, 4)
-		// _ = binary.PutVarint(count, m.Count)
-		// mrep = append(mrep, []byte(m.Value), count)
-		// mrep = append(mrep, []byte(m.Value), []byte(string(m.Count)))
-		// s.Log.Println(string(m.Count), []byte(string(m.Count)))
+	c.ActiveDb.RLock()
+	defer c.ActiveDb.RUnlock()
+	sortBy, err := parseSortArgs(c.ActiveDb, args)
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
 	}
-
-	return NewReply(mrep, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+	mrep, signature := memberRows(c.ActiveDb, c.ActiveDb.Members(), sortBy, cmd.ResponseSignature(), c.Protocol)
+	return NewReply(mrep, COMMAND_OK, int64(len(signature)), signature)
 }
 
 /*
@@ -343,22 +1231,45 @@ type CommandPrefixMembers struct{}
 func (cmd *CommandPrefixMembers) Name() string          { return "PREFIXMEMBERS" }
 func (cmd *CommandPrefixMembers) Flags() int            { return COMMAND_FLAG_READ }
 func (cmd *CommandPrefixMembers) ResponseType() int     { return COMMAND_REPLY_MULTI }
-func (cmd *CommandPrefixMembers) ResponseLength() int64 { return 2 }
+func (cmd *CommandPrefixMembers) ResponseLength() int64 { return 3 }
 func (cmd *CommandPrefixMembers) ResponseSignature() []int {
-	return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT}
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_INT, REPLY_TYPE_BYTES}
+}
+func (cmd *CommandPrefixMembers) Help() string {
+	return "PREFIXMEMBERS prefix [SORT COUNT|SCORE] [IN db,db [MERGE]]"
 }
-func (cmd *CommandPrefixMembers) Help() string { return "TODO: CommandPrefixMembers text" }
 func (cmd *CommandPrefixMembers) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	args, dbNames, merge := splitInArgs(args)
+	if len(args) == 0 {
+		return NewReply([][]byte{[]byte("PREFIXMEMBERS needs a prefix.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
 	key := args[0].(string)
-	var mrep [][]byte
-	for _, m := range c.ActiveDb.Db.PrefixMembers(key) {
-		count := make([]byte, 4)
-		_ = binary.PutVarint(count, m.Count)
-		mrep = append(mrep, []byte(m.Value), count)
-		// mrep = append(mrep, []byte(m.Value), []byte(string(m.Count)))
+	if dbNames != nil {
+		dbs, err := s.databasesByName(c, dbNames)
+		if err != nil {
+			return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+		}
+		defer releaseDatabases(dbs)
+		var sortBy string
+		if len(args) > 1 {
+			sortBy, err = parseSortArgs(dbs[0], args[1:])
+			if err == nil && sortBy != SORT_BY_COUNT {
+				err = errors.New("Only SORT COUNT is supported with IN.")
+			}
+			if err != nil {
+				return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+			}
+		}
+		return multiPrefixMembersReply(dbs, key, sortBy, merge)
 	}
-
-	return NewReply(mrep, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+	c.ActiveDb.RLock()
+	defer c.ActiveDb.RUnlock()
+	sortBy, err := parseSortArgs(c.ActiveDb, args[1:])
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	mrep, signature := memberRows(c.ActiveDb, c.ActiveDb.PrefixMembers(key), sortBy, cmd.ResponseSignature(), c.Protocol)
+	return NewReply(mrep, COMMAND_OK, int64(len(signature)), signature)
 }
 
 /*
@@ -391,10 +1302,36 @@ func (cmd *CommandImportDb) Flags() int               { return COMMAND_FLAG_ADMI
 func (cmd *CommandImportDb) ResponseType() int        { return COMMAND_REPLY_EMPTY }
 func (cmd *CommandImportDb) ResponseLength() int64    { return 0 }
 func (cmd *CommandImportDb) ResponseSignature() []int { return []int{} }
-func (cmd *CommandImportDb) Help() string             { return "TODO: CommandImportDb text" }
+func (cmd *CommandImportDb) Help() string {
+	return "IMPORT file|upload:name name [FORMAT trie|csv|tsv|jsonl] [options]"
+}
 func (cmd *CommandImportDb) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
 	filename := args[0].(string)
 	dbname := args[1].(string)
+	if err := CheckDbName(dbname); err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	if err := s.checkDbAccess(c, dbname); err != nil {
+		return permissionReply(err)
+	}
+	var optArgs []string
+	for _, arg := range args[2:] {
+		optArgs = append(optArgs, arg.(string))
+	}
+	optArgs, format, err := splitFormatArg(filename, optArgs)
+	if err != nil {
+		errMsg := fmt.Sprintf("Could not import db %s: %v", dbname, err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+	}
+	opts, err := ParseDatabaseOptions(optArgs)
+	if err != nil {
+		errMsg := fmt.Sprintf("Could not import db %s: %v", dbname, err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+	}
+	fpath, upload, err := s.resolveFilePath(c, filename)
+	if err != nil {
+		return pathFailReply(err)
+	}
 	s.Lock()
 	if s.dbExists(dbname) {
 		err := fmt.Sprintf("Databases %s already exists.", dbname)
@@ -404,16 +1341,30 @@ func (cmd *CommandImportDb) Function(s *Server, c *ClientConnection, args ...int
 	}
 	s.NewDatabase(dbname)
 	s.Unlock()
-	s.Databases[dbname].Db.Root.Lock()
-	defer s.Databases[dbname].Db.Root.Unlock()
-	var err error
-	s.Databases[dbname].Db, err = trie.LoadFromFile(filename)
+	d := s.Databases[dbname]
+	d.Lock()
+	d.Options = opts
+	if format == EXPORT_FORMAT_TRIE {
+		_, err = d.ImportTrieFile(fpath, false)
+	} else {
+		_, err = d.ImportFile(fpath, format, false)
+	}
 	if err != nil {
+		d.Unlock()
 		err := fmt.Sprintf("Database import failed: %v", err)
 		s.Log.Println(err)
+		s.Lock()
 		delete(s.Databases, dbname)
+		s.Unlock()
 		return NewReply([][]byte{[]byte(err)}, COMMAND_FAIL, 1, cmd.ResponseSignature())
 	}
+	d.RebuildSuffixIndex()
+	// make sure the imported data gets written
+	d.OpsCount += 1
+	d.Unlock()
+	if upload {
+		s.removeUpload(fpath)
+	}
 
 	// persist the db
 	err = s.Databases[dbname].Persist(fmt.Sprintf("%s/%s%s", s.Config.DataDir, s.Config.StorageFilePrefix, dbname))
@@ -435,15 +1386,41 @@ func (cmd *CommandMergeDb) Flags() int               { return COMMAND_FLAG_WRITE
 func (cmd *CommandMergeDb) ResponseType() int        { return COMMAND_REPLY_EMPTY }
 func (cmd *CommandMergeDb) ResponseLength() int64    { return 0 }
 func (cmd *CommandMergeDb) ResponseSignature() []int { return []int{} }
-func (cmd *CommandMergeDb) Help() string             { return "TODO: CommandMergeDb text" }
+func (cmd *CommandMergeDb) Help() string             { return "MERGE file|upload:name [FORMAT trie|csv|tsv|jsonl]" }
 func (cmd *CommandMergeDb) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
 	filename := args[0].(string)
-	err := c.ActiveDb.Db.MergeFromFile(filename)
+	var fmtArgs []string
+	for _, arg := range args[1:] {
+		fmtArgs = append(fmtArgs, arg.(string))
+	}
+	_, format, err := splitFormatArg(filename, fmtArgs)
+	if err != nil {
+		errMsg := fmt.Sprintf("Database merge failed: %v", err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+	}
+	fpath, upload, err := s.resolveFilePath(c, filename)
+	if err != nil {
+		return pathFailReply(err)
+	}
+	c.ActiveDb.Lock()
+	if format == EXPORT_FORMAT_TRIE {
+		_, err = c.ActiveDb.ImportTrieFile(fpath, true)
+	} else {
+		_, err = c.ActiveDb.ImportFile(fpath, format, true)
+	}
+	if err == nil {
+		c.ActiveDb.RebuildSuffixIndex()
+		c.ActiveDb.OpsCount += 1
+	}
+	c.ActiveDb.Unlock()
 	if err != nil {
 		err := fmt.Sprintf("Database merge failed: %v", err)
 		s.Log.Println(err)
 		return NewReply([][]byte{[]byte(err)}, COMMAND_FAIL, 1, cmd.ResponseSignature())
 	}
+	if upload {
+		s.removeUpload(fpath)
+	}
 
 	// backup?
 
@@ -457,6 +1434,243 @@ func (cmd *CommandMergeDb) Function(s *Server, c *ClientConnection, args ...inte
 	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
 }
 
+/*
+CommandBulkLoad streams a key file into the active database
+*/
+type CommandBulkLoad struct{}
+
+func (cmd *CommandBulkLoad) Name() string             { return "BULKLOAD" }
+func (cmd *CommandBulkLoad) Flags() int               { return COMMAND_FLAG_ADMIN | COMMAND_FLAG_WRITE }
+func (cmd *CommandBulkLoad) ResponseType() int        { return COMMAND_REPLY_EMPTY }
+func (cmd *CommandBulkLoad) ResponseLength() int64    { return 0 }
+func (cmd *CommandBulkLoad) ResponseSignature() []int { return []int{} }
+func (cmd *CommandBulkLoad) Help() string {
+	return "BULKLOAD file|upload:name [FORMAT lines|csv|tsv|jsonl]"
+}
+func (cmd *CommandBulkLoad) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) < 1 {
+		return NewReply([][]byte{[]byte("Expected a file name.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	filename := args[0].(string)
+	var fmtArgs []string
+	for _, arg := range args[1:] {
+		fmtArgs = append(fmtArgs, arg.(string))
+	}
+	format, err := bulkLoadFormat(filename, fmtArgs)
+	if err == nil {
+		var fpath string
+		var upload bool
+		fpath, upload, err = s.resolveFilePath(c, filename)
+		if err == nil {
+			err = s.StartBulkLoad(c.ActiveDb, fpath, format, upload)
+		}
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Bulk load failed: %v", err)
+		s.Log.Println(errMsg)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandUpload appends a base64 encoded chunk to an upload that IMPORT,
+MERGE and BULKLOAD can read as upload:name
+*/
+type CommandUpload struct{}
+
+func (cmd *CommandUpload) Name() string             { return "UPLOAD" }
+func (cmd *CommandUpload) Flags() int               { return COMMAND_FLAG_ADMIN | COMMAND_FLAG_WRITE }
+func (cmd *CommandUpload) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandUpload) ResponseLength() int64    { return 1 }
+func (cmd *CommandUpload) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandUpload) Help() string             { return "UPLOAD name base64chunk" }
+func (cmd *CommandUpload) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 2 {
+		return NewReply([][]byte{[]byte("Expected a name and a base64 chunk.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	size, err := s.appendUpload(c, args[0].(string), args[1].(string))
+	if err != nil {
+		errMsg := fmt.Sprintf("Upload failed: %v", err)
+		s.Log.Println(errMsg)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{encodeIntReply(size)}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandExportDb writes the active database to a file in a text format
+*/
+type CommandExportDb struct{}
+
+func (cmd *CommandExportDb) Name() string             { return "EXPORT" }
+func (cmd *CommandExportDb) Flags() int               { return COMMAND_FLAG_ADMIN | COMMAND_FLAG_READ }
+func (cmd *CommandExportDb) ResponseType() int        { return COMMAND_REPLY_SINGLE }
+func (cmd *CommandExportDb) ResponseLength() int64    { return 1 }
+func (cmd *CommandExportDb) ResponseSignature() []int { return []int{REPLY_TYPE_INT} }
+func (cmd *CommandExportDb) Help() string             { return "EXPORT file [FORMAT csv|tsv|jsonl]" }
+func (cmd *CommandExportDb) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) < 1 {
+		return NewReply([][]byte{[]byte("Expected a file name.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	filename := args[0].(string)
+	var fmtArgs []string
+	for _, arg := range args[1:] {
+		fmtArgs = append(fmtArgs, arg.(string))
+	}
+	_, format, err := splitFormatArg(filename, fmtArgs)
+	if err == nil && format == EXPORT_FORMAT_TRIE {
+		format = EXPORT_FORMAT_CSV
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Database export failed: %v", err)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	fpath, upload, err := s.resolveFilePath(c, filename)
+	if err == nil && upload {
+		err = errors.New("Can not export to an upload.")
+	}
+	if err != nil {
+		return pathFailReply(err)
+	}
+	c.ActiveDb.RLock()
+	n, err := c.ActiveDb.ExportFile(fpath, format)
+	c.ActiveDb.RUnlock()
+	if err != nil {
+		errMsg := fmt.Sprintf("Database export failed: %v", err)
+		s.Log.Println(errMsg)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{encodeIntReply(n)}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandClient lists the connections with their rate limit usage
+*/
+type CommandClient struct{}
+
+func (cmd *CommandClient) Name() string          { return "CLIENT" }
+func (cmd *CommandClient) Flags() int            { return COMMAND_FLAG_ADMIN }
+func (cmd *CommandClient) ResponseType() int     { return COMMAND_REPLY_MULTI }
+func (cmd *CommandClient) ResponseLength() int64 { return 6 }
+func (cmd *CommandClient) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_INT, REPLY_TYPE_INT, REPLY_TYPE_STRING}
+}
+func (cmd *CommandClient) Help() string { return "CLIENT LIST" }
+func (cmd *CommandClient) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 1 || strings.ToUpper(args[0].(string)) != "LIST" {
+		return NewReply([][]byte{[]byte(fmt.Sprintf("Usage: %s", cmd.Help()))}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return s.clientListReply()
+}
+
+/*
+CommandReplSync sends a snapshot of every database to a replica
+*/
+type CommandReplSync struct{}
+
+func (cmd *CommandReplSync) Name() string             { return "REPLSYNC" }
+func (cmd *CommandReplSync) Flags() int               { return COMMAND_FLAG_ADMIN }
+func (cmd *CommandReplSync) ResponseType() int        { return COMMAND_REPLY_MULTI }
+func (cmd *CommandReplSync) ResponseLength() int64    { return 1 }
+func (cmd *CommandReplSync) ResponseSignature() []int { return []int{REPLY_TYPE_STRING} }
+func (cmd *CommandReplSync) Help() string {
+	return "REPLSYNC | REPLSYNC READ snapshot n TRIE|META pos | REPLSYNC DONE snapshot"
+}
+func (cmd *CommandReplSync) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	replLog := s.replicationLog()
+	// a former primary keeps serving the snapshots of its log
+	if replLog == nil || (len(args) == 0 && s.isReplica()) {
+		return NewReply([][]byte{[]byte("Replication is not enabled on this server.")}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+	}
+	switch {
+	case len(args) == 0:
+		return s.fullSyncReply(replLog)
+	case len(args) == 5 && strings.ToUpper(args[0].(string)) == "READ":
+		n, err := strconv.Atoi(args[2].(string))
+		pos, perr := strconv.ParseInt(args[4].(string), 10, 64)
+		if err != nil || perr != nil {
+			break
+		}
+		return s.snapshotReadReply(replLog, args[1].(string), n, strings.ToUpper(args[3].(string)), pos)
+	case len(args) == 2 && strings.ToUpper(args[0].(string)) == "DONE":
+		return s.removeSnapshotReply(replLog, args[1].(string))
+	}
+	return NewReply([][]byte{[]byte(fmt.Sprintf("Usage: %s", cmd.Help()))}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+}
+
+/*
+CommandReplFetch sends the replication log entries after an offset to a
+replica
+*/
+type CommandReplFetch struct{}
+
+func (cmd *CommandReplFetch) Name() string             { return "REPLFETCH" }
+func (cmd *CommandReplFetch) Flags() int               { return COMMAND_FLAG_ADMIN }
+func (cmd *CommandReplFetch) ResponseType() int        { return COMMAND_REPLY_MULTI }
+func (cmd *CommandReplFetch) ResponseLength() int64    { return 1 }
+func (cmd *CommandReplFetch) ResponseSignature() []int { return []int{REPLY_TYPE_STRING} }
+func (cmd *CommandReplFetch) Help() string             { return "REPLFETCH replicationid offset" }
+func (cmd *CommandReplFetch) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	// a former primary keeps serving its log after REPLICAOF
+	replLog := s.replicationLog()
+	if replLog == nil {
+		return NewReply([][]byte{[]byte("Replication is not enabled on this server.")}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+	}
+	if len(args) != 2 {
+		return NewReply([][]byte{[]byte(fmt.Sprintf("Usage: %s", cmd.Help()))}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+	}
+	offset, err := strconv.ParseInt(args[1].(string), 10, 64)
+	if err != nil {
+		return NewReply([][]byte{[]byte("Invalid offset")}, COMMAND_FAIL, 1, cmd.ResponseSignature())
+	}
+	return s.fetchReply(replLog, c, args[0].(string), offset)
+}
+
+/*
+CommandReplicaOf makes the server a replica of another one or a primary
+*/
+type CommandReplicaOf struct{}
+
+func (cmd *CommandReplicaOf) Name() string             { return "REPLICAOF" }
+func (cmd *CommandReplicaOf) Flags() int               { return COMMAND_FLAG_ADMIN }
+func (cmd *CommandReplicaOf) ResponseType() int        { return COMMAND_REPLY_EMPTY }
+func (cmd *CommandReplicaOf) ResponseLength() int64    { return 0 }
+func (cmd *CommandReplicaOf) ResponseSignature() []int { return []int{} }
+func (cmd *CommandReplicaOf) Help() string             { return "REPLICAOF host port | REPLICAOF NO ONE" }
+func (cmd *CommandReplicaOf) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	if len(args) != 2 {
+		return NewReply([][]byte{[]byte(fmt.Sprintf("Usage: %s", cmd.Help()))}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	host, port := args[0].(string), args[1].(string)
+	if strings.ToUpper(host) == "NO" && strings.ToUpper(port) == "ONE" {
+		s.Promote()
+		return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return NewReply([][]byte{[]byte(fmt.Sprintf("Invalid port %s", port))}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	s.ReplicaOf(fmt.Sprintf("%s:%s", host, port))
+	return NewReply([][]byte{}, COMMAND_OK, cmd.ResponseLength(), cmd.ResponseSignature())
+}
+
+/*
+CommandRole tells whether the server is a primary or a replica
+*/
+type CommandRole struct{}
+
+func (cmd *CommandRole) Name() string          { return "ROLE" }
+func (cmd *CommandRole) Flags() int            { return COMMAND_FLAG_ADMIN }
+func (cmd *CommandRole) ResponseType() int     { return COMMAND_REPLY_MULTI }
+func (cmd *CommandRole) ResponseLength() int64 { return 4 }
+func (cmd *CommandRole) ResponseSignature() []int {
+	return []int{REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_STRING}
+}
+func (cmd *CommandRole) Help() string { return "ROLE" }
+func (cmd *CommandRole) Function(s *Server, c *ClientConnection, args ...interface{}) (reply *Reply) {
+	return s.roleReply()
+}
+
 /*
 CommandSave saves a full Trie to disk in a separate process
 */
@@ -527,3 +1741,75 @@ func (cmd *CommandHelp) Function(s *Server, c *ClientConnection, args ...interfa
 	}
 	return
 }
+
+/*
+keyCountArgs parses the "key n" arguments of commands like INCRBY,
+SETCOUNT or EXPIRE. n has to fit into an INT reply field.
+*/
+func keyCountArgs(args []interface{}) (key string, n int64, err error) {
+	if len(args) != 2 {
+		err = errors.New("expected the arguments key and n")
+		return
+	}
+	key = args[0].(string)
+	n, err = strconv.ParseInt(args[1].(string), 10, 64)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%s is not a valid number", args[1]))
+		return
+	}
+	if n < MIN_INT_REPLY || n > MAX_INT_REPLY {
+		err = errors.New(fmt.Sprintf("%s is out of range. n has to be between %d and %d", args[1], MIN_INT_REPLY, MAX_INT_REPLY))
+	}
+	return
+}
+
+/*
+parseSortArgs parses the optional "SORT COUNT|SCORE" arguments of member
+listings. sorting by SCORE needs a database with decay.
+*/
+func parseSortArgs(d *Database, args []interface{}) (sortBy string, err error) {
+	if len(args) == 0 {
+		return
+	}
+	if len(args) != 2 || strings.ToUpper(args[0].(string)) != "SORT" {
+		err = errors.New("expected SORT COUNT or SORT SCORE")
+		return
+	}
+	sortBy = strings.ToUpper(args[1].(string))
+	switch sortBy {
+	case SORT_BY_COUNT:
+	case SORT_BY_SCORE:
+		if !d.decays() {
+			err = errors.New(fmt.Sprintf("Database %s has no decay enabled.", d.Name))
+		}
+	default:
+		err = errors.New(fmt.Sprintf("Cannot sort by %s.", args[1]))
+	}
+	return
+}
+
+/*
+memberRows builds the reply rows of member listings: key, count and
+value. databases with decay get the decayed score as a fourth field.
+protocol 1 clients only get key and count.
+*/
+func memberRows(d *Database, members []*trie.MemberInfo, sortBy string, signature []int, protocol int) (rows [][]byte, sig []int) {
+	scores := d.sortMembers(members, sortBy)
+	if protocol < 2 {
+		for _, m := range members {
+			rows = append(rows, []byte(d.DisplayKey(m.Value)), encodeIntReply(m.Count))
+		}
+		return rows, signature[:2]
+	}
+	sig = signature
+	if scores != nil {
+		sig = append(append([]int{}, signature...), REPLY_TYPE_FLOAT)
+	}
+	for i, m := range members {
+		rows = append(rows, []byte(d.DisplayKey(m.Value)), encodeIntReply(m.Count), d.Values[m.Value])
+		if scores != nil {
+			rows = append(rows, encodeFloatReply(scores[i]))
+		}
+	}
+	return
+}
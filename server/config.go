@@ -17,5 +17,79 @@ type ServerConfig struct {
 	PersistInterval time.Duration
 	PersistOpsLimit int
 
+	// how often expired keys get removed. defaults to
+	// DEFAULT_EXPIRE_SWEEP_INTERVAL
+	ExpireSweepInterval time.Duration
+
+	// heap size in bytes above which MaxMemoryPolicy applies. 0 means no
+	// limit
+	MaxMemory int64
+	// MAXMEMORY_POLICY_REJECT (default) or MAXMEMORY_POLICY_EVICT_LRU
+	MaxMemoryPolicy string
+	// how often the heap size is checked against MaxMemory. defaults to
+	// DEFAULT_MEMORY_CHECK_INTERVAL
+	MemoryCheckInterval time.Duration
+
+	// number of data files loaded in parallel on startup. defaults to
+	// the number of cpus
+	LoadWorkers int
+	// stop the server if a data file can not be loaded instead of
+	// skipping it
+	FailOnLoadError bool
+
+	// only register the databases on startup and load them on first use
+	LazyLoad bool
+	// persist and unload databases that were not accessed for this long.
+	// 0 keeps them loaded
+	IdleUnloadTime time.Duration
+
+	// directory that file names of IMPORT, MERGE, EXPORT and BULKLOAD
+	// are resolved in. without it only uploads can be imported
+	ImportDir string
+	// where UPLOADs are kept. defaults to DataDir/DEFAULT_UPLOAD_DIR
+	UploadDir string
+	// largest upload in bytes. 0 and values over MAX_UPLOAD_SIZE mean
+	// MAX_UPLOAD_SIZE
+	MaxUploadSize int64
+	// bytes and number of uploads a connection may keep at once. 0 means
+	// DEFAULT_MAX_CONNECTION_UPLOAD_BYTES and DEFAULT_MAX_CONNECTION_UPLOADS
+	MaxConnectionUploadBytes int64
+	MaxConnectionUploads     int
+	// uploads not written to for this long are removed. 0 means
+	// DEFAULT_UPLOAD_IDLE_TIME
+	UploadIdleTime time.Duration
+
+	// z85 encoded CURVE secret key of the server (see main/keygen). if
+	// set clients have to connect with its public key
+	CurveSecretKey string
+	// port to accept TLS connections on. 0 disables TLS
+	TLSPort     int
+	TLSCertFile string
+	TLSKeyFile  string
+	// if set TLS clients have to present a certificate signed by one of
+	// the CAs in this file
+	TLSClientCAFile string
+	// only accept TLS connections
+	TLSOnly bool
+
+	// nr of write commands kept for replicas. 0 disables replication
+	ReplicationBacklog int
+	// "host:port" of the primary to replicate. the primary has to have a
+	// ReplicationBacklog
+	ReplicaOf string
+	// credentials and CURVE public key for the connection to the primary
+	ReplicaUser      string
+	ReplicaSecret    string
+	ReplicaServerKey string
+
+	// token bucket limits per flag class for every connection and for
+	// all connections of a user together. nil means no limits
+	RateLimits     *RateLimits
+	UserRateLimits map[string]*RateLimits
+
+	// user names and secret hashes (see HashSecret). if set clients have
+	// to AUTH
+	Users map[string]string
+
 	Logger *log.Logger
 }
@@ -0,0 +1,41 @@
+//go:build zmq_4_x
+// +build zmq_4_x
+
+package tris
+
+import (
+	"errors"
+	"fmt"
+	zmq "github.com/alecthomas/gozmq"
+)
+
+/*
+SetCurveServerKey makes sock a CURVE server with the z85 encoded secret
+key.
+*/
+func SetCurveServerKey(sock *zmq.Socket, secretKey string) (err error) {
+	if err = sock.SetSockOptInt(zmq.CURVE_SERVER, 1); err != nil {
+		return errors.New(fmt.Sprintf("Could not enable CURVE: %v", err))
+	}
+	if err = sock.SetSockOptString(zmq.CURVE_SECRETKEY, secretKey); err != nil {
+		return errors.New(fmt.Sprintf("Could not set the CURVE key: %v", err))
+	}
+	return
+}
+
+/*
+SetCurveClientKeys sets the z85 encoded server key and client key pair
+of a CURVE client socket.
+*/
+func SetCurveClientKeys(sock *zmq.Socket, serverKey string, public string, secret string) (err error) {
+	if err = sock.SetSockOptString(zmq.CURVE_SERVERKEY, serverKey); err != nil {
+		return errors.New(fmt.Sprintf("Could not set the CURVE server key: %v", err))
+	}
+	if err = sock.SetSockOptString(zmq.CURVE_PUBLICKEY, public); err != nil {
+		return errors.New(fmt.Sprintf("Could not set the CURVE public key: %v", err))
+	}
+	if err = sock.SetSockOptString(zmq.CURVE_SECRETKEY, secret); err != nil {
+		return errors.New(fmt.Sprintf("Could not set the CURVE secret key: %v", err))
+	}
+	return
+}
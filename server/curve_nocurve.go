@@ -0,0 +1,20 @@
+//go:build !zmq_4_x
+// +build !zmq_4_x
+
+package tris
+
+import (
+	"errors"
+	zmq "github.com/alecthomas/gozmq"
+)
+
+// gozmq only has the CURVE options with libzmq 4 and the zmq_4_x tag
+var errNoCurve = errors.New("CURVE needs libzmq 4 and a build with the zmq_4_x tag.")
+
+func SetCurveServerKey(sock *zmq.Socket, secretKey string) error {
+	return errNoCurve
+}
+
+func SetCurveClientKeys(sock *zmq.Socket, serverKey string, public string, secret string) error {
+	return errNoCurve
+}
@@ -1,15 +1,25 @@
 package tris
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/fvbock/trie"
 	"github.com/fvbock/tris/util"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// counts have to fit into INT reply fields
+	MAX_COUNT = MAX_INT_REPLY
+)
+
 type Database struct {
 	sync.RWMutex
 	Name                string
@@ -20,15 +30,407 @@ type Database struct {
 	LastPersistTime     int64
 	PersistInterval     time.Duration
 	PersistTicker       time.Ticker
+	// values attached to keys (SET/GET)
+	Values map[string][]byte
+	// expiry times of keys in unix nanoseconds (EXPIRE/ADDEX)
+	Expires map[string]int64
+	// options set on CREATE
+	Options DatabaseOptions
+	// decayed scores of keys if Options.DecayHalfLife is set
+	Scores map[string]*DecayScore
+	// display forms of normalized keys if Options.Normalization is set
+	Display map[string]string
+	// suffix index if Options.SuffixIndex is set. it is not persisted
+	// but rebuilt on load
+	Suffixes *SuffixIndex
+	// state of the last BULKLOAD. set under the write lock and bulkGate
+	BulkLoad *BulkLoadProgress
+	// held by writes to the db while they run so a bulk load can start
+	// in between writes
+	bulkGate sync.RWMutex
+	// unix nanoseconds of the last request. accessed atomically
+	LastAccess int64
+	// number of requests that use the db. it is not unloaded while
+	// they run. accessed atomically
+	users int32
+	// the time writes use if it is not 0 (see Server.writeClock)
+	clock *int64
+	// cached result of Stats()
+	stats     *DatabaseStats
+	statsDb   *trie.Trie
+	statsOps  int
+	statsLock sync.Mutex
 	// DbFileLock          sync.Mutex
-	// add a last access ticker to remove rarely accessed dbs from memory
+}
+
+/*
+newDetachedDatabase returns an empty database that is not registered
+with a server.
+*/
+func newDetachedDatabase(name string) *Database {
+	return &Database{
+		Name:    name,
+		Db:      trie.NewTrie(),
+		Values:  make(map[string][]byte),
+		Expires: make(map[string]int64),
+		Scores:  make(map[string]*DecayScore),
+		Display: make(map[string]string),
+	}
+}
+
+/*
+now returns the time in unix nanoseconds that expiry times and decayed
+scores are computed with.
+*/
+func (d *Database) now() int64 {
+	if d.clock != nil {
+		if now := atomic.LoadInt64(d.clock); now != 0 {
+			return now
+		}
+	}
+	return time.Now().UnixNano()
+}
+
+/*
+DatabaseMeta holds everything about a database that does not fit into
+the trie dump. it is persisted as json next to the trie file.
+*/
+type DatabaseMeta struct {
+	Options DatabaseOptions
+	Values  map[string][]byte      `json:",omitempty"`
+	Expires map[string]int64       `json:",omitempty"`
+	Scores  map[string]*DecayScore `json:",omitempty"`
+	Display map[string]string      `json:",omitempty"`
+}
+
+func (m *DatabaseMeta) isEmpty() bool {
+	return m.Options == DatabaseOptions{} && len(m.Values) == 0 && len(m.Expires) == 0 && len(m.Scores) == 0 && len(m.Display) == 0
+}
+
+/*
+DatabaseOptions are set when a database gets created and stay with it.
+*/
+type DatabaseOptions struct {
+	// half-life of the decayed scores. 0 disables decay
+	DecayHalfLife time.Duration `json:",omitempty"`
+	// NORMALIZE_* flags applied to all keys
+	Normalization int `json:",omitempty"`
+	// maintain a suffix index for SUFFIXMEMBERS and CONTAINS
+	SuffixIndex bool `json:",omitempty"`
+}
+
+/*
+ParseDatabaseOptions parses the options following the name in CREATE:
+
+	DECAY <half-life in seconds>
+	NORMALIZE <comma separated NormalizationNames>
+	SUFFIX
+*/
+func ParseDatabaseOptions(args []string) (opts DatabaseOptions, err error) {
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "DECAY":
+			if i+1 >= len(args) {
+				err = errors.New("DECAY needs a half-life in seconds")
+				return
+			}
+			i++
+			var seconds int64
+			seconds, err = strconv.ParseInt(args[i], 10, 64)
+			if err != nil || seconds <= 0 {
+				err = errors.New(fmt.Sprintf("Invalid DECAY half-life %s", args[i]))
+				return
+			}
+			opts.DecayHalfLife = time.Duration(seconds) * time.Second
+		case "NORMALIZE":
+			if i+1 >= len(args) {
+				err = errors.New("NORMALIZE needs a list of normalizations")
+				return
+			}
+			i++
+			opts.Normalization, err = ParseNormalization(args[i])
+			if err != nil {
+				return
+			}
+		case "SUFFIX":
+			opts.SuffixIndex = true
+		default:
+			err = errors.New(fmt.Sprintf("Unknown database option %s", args[i]))
+			return
+		}
+	}
+	return
+}
+
+/*
+The exported key methods normalize their key arguments according to
+Options.Normalization. the unexported ones expect normalized keys.
+*/
+
+/*
+Add maps to Trie.Add(). an expired key that has not been swept yet
+starts over with a count of 1. the caller has to hold the write lock.
+*/
+func (d *Database) Add(key string) *trie.Branch {
+	nkey := d.normalize(key)
+	b := d.add(nkey)
+	d.rememberDisplay(key, nkey)
+	d.bumpScore(nkey, 1)
+	return b
+}
+
+func (d *Database) add(nkey string) *trie.Branch {
+	if d.isExpired(nkey, d.now()) {
+		d.delete(nkey)
+	}
+	if d.Suffixes != nil && !d.Db.Has(nkey) {
+		d.Suffixes.add(nkey)
+	}
+	return d.Db.Add(nkey)
+}
+
+/*
+Has maps to Trie.Has() but hides expired keys. the caller has to hold
+the read lock.
+*/
+func (d *Database) Has(key string) bool {
+	return d.has(d.normalize(key))
+}
+
+func (d *Database) has(nkey string) bool {
+	return !d.isExpired(nkey, d.now()) && d.Db.Has(nkey)
+}
+
+/*
+HasCount maps to Trie.HasCount() but hides expired keys. the caller has
+to hold the read lock.
+*/
+func (d *Database) HasCount(key string) (exists bool, count int64) {
+	return d.hasCount(d.normalize(key))
+}
+
+func (d *Database) hasCount(nkey string) (exists bool, count int64) {
+	if d.isExpired(nkey, d.now()) {
+		return
+	}
+	return d.Db.HasCount(nkey)
+}
+
+/*
+HasPrefix maps to Trie.HasPrefix() but ignores expired keys. the caller
+has to hold the read lock.
+*/
+func (d *Database) HasPrefix(prefix string) bool {
+	nprefix := d.normalize(prefix)
+	if !d.Db.HasPrefix(nprefix) {
+		return false
+	}
+	if len(d.Expires) == 0 {
+		return true
+	}
+	keys, _ := d.countPrefix(nprefix)
+	return keys > 0
+}
+
+/*
+Members maps to Trie.Members() but hides expired keys. the member values
+are the normalized keys, use DisplayKey() for results. the caller has to
+hold the read lock.
+*/
+func (d *Database) Members() []*trie.MemberInfo {
+	return d.liveMembers(d.Db.Members())
+}
+
+/*
+PrefixMembers maps to Trie.PrefixMembers() but hides expired keys. the
+member values are the normalized keys, use DisplayKey() for results. the
+caller has to hold the read lock.
+*/
+func (d *Database) PrefixMembers(prefix string) []*trie.MemberInfo {
+	return d.liveMembers(d.Db.PrefixMembers(d.normalize(prefix)))
+}
+
+/*
+PrefixesOf returns all keys that are a prefix of input, shortest first.
+the caller has to hold the read lock.
+*/
+func (d *Database) PrefixesOf(input string) (members []*trie.MemberInfo) {
+	now := d.now()
+	walkPrefixesOf(d.Db, []byte(d.normalize(input)), func(key []byte, b *trie.Branch) {
+		if len(d.Expires) > 0 && d.isExpired(string(key), now) {
+			return
+		}
+		members = append(members, &trie.MemberInfo{Value: string(key), Count: b.Count})
+	})
+	return
+}
+
+func (d *Database) liveMembers(members []*trie.MemberInfo) (live []*trie.MemberInfo) {
+	if len(d.Expires) == 0 {
+		return members
+	}
+	now := d.now()
+	for _, m := range members {
+		if !d.isExpired(m.Value, now) {
+			live = append(live, m)
+		}
+	}
+	return
+}
+
+/*
+Delete removes key and everything attached to it. the caller has to hold
+the write lock.
+*/
+func (d *Database) Delete(key string) bool {
+	return d.delete(d.normalize(key))
+}
+
+func (d *Database) delete(nkey string) bool {
+	delete(d.Values, nkey)
+	delete(d.Expires, nkey)
+	delete(d.Scores, nkey)
+	delete(d.Display, nkey)
+	if !d.Db.Delete(nkey) {
+		return false
+	}
+	if d.Suffixes != nil {
+		d.Suffixes.remove(nkey)
+	}
+	return true
+}
+
+/*
+Value returns the value attached to key and whether the key exists. the
+caller has to hold the read lock.
+*/
+func (d *Database) Value(key string) (value []byte, exists bool) {
+	nkey := d.normalize(key)
+	if !d.has(nkey) {
+		return
+	}
+	return d.Values[nkey], true
+}
+
+/*
+SetValue attaches value to key. keys that do not exist yet are added
+with a count of 1. the caller has to hold the write lock.
+*/
+func (d *Database) SetValue(key string, value []byte) {
+	nkey := d.normalize(key)
+	if !d.has(nkey) {
+		d.add(nkey)
+		d.rememberDisplay(key, nkey)
+		d.bumpScore(nkey, 1)
+	}
+	d.Values[nkey] = value
+}
+
+/*
+IncrBy adds n to the count of key. a key that is not in the trie yet is
+added. if the resulting count drops to zero or below the key gets
+deleted. counts above MAX_COUNT are rejected. the caller has to hold the
+write lock.
+*/
+func (d *Database) IncrBy(key string, n int64) (count int64, err error) {
+	nkey := d.normalize(key)
+	_, count = d.hasCount(nkey)
+	if n > 0 && count > MAX_COUNT-n {
+		return count, errors.New(fmt.Sprintf("The count of %s would exceed %d.", key, MAX_COUNT))
+	}
+	score := d.score(nkey)
+	count = d.setCount(nkey, count+n)
+	if count > 0 {
+		d.rememberDisplay(key, nkey)
+		d.setScore(nkey, score+float64(n))
+	}
+	return
+}
+
+/*
+SetCount sets the count of key to n. counts of zero or below delete the
+key, counts above MAX_COUNT are rejected. the caller has to hold the
+write lock.
+*/
+func (d *Database) SetCount(key string, n int64) (count int64, err error) {
+	if n > MAX_COUNT {
+		return 0, errors.New(fmt.Sprintf("The count of %s would exceed %d.", key, MAX_COUNT))
+	}
+	nkey := d.normalize(key)
+	count = d.setCount(nkey, n)
+	if count > 0 {
+		d.rememberDisplay(key, nkey)
+	}
+	return
+}
+
+func (d *Database) setCount(nkey string, n int64) (count int64) {
+	if n <= 0 {
+		d.delete(nkey)
+		return 0
+	}
+	b := d.add(nkey)
+	b.Lock()
+	b.Count = n
+	b.Unlock()
+	d.setScore(nkey, float64(n))
+	return n
+}
+
+/*
+DelPrefix deletes all keys starting with prefix and returns the number of
+deleted keys. the caller has to hold the write lock.
+*/
+func (d *Database) DelPrefix(prefix string) (deleted int64) {
+	for _, nkey := range prefixKeys(d.Db, d.normalize(prefix)) {
+		if d.delete(nkey) {
+			deleted++
+		}
+	}
+	return
+}
+
+/*
+CountPrefix returns the number of distinct keys starting with prefix and
+the sum of their counts. the caller has to hold the read lock.
+*/
+func (d *Database) CountPrefix(prefix string) (keys int64, sum int64) {
+	return d.countPrefix(d.normalize(prefix))
+}
+
+func (d *Database) countPrefix(nprefix string) (keys int64, sum int64) {
+	now := d.now()
+	walkPrefix(d.Db, nprefix, func(key []byte, b *trie.Branch) {
+		if len(d.Expires) > 0 && d.isExpired(string(key), now) {
+			return
+		}
+		keys++
+		sum += b.Count
+	})
+	return
+}
+
+/*
+Clear drops all keys and everything attached to them. the options stay.
+the caller has to hold the write lock.
+*/
+func (d *Database) Clear() {
+	d.Db = trie.NewTrie()
+	d.Values = make(map[string][]byte)
+	d.Expires = make(map[string]int64)
+	d.Scores = make(map[string]*DecayScore)
+	d.Display = make(map[string]string)
+	d.RebuildSuffixIndex()
 }
 
 func (d *Database) Persist(fname string) (err error) {
-	if d.LastPersistOpsCount == d.OpsCount {
+	if d.LastPersistOpsCount == d.OpsCount || !d.Loaded() {
 		return
 	}
 	err = d.Db.DumpToFile(fname)
+	if err == nil {
+		err = d.persistMeta(fname + META_FILE_SUFFIX)
+	}
 	if err != nil {
 		err = errors.New(fmt.Sprintf("Could persist the db %s: %v", d.Name, err))
 	} else {
@@ -40,6 +442,101 @@ func (d *Database) Persist(fname string) (err error) {
 	return
 }
 
+/*
+persistMeta writes the DatabaseMeta to fname. if there is nothing to
+store an old meta file is removed.
+*/
+func (d *Database) persistMeta(fname string) (err error) {
+	d.RLock()
+	meta := d.meta()
+	empty := meta.isEmpty()
+	var data []byte
+	if !empty {
+		data, err = json.Marshal(meta)
+	}
+	d.RUnlock()
+	if err != nil {
+		return
+	}
+	if empty {
+		err = os.Remove(fname)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	return ioutil.WriteFile(fname, data, 0644)
+}
+
+/*
+meta returns the DatabaseMeta of d. the caller has to hold the read
+lock.
+*/
+func (d *Database) meta() *DatabaseMeta {
+	return &DatabaseMeta{
+		Options: d.Options,
+		Values:  d.Values,
+		Expires: d.Expires,
+		Scores:  d.Scores,
+		Display: d.Display,
+	}
+}
+
+/*
+LoadMeta reads the DatabaseMeta from fname if it exists.
+*/
+func (d *Database) LoadMeta(fname string) (err error) {
+	meta, err := d.readMeta(fname)
+	if err != nil {
+		return
+	}
+	d.Lock()
+	d.applyMeta(meta)
+	d.Unlock()
+	return
+}
+
+/*
+readMeta reads the DatabaseMeta from fname. a missing file gives an empty
+DatabaseMeta.
+*/
+func (d *Database) readMeta(fname string) (meta *DatabaseMeta, err error) {
+	meta = &DatabaseMeta{}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Could not read the meta data of db %s: %v", d.Name, err))
+	}
+	return
+}
+
+/*
+applyMeta sets the options and side data from meta and rebuilds the
+suffix index. the caller has to hold the write lock.
+*/
+func (d *Database) applyMeta(meta *DatabaseMeta) {
+	d.Options = meta.Options
+	if meta.Values != nil {
+		d.Values = meta.Values
+	}
+	if meta.Expires != nil {
+		d.Expires = meta.Expires
+	}
+	if meta.Scores != nil {
+		d.Scores = meta.Scores
+	}
+	if meta.Display != nil {
+		d.Display = meta.Display
+	}
+	d.RebuildSuffixIndex()
+}
+
 func (d *Database) OpsLimitPersist(fname string) (err error) {
 	if d.LastPersistOpsCount+d.PersistOpsLimit >= d.OpsCount {
 		err = d.Persist(fname)
@@ -69,6 +566,14 @@ func (d *Database) Backup(srcFilePath string, dstPath string, dstFile string) (e
 	d.Db.Root.Unlock()
 	if err != nil {
 		err = errors.New(fmt.Sprintf("Could backup the previous data file: %v", err))
+		return
+	}
+	exists, _ = tris.PathExists(srcFilePath + META_FILE_SUFFIX)
+	if exists {
+		err = tris.CopyFile(srcFilePath+META_FILE_SUFFIX, fmt.Sprintf("%s/%s%s", dstPath, dstFile, META_FILE_SUFFIX))
+		if err != nil {
+			err = errors.New(fmt.Sprintf("Could backup the previous meta data file: %v", err))
+		}
 	}
 	return
 }
@@ -0,0 +1,273 @@
+package tris
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+COPY, RENAME and SWAP work on whole databases. clients keep a pointer to
+their selected Database, so
+
+	COPY src dst     creates dst with the contents of src
+	RENAME src dst   moves src to the name dst. clients that selected src
+	                 stay on it under its new name
+	SWAP a b         exchanges the contents of a and b. clients that
+	                 selected either name see the new contents right away
+
+the trie and meta files and the _bak directory of a database are moved
+along with it. if a move fails the files that were already moved are
+moved back.
+
+COPY holds one database lock at a time. SWAP looks up its dbs under the
+server lock and then takes their locks in the order of their names.
+RENAME and SWAP are serialized by dbOpsLock so names do not change in
+between.
+*/
+const (
+	// prefix of the temporary name of a db during SWAP. it is not a valid
+	// db name so it can not clash with a database
+	SWAP_TMP_PREFIX = "#swap#"
+)
+
+/*
+CheckDbName rejects names that can not be used as file names in DataDir
+or clash with the query syntax: empty names, path separators, . and ..
+and names containing @, # or commas.
+*/
+func CheckDbName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return errors.New(fmt.Sprintf("Invalid db name %q.", name))
+	}
+	if strings.ContainsAny(name, "/\\@#,") || strings.Contains(name, "..") {
+		return errors.New(fmt.Sprintf("Invalid db name %s: /, \\, .., @, # and , are not allowed.", name))
+	}
+	return nil
+}
+
+/*
+dbBackupPath returns the path of the backup directory of the database
+name.
+*/
+func (s *Server) dbBackupPath(name string) string {
+	return fmt.Sprintf("%s/%s_bak", s.Config.DataDir, name)
+}
+
+/*
+renameIfExists renames from to to and ignores a missing from.
+*/
+func renameIfExists(from string, to string) (err error) {
+	err = os.Rename(from, to)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+/*
+moveDbFiles renames the trie and meta files and the backup directory of
+the database src to dst. the backup files inside are named after the db
+and get renamed too.
+*/
+func (s *Server) moveDbFiles(src string, dst string) (err error) {
+	err = renameIfExists(s.dbFilePath(src), s.dbFilePath(dst))
+	if err != nil {
+		return
+	}
+	err = renameIfExists(s.dbFilePath(src)+META_FILE_SUFFIX, s.dbFilePath(dst)+META_FILE_SUFFIX)
+	if err != nil {
+		return
+	}
+	err = renameIfExists(s.dbBackupPath(src), s.dbBackupPath(dst))
+	if err != nil {
+		return
+	}
+	bakPath := s.dbBackupPath(dst)
+	err = renameIfExists(fmt.Sprintf("%s/%s", bakPath, src), fmt.Sprintf("%s/%s", bakPath, dst))
+	if err != nil {
+		return
+	}
+	return renameIfExists(fmt.Sprintf("%s/%s%s", bakPath, src, META_FILE_SUFFIX), fmt.Sprintf("%s/%s%s", bakPath, dst, META_FILE_SUFFIX))
+}
+
+/*
+undoMoves moves the files of moves back in reverse order. failures are
+only logged.
+*/
+func (s *Server) undoMoves(moves [][2]string) {
+	for i := len(moves) - 1; i >= 0; i-- {
+		if err := s.moveDbFiles(moves[i][1], moves[i][0]); err != nil {
+			s.Log.Printf("Could not move the files of db %s back to %s: %v\n", moves[i][1], moves[i][0], err)
+		}
+	}
+}
+
+/*
+CopyDatabase creates the database dst with the keys, counts, values,
+expiry times, scores and options of src and persists it.
+*/
+func (s *Server) CopyDatabase(srcName string, dstName string) (err error) {
+	if err = CheckDbName(dstName); err != nil {
+		return
+	}
+	dbs, err := s.databasesByName(nil, []string{srcName})
+	if err != nil {
+		return
+	}
+	defer releaseDatabases(dbs)
+	src := dbs[0]
+	s.RLock()
+	exists := s.dbExists(dstName)
+	s.RUnlock()
+	if exists {
+		return errors.New(fmt.Sprintf("Databases %s already exists.", dstName))
+	}
+
+	// dst is filled before it is registered so only one lock is held
+	dst := s.newDatabase(dstName)
+	src.RLock()
+	if !src.Loaded() {
+		src.RUnlock()
+		return errors.New(fmt.Sprintf("Databases %s got unloaded during the copy.", srcName))
+	}
+	dst.Options = src.Options
+	for _, m := range src.Db.Members() {
+		b := dst.Db.Add(m.Value)
+		b.Lock()
+		b.Count = m.Count
+		b.Unlock()
+	}
+	for nkey, value := range src.Values {
+		dst.Values[nkey] = value
+	}
+	for nkey, expires := range src.Expires {
+		dst.Expires[nkey] = expires
+	}
+	for nkey, score := range src.Scores {
+		dst.Scores[nkey] = &DecayScore{Score: score.Score, Updated: score.Updated}
+	}
+	for nkey, display := range src.Display {
+		dst.Display[nkey] = display
+	}
+	src.RUnlock()
+	dst.RebuildSuffixIndex()
+	dst.OpsCount += 1
+
+	s.Lock()
+	if s.dbExists(dstName) {
+		s.Unlock()
+		return errors.New(fmt.Sprintf("Databases %s already exists.", dstName))
+	}
+	s.Databases[dstName] = dst
+	s.Unlock()
+	return dst.Persist(s.dbFilePath(dstName))
+}
+
+/*
+RenameDatabase moves the database src to the name dst. the default
+database can not be renamed.
+*/
+func (s *Server) RenameDatabase(srcName string, dstName string) (err error) {
+	if srcName == DEFAULT_DB {
+		return errors.New("Renaming the default DB is not permitted.")
+	}
+	if err = CheckDbName(dstName); err != nil {
+		return
+	}
+	s.dbOpsLock.Lock()
+	defer s.dbOpsLock.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	d, exists := s.Databases[srcName]
+	if !exists {
+		return errors.New(fmt.Sprintf("Databases %s does not exist.", srcName))
+	}
+	if s.dbExists(dstName) {
+		return errors.New(fmt.Sprintf("Databases %s already exists.", dstName))
+	}
+	d.Lock()
+	defer d.Unlock()
+	err = s.moveDbFiles(srcName, dstName)
+	if err != nil {
+		s.undoMoves([][2]string{{srcName, dstName}})
+		return errors.New(fmt.Sprintf("Could not rename the files of db %s: %v", srcName, err))
+	}
+	delete(s.Databases, srcName)
+	d.Name = dstName
+	s.Databases[dstName] = d
+	return
+}
+
+/*
+SwapDatabases exchanges the contents of the databases a and b. the
+server lock is only held to look them up.
+*/
+func (s *Server) SwapDatabases(aName string, bName string) (err error) {
+	if aName == bName {
+		return
+	}
+	s.dbOpsLock.Lock()
+	defer s.dbOpsLock.Unlock()
+	s.RLock()
+	a, aExists := s.Databases[aName]
+	b, bExists := s.Databases[bName]
+	s.RUnlock()
+	if !aExists {
+		return errors.New(fmt.Sprintf("Databases %s does not exist.", aName))
+	}
+	if !bExists {
+		return errors.New(fmt.Sprintf("Databases %s does not exist.", bName))
+	}
+	lockDatabases(a, b)
+	defer a.Unlock()
+	defer b.Unlock()
+	if a.bulkLoading() {
+		return bulkLoadingError(a)
+	}
+	if b.bulkLoading() {
+		return bulkLoadingError(b)
+	}
+
+	tmpName := SWAP_TMP_PREFIX + aName
+	moves := [][2]string{{aName, tmpName}, {bName, aName}, {tmpName, bName}}
+	for i, move := range moves {
+		if err = s.moveDbFiles(move[0], move[1]); err != nil {
+			// the failed move may have renamed some of the files
+			s.undoMoves(moves[:i+1])
+			return errors.New(fmt.Sprintf("Could not swap the files of dbs %s and %s: %v", aName, bName, err))
+		}
+	}
+
+	swapContents(a, b)
+	a.OpsCount, b.OpsCount = b.OpsCount, a.OpsCount
+	a.LastPersistOpsCount, b.LastPersistOpsCount = b.LastPersistOpsCount, a.LastPersistOpsCount
+	a.LastPersistTime, b.LastPersistTime = b.LastPersistTime, a.LastPersistTime
+	return
+}
+
+/*
+lockDatabases write locks a and b in the order of their names.
+*/
+func lockDatabases(a *Database, b *Database) {
+	if b.Name < a.Name {
+		a, b = b, a
+	}
+	a.Lock()
+	b.Lock()
+}
+
+/*
+swapContents exchanges the keys and everything attached to them and the
+options of a and b. the caller has to hold both write locks.
+*/
+func swapContents(a *Database, b *Database) {
+	a.Db, b.Db = b.Db, a.Db
+	a.Values, b.Values = b.Values, a.Values
+	a.Expires, b.Expires = b.Expires, a.Expires
+	a.Options, b.Options = b.Options, a.Options
+	a.Scores, b.Scores = b.Scores, a.Scores
+	a.Display, b.Display = b.Display, a.Display
+	a.Suffixes, b.Suffixes = b.Suffixes, a.Suffixes
+}
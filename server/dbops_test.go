@@ -0,0 +1,52 @@
+package tris
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCopySwapConcurrent(t *testing.T) {
+	s := &Server{
+		Config:    &ServerConfig{DataDir: t.TempDir()},
+		Databases: make(map[string]*Database),
+		Log:       log.New(ioutil.Discard, "", 0),
+	}
+	s.NewDatabase("a")
+	s.NewDatabase("b")
+	s.Databases["a"].Add("key")
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		// SWAP a c fails until COPY registered c
+		for _, pair := range [][2]string{{"a", "b"}, {"b", "a"}, {"a", "c"}, {"c", "a"}} {
+			for i := 0; i < 25; i++ {
+				wg.Add(1)
+				go func(pair [2]string) {
+					defer wg.Done()
+					s.SwapDatabases(pair[0], pair[1])
+				}(pair)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.CopyDatabase("a", "c"); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("COPY and SWAP deadlocked")
+	}
+	if err := s.CopyDatabase("a", "c"); err == nil {
+		t.Error("COPY overwrote an existing db")
+	}
+}
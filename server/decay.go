@@ -0,0 +1,133 @@
+package tris
+
+import (
+	"github.com/fvbock/trie"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// sort orders of member listings
+	SORT_BY_COUNT = "COUNT"
+	SORT_BY_SCORE = "SCORE"
+)
+
+/*
+DecayScore is the time decayed score of a key in a database with a
+DecayHalfLife. Score is the value at Updated (unix nanoseconds).
+*/
+type DecayScore struct {
+	Score   float64
+	Updated int64
+}
+
+/*
+At returns the score decayed to now.
+*/
+func (ds *DecayScore) At(now int64, halfLife time.Duration) float64 {
+	if now <= ds.Updated {
+		return ds.Score
+	}
+	return ds.Score * math.Exp2(-float64(now-ds.Updated)/float64(halfLife))
+}
+
+func (d *Database) decays() bool {
+	return d.Options.DecayHalfLife > 0
+}
+
+/*
+Score returns the decayed score of key. it is 0 for keys without a score
+and databases without decay. the caller has to hold the read lock.
+*/
+func (d *Database) Score(key string) float64 {
+	return d.score(d.normalize(key))
+}
+
+func (d *Database) score(nkey string) float64 {
+	ds, exists := d.Scores[nkey]
+	if !d.decays() || !exists {
+		return 0
+	}
+	return ds.At(d.now(), d.Options.DecayHalfLife)
+}
+
+/*
+bumpScore adds delta to the decayed score of nkey.
+*/
+func (d *Database) bumpScore(nkey string, delta float64) {
+	if !d.decays() {
+		return
+	}
+	d.setScore(nkey, d.score(nkey)+delta)
+}
+
+func (d *Database) setScore(nkey string, score float64) {
+	if !d.decays() {
+		return
+	}
+	d.Scores[nkey] = &DecayScore{
+		Score:   math.Max(score, 0),
+		Updated: d.now(),
+	}
+}
+
+/*
+sortableMembers sorts members by count or decayed score, highest first.
+scores are kept in the same order as members if they are set.
+*/
+type sortableMembers struct {
+	members []*trie.MemberInfo
+	scores  []float64
+	byScore bool
+}
+
+func (m *sortableMembers) Len() int { return len(m.members) }
+func (m *sortableMembers) Less(i, j int) bool {
+	if m.byScore {
+		return m.scores[i] > m.scores[j]
+	}
+	return m.members[i].Count > m.members[j].Count
+}
+func (m *sortableMembers) Swap(i, j int) {
+	m.members[i], m.members[j] = m.members[j], m.members[i]
+	if m.scores != nil {
+		m.scores[i], m.scores[j] = m.scores[j], m.scores[i]
+	}
+}
+
+/*
+memberScores returns the decayed scores of members in the same order.
+the caller has to hold the read lock.
+*/
+func (d *Database) memberScores(members []*trie.MemberInfo) (scores []float64) {
+	now := d.now()
+	scores = make([]float64, len(members))
+	for i, m := range members {
+		if ds, exists := d.Scores[m.Value]; exists {
+			scores[i] = ds.At(now, d.Options.DecayHalfLife)
+		}
+	}
+	return
+}
+
+/*
+sortMembers sorts members in place by SORT_BY_COUNT or SORT_BY_SCORE. an
+empty sortBy keeps the trie order. if the database decays the scores of
+the members are returned in the resulting order. the caller has to hold
+the read lock.
+*/
+func (d *Database) sortMembers(members []*trie.MemberInfo, sortBy string) (scores []float64) {
+	if d.decays() {
+		scores = d.memberScores(members)
+	}
+	if sortBy == "" {
+		return
+	}
+	sort.Stable(&sortableMembers{
+		members: members,
+		scores:  scores,
+		byScore: sortBy == SORT_BY_SCORE,
+	})
+	return
+}
@@ -0,0 +1,111 @@
+package tris
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TTL replies for keys without a ttl and keys that do not exist
+	TTL_NO_EXPIRY   = -1
+	TTL_NO_SUCH_KEY = -2
+
+	DEFAULT_EXPIRE_SWEEP_INTERVAL = time.Second
+)
+
+func (d *Database) isExpired(key string, now int64) bool {
+	expires, exists := d.Expires[key]
+	return exists && expires <= now
+}
+
+/*
+Expire sets the ttl of key. it returns false if the key does not exist.
+a ttl of zero or below deletes the key right away. the caller has to
+hold the write lock.
+*/
+func (d *Database) Expire(key string, ttl time.Duration) bool {
+	nkey := d.normalize(key)
+	if !d.has(nkey) {
+		return false
+	}
+	if ttl <= 0 {
+		d.delete(nkey)
+		return true
+	}
+	d.Expires[nkey] = d.now() + int64(ttl)
+	return true
+}
+
+/*
+TTL returns the remaining time to live of key in seconds or one of
+TTL_NO_EXPIRY and TTL_NO_SUCH_KEY. the caller has to hold the read lock.
+*/
+func (d *Database) TTL(key string) int64 {
+	nkey := d.normalize(key)
+	if !d.has(nkey) {
+		return TTL_NO_SUCH_KEY
+	}
+	expires, exists := d.Expires[nkey]
+	if !exists {
+		return TTL_NO_EXPIRY
+	}
+	return int64(time.Duration(expires-d.now()) / time.Second)
+}
+
+/*
+PersistKey removes the ttl of key. it returns false if the key does not
+exist or has no ttl. the caller has to hold the write lock.
+*/
+func (d *Database) PersistKey(key string) bool {
+	nkey := d.normalize(key)
+	if !d.has(nkey) {
+		return false
+	}
+	if _, exists := d.Expires[nkey]; !exists {
+		return false
+	}
+	delete(d.Expires, nkey)
+	return true
+}
+
+/*
+SweepExpired deletes all expired keys and returns their number.
+*/
+func (d *Database) SweepExpired() (swept int) {
+	d.Lock()
+	defer d.Unlock()
+	now := d.now()
+	for key, expires := range d.Expires {
+		if expires <= now {
+			d.delete(key)
+			swept++
+		}
+	}
+	if swept > 0 {
+		d.OpsCount += 1
+	}
+	return
+}
+
+/*
+sweepExpiredKeys runs SweepExpired on all databases. it gets triggered
+from the main loop and returns right away if the previous sweep is still
+running.
+*/
+func (s *Server) sweepExpiredKeys() {
+	if !atomic.CompareAndSwapInt32(&s.sweeping, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.sweeping, 0)
+	s.RLock()
+	dbs := make([]*Database, 0, len(s.Databases))
+	for _, db := range s.Databases {
+		dbs = append(dbs, db)
+	}
+	s.RUnlock()
+	for _, db := range dbs {
+		if swept := db.SweepExpired(); swept > 0 {
+			s.Log.Printf("Swept %v expired keys from db %s\n", swept, db.Name)
+		}
+	}
+}
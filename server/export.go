@@ -0,0 +1,305 @@
+package tris
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fvbock/trie"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+Databases can be exported to and imported from text formats with one line
+per member:
+
+	CSV     key,count[,value]
+	TSV     key<tab>count[<tab>value]
+	JSONL   {"key":"...","count":1,"value":"..."}
+
+CSV and TSV fields are quoted the way encoding/csv does it. TRIE is the
+trie.DumpToFile format. if no FORMAT is given it is taken from the file
+extension and defaults to TRIE.
+*/
+const (
+	EXPORT_FORMAT_TRIE  = "TRIE"
+	EXPORT_FORMAT_CSV   = "CSV"
+	EXPORT_FORMAT_TSV   = "TSV"
+	EXPORT_FORMAT_JSONL = "JSONL"
+)
+
+/*
+ExportRecord is one member in a text export.
+*/
+type ExportRecord struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+	Value string `json:"value,omitempty"`
+}
+
+/*
+ParseExportFormat checks and upper cases a format name.
+*/
+func ParseExportFormat(name string) (format string, err error) {
+	format = strings.ToUpper(name)
+	switch format {
+	case EXPORT_FORMAT_TRIE, EXPORT_FORMAT_CSV, EXPORT_FORMAT_TSV, EXPORT_FORMAT_JSONL:
+	default:
+		err = errors.New(fmt.Sprintf("Unknown format %s", name))
+	}
+	return
+}
+
+/*
+ExportFormatFromPath guesses the format from the extension of path.
+*/
+func ExportFormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return EXPORT_FORMAT_CSV
+	case ".tsv":
+		return EXPORT_FORMAT_TSV
+	case ".jsonl", ".json":
+		return EXPORT_FORMAT_JSONL
+	}
+	return EXPORT_FORMAT_TRIE
+}
+
+/*
+splitFormatArg strips "FORMAT name" from args. without it the format is
+taken from path.
+*/
+func splitFormatArg(path string, args []string) (rest []string, format string, err error) {
+	format = ExportFormatFromPath(path)
+	for i := 0; i < len(args); i++ {
+		if strings.ToUpper(args[i]) == "FORMAT" {
+			if i+1 >= len(args) {
+				err = errors.New("FORMAT needs TRIE, CSV, TSV or JSONL")
+				return
+			}
+			format, err = ParseExportFormat(args[i+1])
+			if err != nil {
+				return
+			}
+			i++
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+	return
+}
+
+func newCsvWriter(w io.Writer, format string) *csv.Writer {
+	cw := csv.NewWriter(w)
+	if format == EXPORT_FORMAT_TSV {
+		cw.Comma = '\t'
+	}
+	return cw
+}
+
+func newCsvReader(r io.Reader, format string) *csv.Reader {
+	cr := csv.NewReader(r)
+	if format == EXPORT_FORMAT_TSV {
+		cr.Comma = '\t'
+	}
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	return cr
+}
+
+/*
+Export writes all live members of d in format to w and returns the number
+of written members. the caller has to hold the read lock.
+*/
+func (d *Database) Export(w io.Writer, format string) (n int64, err error) {
+	if format == EXPORT_FORMAT_TRIE {
+		return 0, errors.New("Use SAVE to write the TRIE format.")
+	}
+	bw := bufio.NewWriter(w)
+	cw := newCsvWriter(bw, format)
+	enc := json.NewEncoder(bw)
+	for _, m := range d.liveMembers(d.Db.Members()) {
+		rec := &ExportRecord{
+			Key:   d.DisplayKey(m.Value),
+			Count: m.Count,
+			Value: string(d.Values[m.Value]),
+		}
+		if format == EXPORT_FORMAT_JSONL {
+			err = enc.Encode(rec)
+		} else {
+			fields := []string{rec.Key, strconv.FormatInt(rec.Count, 10)}
+			if _, exists := d.Values[m.Value]; exists {
+				fields = append(fields, rec.Value)
+			}
+			err = cw.Write(fields)
+		}
+		if err != nil {
+			return
+		}
+		n++
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return
+	}
+	err = bw.Flush()
+	return
+}
+
+/*
+ExportFile writes the export to fname. the file gets written to a new
+temporary file in the same directory first and is then moved into place.
+*/
+func (d *Database) ExportFile(fname string, format string) (n int64, err error) {
+	f, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".tmp")
+	if err != nil {
+		return
+	}
+	tmpName := f.Name()
+	n, err = d.Export(f, format)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return
+	}
+	err = os.Rename(tmpName, fname)
+	return
+}
+
+/*
+ReadExport calls fn for every record of a text export in r. a missing
+count is read as 1.
+*/
+func ReadExport(r io.Reader, format string, fn func(rec *ExportRecord) error) (err error) {
+	if format == EXPORT_FORMAT_JSONL {
+		dec := json.NewDecoder(bufio.NewReader(r))
+		for line := 1; ; line++ {
+			rec := &ExportRecord{Count: 1}
+			err = dec.Decode(rec)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.New(fmt.Sprintf("Record %d: %v", line, err))
+			}
+			if err = fn(rec); err != nil {
+				return
+			}
+		}
+	}
+	cr := newCsvReader(bufio.NewReader(r), format)
+	for line := 1; ; line++ {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 || fields[0] == "" {
+			continue
+		}
+		rec := &ExportRecord{Key: fields[0], Count: 1}
+		if len(fields) > 1 && fields[1] != "" {
+			rec.Count, err = strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Record %d: invalid count %s", line, fields[1]))
+			}
+		}
+		if len(fields) > 2 {
+			rec.Value = fields[2]
+		}
+		if err = fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ImportRecords adds the records of a text export in r to d. with merge
+the counts are added to existing keys, otherwise they replace them. it
+returns the number of read records. the caller has to hold the write
+lock.
+*/
+func (d *Database) ImportRecords(r io.Reader, format string, merge bool) (n int64, err error) {
+	err = ReadExport(r, format, func(rec *ExportRecord) error {
+		if err := d.importRecord(rec, merge); err != nil {
+			return errors.New(fmt.Sprintf("Record %d: %v", n+1, err))
+		}
+		n++
+		return nil
+	})
+	return
+}
+
+func (d *Database) importRecord(rec *ExportRecord, merge bool) (err error) {
+	if merge {
+		_, err = d.IncrBy(rec.Key, rec.Count)
+	} else {
+		_, err = d.SetCount(rec.Key, rec.Count)
+	}
+	if err != nil {
+		return
+	}
+	if rec.Value != "" {
+		d.SetValue(rec.Key, []byte(rec.Value))
+	}
+	return
+}
+
+/*
+ImportTrieFile adds the keys of the trie dump fname to d. they go through
+IncrBy or SetCount like the records of text exports so they get
+normalized and scored. the caller has to hold the write lock.
+*/
+func (d *Database) ImportTrieFile(fname string, merge bool) (n int64, err error) {
+	t, err := trie.LoadFromFile(fname)
+	if err != nil {
+		return
+	}
+	for _, m := range t.Members() {
+		if err = d.importRecord(&ExportRecord{Key: m.Value, Count: m.Count}, merge); err != nil {
+			return n, errors.New(fmt.Sprintf("Key %d: %v", n+1, err))
+		}
+		n++
+	}
+	return
+}
+
+/*
+ImportFile reads a text export from fname into d. see ImportRecords.
+*/
+func (d *Database) ImportFile(fname string, format string, merge bool) (n int64, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return d.ImportRecords(f, format, merge)
+}
+
+/*
+LoadDatabaseFile loads a database from its trie and meta files without a
+server. it is used by offline tools.
+*/
+func LoadDatabaseFile(name string, fname string) (d *Database, err error) {
+	d = newDetachedDatabase(name)
+	d.Db, err = trie.LoadFromFile(fname)
+	if err != nil {
+		return
+	}
+	err = d.LoadMeta(fname + META_FILE_SUFFIX)
+	return
+}
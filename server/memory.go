@@ -0,0 +1,361 @@
+package tris
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fvbock/trie"
+	"github.com/fvbock/tris/util"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Memory is accounted per database by walking its tries and side maps and
+server wide by the heap size of the process. if ServerConfig.MaxMemory
+is set the heap is checked every MemoryCheckInterval. when it is above
+the limit
+
+	MAXMEMORY_POLICY_REJECT     rejects all write commands
+	MAXMEMORY_POLICY_EVICT_LRU  persists and unloads the least recently
+	                            used databases until enough is freed.
+	                            writes are rejected if that is not enough
+
+unloaded databases are read back from disk on their next access. with
+ServerConfig.LazyLoad databases are only registered on startup and read
+the first time they are used. with ServerConfig.IdleUnloadTime databases
+that were not accessed for that long are persisted and unloaded.
+*/
+const (
+	MAXMEMORY_POLICY_REJECT    = "reject"
+	MAXMEMORY_POLICY_EVICT_LRU = "evict-lru"
+
+	DEFAULT_MEMORY_CHECK_INTERVAL = time.Second
+	// databases accessed more recently are not unloaded
+	MIN_UNLOAD_IDLE_TIME = time.Second
+	// how often databases are checked for IdleUnloadTime
+	IDLE_CHECK_INTERVAL = 10 * time.Second
+
+	// rough sizes of the parts of a trie branch and of map entries
+	ESTIMATED_BRANCH_BYTES    = 96
+	ESTIMATED_MAP_ENTRY_BYTES = 48
+)
+
+/*
+DatabaseStats describes the size of a database. Bytes is an estimate.
+*/
+type DatabaseStats struct {
+	Nodes    int64
+	Members  int64
+	CountSum int64
+	Bytes    int64
+}
+
+func (st *DatabaseStats) String() string {
+	return fmt.Sprintf("members: %v, count sum: %v, nodes: %v, ~%v bytes", st.Members, st.CountSum, st.Nodes, st.Bytes)
+}
+
+/*
+Loaded tells whether the contents of the database are in memory.
+*/
+func (d *Database) Loaded() bool {
+	return d.Db != nil
+}
+
+/*
+dropContents removes the keys and everything attached to them from
+memory. the caller has to hold the write lock.
+*/
+func (d *Database) dropContents() {
+	d.Db = nil
+	d.Values = nil
+	d.Expires = nil
+	d.Scores = nil
+	d.Display = nil
+	d.Suffixes = nil
+}
+
+func (d *Database) touch() {
+	atomic.StoreInt64(&d.LastAccess, time.Now().UnixNano())
+}
+
+func addTrieStats(st *DatabaseStats, t *trie.Trie, members bool) {
+	walkBranches(t.Root, func(b *trie.Branch) {
+		st.Nodes++
+		st.Bytes += ESTIMATED_BRANCH_BYTES + int64(len(b.LeafValue)) + int64(len(b.Branches))*ESTIMATED_MAP_ENTRY_BYTES
+		if members && b.End {
+			st.Members++
+			st.CountSum += b.Count
+		}
+	})
+}
+
+/*
+walkBranches calls fn for every branch under b including b.
+*/
+func walkBranches(b *trie.Branch, fn func(b *trie.Branch)) {
+	if b == nil {
+		return
+	}
+	b.RLock()
+	defer b.RUnlock()
+	fn(b)
+	for _, child := range b.Branches {
+		walkBranches(child, fn)
+	}
+}
+
+/*
+Stats returns the size of the database. the result is cached until the
+next write. the caller has to hold the read lock.
+*/
+func (d *Database) Stats() *DatabaseStats {
+	d.statsLock.Lock()
+	defer d.statsLock.Unlock()
+	if d.stats != nil && d.statsDb == d.Db && d.statsOps == d.OpsCount {
+		return d.stats
+	}
+	st := &DatabaseStats{}
+	if d.Loaded() {
+		addTrieStats(st, d.Db, true)
+		if d.Suffixes != nil {
+			addTrieStats(st, d.Suffixes.Trie, false)
+		}
+		for key, value := range d.Values {
+			st.Bytes += int64(len(key)+len(value)) + ESTIMATED_MAP_ENTRY_BYTES
+		}
+		for key, _ := range d.Expires {
+			st.Bytes += int64(len(key)) + ESTIMATED_MAP_ENTRY_BYTES
+		}
+		for key, _ := range d.Scores {
+			st.Bytes += int64(len(key)) + 2*ESTIMATED_MAP_ENTRY_BYTES
+		}
+		for key, display := range d.Display {
+			st.Bytes += int64(len(key)+len(display)) + ESTIMATED_MAP_ENTRY_BYTES
+		}
+	}
+	d.stats, d.statsDb, d.statsOps = st, d.Db, d.OpsCount
+	return st
+}
+
+/*
+acquireDatabase marks d as used and loads it. if it succeeds d stays
+loaded until releaseDatabase is called.
+*/
+func (s *Server) acquireDatabase(d *Database) (err error) {
+	atomic.AddInt32(&d.users, 1)
+	if err = s.ensureLoaded(d); err != nil {
+		releaseDatabase(d)
+	}
+	return
+}
+
+func releaseDatabase(d *Database) {
+	atomic.AddInt32(&d.users, -1)
+}
+
+func releaseDatabases(dbs []*Database) {
+	for _, d := range dbs {
+		releaseDatabase(d)
+	}
+}
+
+/*
+ensureLoaded reads the database back from disk if it was unloaded and
+marks it as accessed. use acquireDatabase if d has to stay loaded
+afterwards.
+*/
+func (s *Server) ensureLoaded(d *Database) (err error) {
+	d.touch()
+	d.RLock()
+	loaded := d.Loaded()
+	d.RUnlock()
+	if loaded {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.Loaded() {
+		return
+	}
+	fname := s.dbFilePath(d.Name)
+	t, err := trie.LoadFromFile(fname)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not load db %s: %v", d.Name, err))
+	}
+	meta, err := d.readMeta(fname + META_FILE_SUFFIX)
+	if err != nil {
+		return
+	}
+	d.Db = t
+	d.Values = make(map[string][]byte)
+	d.Expires = make(map[string]int64)
+	d.Scores = make(map[string]*DecayScore)
+	d.Display = make(map[string]string)
+	d.applyMeta(meta)
+	s.Log.Printf("Loaded db %s\n", d.Name)
+	return
+}
+
+/*
+unloadDatabase persists the database and drops its contents from memory.
+it returns the estimated number of freed bytes. the default database,
+databases without a data file and databases in use by a request stay
+loaded.
+*/
+func (s *Server) unloadDatabase(d *Database) (freed int64, err error) {
+	if d.Name == DEFAULT_DB || time.Now().UnixNano()-atomic.LoadInt64(&d.LastAccess) < int64(MIN_UNLOAD_IDLE_TIME) {
+		return
+	}
+	fname := s.dbFilePath(d.Name)
+	err = d.Persist(fname)
+	if err != nil {
+		return
+	}
+	if exists, _ := tris.PathExists(fname); !exists {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if !d.Loaded() || d.OpsCount != d.LastPersistOpsCount {
+		// written to since the persist
+		return
+	}
+	// acquireDatabase counts the user before it checks Loaded, so a
+	// request either sees the db unloaded and loads it again or keeps it
+	// loaded here
+	if atomic.LoadInt32(&d.users) > 0 {
+		return
+	}
+	if d.BulkLoad != nil && d.BulkLoad.running() {
+		return
+	}
+	freed = d.Stats().Bytes
+	d.dropContents()
+	s.Log.Printf("Unloaded db %s, ~%v bytes\n", d.Name, freed)
+	return
+}
+
+type databasesByAccess []*Database
+
+func (dbs databasesByAccess) Len() int      { return len(dbs) }
+func (dbs databasesByAccess) Swap(i, j int) { dbs[i], dbs[j] = dbs[j], dbs[i] }
+func (dbs databasesByAccess) Less(i, j int) bool {
+	return atomic.LoadInt64(&dbs[i].LastAccess) < atomic.LoadInt64(&dbs[j].LastAccess)
+}
+
+/*
+evictDatabases unloads the least recently used databases until an
+estimated need bytes are freed.
+*/
+func (s *Server) evictDatabases(need int64) (freed int64) {
+	s.RLock()
+	dbs := make([]*Database, 0, len(s.Databases))
+	for _, db := range s.Databases {
+		dbs = append(dbs, db)
+	}
+	s.RUnlock()
+	sort.Sort(databasesByAccess(dbs))
+	for _, db := range dbs {
+		if freed >= need {
+			break
+		}
+		n, err := s.unloadDatabase(db)
+		if err != nil {
+			s.Log.Printf("Could not unload db %s: %v\n", db.Name, err)
+		}
+		freed += n
+	}
+	return
+}
+
+func heapAlloc() int64 {
+	memstats := new(runtime.MemStats)
+	runtime.ReadMemStats(memstats)
+	return int64(memstats.HeapAlloc)
+}
+
+/*
+checkMemory compares the heap size with MaxMemory, evicts databases if
+the policy says so and sets whether writes are rejected.
+*/
+func (s *Server) checkMemory() {
+	if s.Config.MaxMemory <= 0 || !atomic.CompareAndSwapInt32(&s.memoryChecking, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.memoryChecking, 0)
+	used := heapAlloc()
+	if used > s.Config.MaxMemory && s.maxMemoryPolicy() == MAXMEMORY_POLICY_EVICT_LRU {
+		if s.evictDatabases(used-s.Config.MaxMemory) > 0 {
+			runtime.GC()
+			used = heapAlloc()
+		}
+	}
+	if used > s.Config.MaxMemory {
+		if atomic.SwapInt32(&s.memoryFull, 1) == 0 {
+			s.Log.Printf("Memory use of %v bytes is above MaxMemory %v. Rejecting writes.\n", used, s.Config.MaxMemory)
+		}
+	} else if atomic.SwapInt32(&s.memoryFull, 0) == 1 {
+		s.Log.Printf("Memory use of %v bytes is below MaxMemory %v again.\n", used, s.Config.MaxMemory)
+	}
+}
+
+/*
+unloadIdleDatabases unloads all databases that were not accessed for
+IdleUnloadTime.
+*/
+func (s *Server) unloadIdleDatabases() {
+	if s.Config.IdleUnloadTime <= 0 || !atomic.CompareAndSwapInt32(&s.unloadingIdle, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.unloadingIdle, 0)
+	idleSince := time.Now().Add(-s.Config.IdleUnloadTime).UnixNano()
+	s.RLock()
+	var idle []*Database
+	for _, db := range s.Databases {
+		if atomic.LoadInt64(&db.LastAccess) < idleSince {
+			idle = append(idle, db)
+		}
+	}
+	s.RUnlock()
+	for _, db := range idle {
+		db.RLock()
+		loaded := db.Loaded()
+		db.RUnlock()
+		if !loaded {
+			continue
+		}
+		if _, err := s.unloadDatabase(db); err != nil {
+			s.Log.Printf("Could not unload idle db %s: %v\n", db.Name, err)
+		}
+	}
+}
+
+func (s *Server) maxMemoryPolicy() string {
+	if s.Config.MaxMemoryPolicy == MAXMEMORY_POLICY_EVICT_LRU {
+		return MAXMEMORY_POLICY_EVICT_LRU
+	}
+	return MAXMEMORY_POLICY_REJECT
+}
+
+/*
+dbStatsInfo is the load state, size and last access of d for INFO.
+*/
+func dbStatsInfo(d *Database) string {
+	d.RLock()
+	defer d.RUnlock()
+	lastAccess := "never accessed"
+	if la := atomic.LoadInt64(&d.LastAccess); la > 0 {
+		lastAccess = fmt.Sprintf("accessed %v ago", time.Since(time.Unix(0, la)))
+	}
+	if !d.Loaded() {
+		return "unloaded, " + lastAccess
+	}
+	return fmt.Sprintf("loaded, %s, %s", d.Stats(), lastAccess)
+}
+
+func (s *Server) memoryFullReply() *Reply {
+	errMsg := fmt.Sprintf("Out of memory: MaxMemory of %v bytes reached. Writes are rejected.", s.Config.MaxMemory)
+	return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+}
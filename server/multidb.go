@@ -0,0 +1,204 @@
+package tris
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fvbock/trie"
+	"sort"
+	"strings"
+)
+
+/*
+Queries against other databases than the active one come in two forms:
+
+	CMD@db args...                   runs any command against db
+	HAS key IN db1,db2 [MERGE]       runs HAS, HASCOUNT or PREFIXMEMBERS
+	                                 against several dbs
+
+IN replies carry one row per database, MERGE combines them into one
+result with the counts summed. commands that change the connection can
+not be qualified.
+*/
+
+var (
+	// commands that change the connection state
+	SessionCommands = map[string]bool{
+		"AUTH":   true,
+		"HELLO":  true,
+		"SELECT": true,
+		"TIMING": true,
+		"EXIT":   true,
+	}
+)
+
+/*
+splitDbQualifier splits CMD@db into the command and database name.
+*/
+func splitDbQualifier(cmd string) (name string, dbName string) {
+	at := strings.Index(cmd, "@")
+	if at < 0 {
+		return cmd, ""
+	}
+	return cmd[:at], cmd[at+1:]
+}
+
+/*
+qualifiedClient returns a copy of c that has dbName as its active
+database to run cmdName with. the original connection stays untouched,
+so SessionCommands are rejected.
+*/
+func (s *Server) qualifiedClient(c *ClientConnection, cmdName string, dbName string) (qc *ClientConnection, err error) {
+	if SessionCommands[cmdName] {
+		err = errors.New(fmt.Sprintf("%s changes the connection and can not run against another db.", cmdName))
+		return
+	}
+	s.RLock()
+	db, exists := s.Databases[dbName]
+	s.RUnlock()
+	if !exists {
+		err = errors.New(fmt.Sprintf("Databases %s does not exist.", dbName))
+		return
+	}
+	qcopy := *c
+	qcopy.ActiveDb = db
+	return &qcopy, nil
+}
+
+/*
+splitInArgs strips a trailing "IN db1,db2 [MERGE]" from args.
+*/
+func splitInArgs(args []interface{}) (rest []interface{}, dbNames []string, merge bool) {
+	rest = args
+	for i, arg := range args {
+		if strings.ToUpper(arg.(string)) != "IN" || i+1 >= len(args) {
+			continue
+		}
+		for _, name := range strings.Split(args[i+1].(string), ",") {
+			if name != "" {
+				dbNames = append(dbNames, name)
+			}
+		}
+		if i+2 < len(args) && strings.ToUpper(args[i+2].(string)) == "MERGE" {
+			merge = true
+		}
+		rest = args[:i]
+		return
+	}
+	return
+}
+
+/*
+databasesByName returns the databases in the order of names if c may
+access them. c is nil for the server itself. the databases are acquired,
+the caller has to release them with releaseDatabases.
+*/
+func (s *Server) databasesByName(c *ClientConnection, names []string) (dbs []*Database, err error) {
+	if err = s.checkDbAccess(c, names...); err != nil {
+		return
+	}
+	s.RLock()
+	for _, name := range names {
+		db, exists := s.Databases[name]
+		if !exists {
+			s.RUnlock()
+			return nil, errors.New(fmt.Sprintf("Databases %s does not exist.", name))
+		}
+		dbs = append(dbs, db)
+	}
+	s.RUnlock()
+	for i, db := range dbs {
+		if err = s.acquireDatabase(db); err != nil {
+			releaseDatabases(dbs[:i])
+			return nil, err
+		}
+	}
+	return
+}
+
+func multiHasReply(dbs []*Database, key string, merge bool) *Reply {
+	var rows [][]byte
+	var any bool
+	for _, db := range dbs {
+		db.RLock()
+		exists := db.Has(key)
+		db.RUnlock()
+		any = any || exists
+		if !merge {
+			rows = append(rows, []byte(db.Name), boolPayload(exists))
+		}
+	}
+	if merge {
+		return NewReply([][]byte{boolPayload(any)}, COMMAND_OK, 1, []int{REPLY_TYPE_BOOL})
+	}
+	return NewReply(rows, COMMAND_OK, 2, []int{REPLY_TYPE_STRING, REPLY_TYPE_BOOL})
+}
+
+func multiHasCountReply(dbs []*Database, key string, merge bool) *Reply {
+	var rows [][]byte
+	var sum int64
+	for _, db := range dbs {
+		db.RLock()
+		_, count := db.HasCount(key)
+		db.RUnlock()
+		sum += count
+		if !merge {
+			rows = append(rows, []byte(db.Name), encodeIntReply(count))
+		}
+	}
+	if merge {
+		return NewReply([][]byte{encodeIntReply(sum)}, COMMAND_OK, 1, []int{REPLY_TYPE_INT})
+	}
+	return NewReply(rows, COMMAND_OK, 2, []int{REPLY_TYPE_STRING, REPLY_TYPE_INT})
+}
+
+func multiPrefixMembersReply(dbs []*Database, prefix string, sortBy string, merge bool) *Reply {
+	var rows [][]byte
+	var merged []*trie.MemberInfo
+	mergedIdx := make(map[string]int)
+	for _, db := range dbs {
+		db.RLock()
+		members := db.PrefixMembers(prefix)
+		if sortBy == SORT_BY_COUNT && !merge {
+			db.sortMembers(members, sortBy)
+		}
+		for _, m := range members {
+			key := db.DisplayKey(m.Value)
+			if !merge {
+				rows = append(rows, []byte(db.Name), []byte(key), encodeIntReply(m.Count))
+				continue
+			}
+			if idx, exists := mergedIdx[m.Value]; exists {
+				merged[idx].Count += m.Count
+			} else {
+				mergedIdx[m.Value] = len(merged)
+				merged = append(merged, &trie.MemberInfo{Value: key, Count: m.Count})
+			}
+		}
+		db.RUnlock()
+	}
+	if !merge {
+		return NewReply(rows, COMMAND_OK, 3, []int{REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_INT})
+	}
+	if sortBy == SORT_BY_COUNT {
+		sort.Stable(&sortableMembers{members: merged})
+	} else {
+		sort.Sort(membersByValue(merged))
+	}
+	for _, m := range merged {
+		rows = append(rows, []byte(m.Value), encodeIntReply(m.Count))
+	}
+	return NewReply(rows, COMMAND_OK, 2, []int{REPLY_TYPE_STRING, REPLY_TYPE_INT})
+}
+
+type membersByValue []*trie.MemberInfo
+
+func (m membersByValue) Len() int           { return len(m) }
+func (m membersByValue) Less(i, j int) bool { return m[i].Value < m[j].Value }
+func (m membersByValue) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+func boolPayload(b bool) []byte {
+	if b {
+		return []byte("TRUE")
+	}
+	return []byte("FALSE")
+}
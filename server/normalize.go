@@ -0,0 +1,122 @@
+package tris
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	NORMALIZE_CASEFOLD = 1 << iota
+	NORMALIZE_NFC
+	NORMALIZE_NFKC
+	NORMALIZE_STRIP_DIACRITICS
+	NORMALIZE_COLLAPSE_WHITESPACE
+)
+
+var (
+	// names of the normalizations in CREATE ... NORMALIZE name,name
+	NormalizationNames = map[string]int{
+		"CASEFOLD":     NORMALIZE_CASEFOLD,
+		"NFC":          NORMALIZE_NFC,
+		"NFKC":         NORMALIZE_NFKC,
+		"NODIACRITICS": NORMALIZE_STRIP_DIACRITICS,
+		"WHITESPACE":   NORMALIZE_COLLAPSE_WHITESPACE,
+	}
+)
+
+/*
+ParseNormalization parses a comma separated list of NormalizationNames.
+*/
+func ParseNormalization(spec string) (normalization int, err error) {
+	for _, name := range strings.Split(spec, ",") {
+		n, exists := NormalizationNames[strings.ToUpper(strings.TrimSpace(name))]
+		if !exists {
+			err = errors.New(fmt.Sprintf("Unknown normalization %s", name))
+			return
+		}
+		normalization |= n
+	}
+	return
+}
+
+/*
+NormalizationString returns the comma separated names of the
+normalizations set in normalization.
+*/
+func NormalizationString(normalization int) string {
+	var names sort.StringSlice
+	for name, n := range NormalizationNames {
+		if normalization&n == n {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(names)
+	return strings.Join(names, ",")
+}
+
+/*
+NormalizeKey applies the normalizations to key. the unicode forms go
+first, then diacritics are stripped, case folded and whitespace is
+collapsed.
+*/
+func NormalizeKey(key string, normalization int) string {
+	if normalization&NORMALIZE_NFKC == NORMALIZE_NFKC {
+		key = norm.NFKC.String(key)
+	} else if normalization&NORMALIZE_NFC == NORMALIZE_NFC {
+		key = norm.NFC.String(key)
+	}
+	if normalization&NORMALIZE_STRIP_DIACRITICS == NORMALIZE_STRIP_DIACRITICS {
+		stripped, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), key)
+		if err == nil {
+			key = stripped
+		}
+	}
+	if normalization&NORMALIZE_CASEFOLD == NORMALIZE_CASEFOLD {
+		key = cases.Fold().String(key)
+	}
+	if normalization&NORMALIZE_COLLAPSE_WHITESPACE == NORMALIZE_COLLAPSE_WHITESPACE {
+		key = strings.Join(strings.Fields(key), " ")
+	}
+	return key
+}
+
+/*
+normalize returns the form of key that is stored in the trie.
+*/
+func (d *Database) normalize(key string) string {
+	if d.Options.Normalization == 0 {
+		return key
+	}
+	return NormalizeKey(key, d.Options.Normalization)
+}
+
+/*
+rememberDisplay keeps the first form in which a key was added so results
+can show it instead of the normalized key.
+*/
+func (d *Database) rememberDisplay(key string, nkey string) {
+	if key == nkey {
+		return
+	}
+	if _, exists := d.Display[nkey]; !exists {
+		d.Display[nkey] = key
+	}
+}
+
+/*
+DisplayKey returns the form of the normalized key nkey that should be
+shown in results. the caller has to hold the read lock.
+*/
+func (d *Database) DisplayKey(nkey string) string {
+	if display, exists := d.Display[nkey]; exists {
+		return display
+	}
+	return nkey
+}
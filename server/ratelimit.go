@@ -0,0 +1,267 @@
+package tris
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Requests can be rate limited with token buckets, one per flag class:
+
+	ServerConfig.RateLimits      apply to every connection
+	ServerConfig.UserRateLimits  apply to all connections of an
+	                             authenticated user together
+
+a command takes one token from the bucket of every class in its flags.
+commands over the limit are not run and get COMMAND_RATE_LIMITED with
+the time until a token is available. CLIENT LIST shows the buckets of
+every connection.
+*/
+const (
+	COMMAND_RATE_LIMITED = 2
+)
+
+var (
+	// commands that are never rate limited
+	RateLimitExemptCommands = map[string]bool{
+		"EXIT":      true,
+		"REPLSYNC":  true,
+		"REPLFETCH": true,
+	}
+
+	rateLimitClasses = []int{COMMAND_FLAG_READ, COMMAND_FLAG_WRITE, COMMAND_FLAG_ADMIN}
+)
+
+/*
+RateLimit allows Rate commands per second with bursts of up to Burst
+commands. a Rate of 0 means no limit. Burst defaults to Rate.
+*/
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+/*
+RateLimits are the limits per flag class.
+*/
+type RateLimits struct {
+	Read  RateLimit
+	Write RateLimit
+	Admin RateLimit
+}
+
+func (l *RateLimits) forClass(class int) RateLimit {
+	switch class {
+	case COMMAND_FLAG_READ:
+		return l.Read
+	case COMMAND_FLAG_WRITE:
+		return l.Write
+	}
+	return l.Admin
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+}
+
+func (b *tokenBucket) refill(elapsed time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+b.rate*elapsed.Seconds())
+}
+
+/*
+rateLimiter holds the buckets of one connection or user. classes without
+a limit have no bucket.
+*/
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[int]*tokenBucket
+	last    time.Time
+}
+
+func newRateLimiter(limits *RateLimits) *rateLimiter {
+	if limits == nil {
+		return nil
+	}
+	l := &rateLimiter{buckets: make(map[int]*tokenBucket), last: time.Now()}
+	for _, class := range rateLimitClasses {
+		limit := limits.forClass(class)
+		if limit.Rate <= 0 {
+			continue
+		}
+		burst := limit.Burst
+		if burst < 1 {
+			burst = math.Max(1, limit.Rate)
+		}
+		l.buckets[class] = &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst}
+	}
+	if len(l.buckets) == 0 {
+		return nil
+	}
+	return l
+}
+
+/*
+take removes a token for every class in flags if all of them have one.
+otherwise it takes nothing and returns the class that is empty and how
+long until it has a token again.
+*/
+func (l *rateLimiter) take(flags int) (ok bool, class int, wait time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(l.last)
+	l.last = now
+	for _, b := range l.buckets {
+		b.refill(elapsed)
+	}
+	for c, b := range l.buckets {
+		if flags&c != 0 && b.tokens < 1 {
+			return false, c, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		}
+	}
+	for c, b := range l.buckets {
+		if flags&c != 0 {
+			b.tokens--
+		}
+	}
+	return true, 0, 0
+}
+
+/*
+refund gives back the tokens taken for flags.
+*/
+func (l *rateLimiter) refund(flags int) {
+	l.Lock()
+	defer l.Unlock()
+	for c, b := range l.buckets {
+		if flags&c != 0 {
+			b.tokens = math.Min(b.burst, b.tokens+1)
+		}
+	}
+}
+
+/*
+String shows the tokens left and the burst size per class.
+*/
+func (l *rateLimiter) String() string {
+	if l == nil {
+		return "unlimited"
+	}
+	l.Lock()
+	defer l.Unlock()
+	elapsed := time.Since(l.last)
+	var parts []string
+	for _, class := range rateLimitClasses {
+		b, exists := l.buckets[class]
+		if !exists {
+			continue
+		}
+		tokens := math.Min(b.burst, b.tokens+b.rate*elapsed.Seconds())
+		parts = append(parts, fmt.Sprintf("%s %.1f/%g at %g/s", ACLFlagsString(class), tokens, b.burst, b.rate))
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+userRateLimiter returns the shared limiter of user or nil if the user has
+no limits.
+*/
+func (s *Server) userRateLimiter(user string) *rateLimiter {
+	limits, exists := s.Config.UserRateLimits[user]
+	if !exists {
+		return nil
+	}
+	s.rateLock.Lock()
+	defer s.rateLock.Unlock()
+	if l, exists := s.userLimiters[user]; exists {
+		return l
+	}
+	l := newRateLimiter(limits)
+	s.userLimiters[user] = l
+	return l
+}
+
+/*
+checkRateLimit takes the tokens for cmd from the buckets of c and its
+user. it returns the reply for a limited command or nil.
+*/
+func (s *Server) checkRateLimit(c *ClientConnection, cmd Command) *Reply {
+	if RateLimitExemptCommands[cmd.Name()] {
+		return nil
+	}
+	flags := cmd.Flags()
+	var userLimiter *rateLimiter
+	if c.Authenticated {
+		userLimiter = s.userRateLimiter(c.User)
+	}
+	if c.limiter != nil {
+		if ok, class, wait := c.limiter.take(flags); !ok {
+			return rateLimitedReply(c, class, wait)
+		}
+	}
+	if userLimiter != nil {
+		if ok, class, wait := userLimiter.take(flags); !ok {
+			if c.limiter != nil {
+				c.limiter.refund(flags)
+			}
+			return rateLimitedReply(c, class, wait)
+		}
+	}
+	return nil
+}
+
+func rateLimitedReply(c *ClientConnection, class int, wait time.Duration) *Reply {
+	atomic.AddInt64(&c.RateLimited, 1)
+	errMsg := fmt.Sprintf("RATELIMIT Rate limit for %s commands exceeded. Retry in %v.", ACLFlagsString(class), wait)
+	return NewReply([][]byte{[]byte(errMsg)}, COMMAND_RATE_LIMITED, 1, []int{REPLY_TYPE_STRING})
+}
+
+/*
+clientListReply replies one row per connection: id, user, active db,
+commands run, commands limited and the state of the buckets of the
+connection and its user.
+*/
+func (s *Server) clientListReply() *Reply {
+	s.RLock()
+	clients := make([]*ClientConnection, 0, len(s.ActiveClients))
+	for _, c := range s.ActiveClients {
+		clients = append(clients, c)
+	}
+	s.RUnlock()
+	sort.Sort(clientsById(clients))
+	var rows [][]byte
+	for _, c := range clients {
+		user := c.User
+		if !c.Authenticated {
+			user = "-"
+		}
+		usage := "connection: " + c.limiter.String()
+		if c.Authenticated {
+			if l := s.userRateLimiter(c.User); l != nil {
+				usage += "; user: " + l.String()
+			}
+		}
+		rows = append(rows,
+			[]byte(hex.EncodeToString(c.Id)),
+			[]byte(user),
+			[]byte(c.ActiveDb.Name),
+			encodeIntReply(atomic.LoadInt64(&c.Commands)),
+			encodeIntReply(atomic.LoadInt64(&c.RateLimited)),
+			[]byte(usage))
+	}
+	return NewReply(rows, COMMAND_OK, 6, []int{REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_INT, REPLY_TYPE_INT, REPLY_TYPE_STRING})
+}
+
+type clientsById []*ClientConnection
+
+func (cs clientsById) Len() int           { return len(cs) }
+func (cs clientsById) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs clientsById) Less(i, j int) bool { return string(cs[i].Id) < string(cs[j].Id) }
@@ -0,0 +1,1169 @@
+package tris
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	zmq "github.com/alecthomas/gozmq"
+	"github.com/fvbock/trie"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+A server with ServerConfig.ReplicationBacklog keeps the last that many
+write commands in a replication log. replicas (ServerConfig.ReplicaOf)
+connect to it, fetch a snapshot of every database with REPLSYNC and then
+poll the log with REPLFETCH from the offset they have applied. after a
+disconnect they continue from that offset as long as the primary still
+has it in its backlog, otherwise they sync again.
+
+write commands run one at a time on a primary so the log has the order
+they were applied in. every entry carries the time the command ran at,
+replicas apply it with that time so expiry times and decayed scores come
+out the same. IMPORT and MERGE read files of the primary, they are sent
+as a snapshot of the database they changed. so is BULKLOAD once it is
+done. replicas reject writes from clients with COMMAND_READONLY and can
+not have replicas themselves.
+
+snapshots are written to DataDir/REPL_SNAPSHOT_DIR while writes wait.
+unloaded databases are copied from their data files. replicas read the
+files in chunks of REPL_CHUNK_SIZE with
+
+	REPLSYNC                          starts a full sync. it replies the
+	                                  log position, the snapshot id and
+	                                  the names of the databases
+	REPLSYNC READ id n TRIE|META pos  a chunk of a file of the n-th
+	                                  database of the snapshot
+	REPLSYNC DONE id                  removes a full sync snapshot
+
+a full sync snapshot is removed REPL_SYNC_TIMEOUT after its last read at
+the latest, the snapshot of a log entry when the entry leaves the
+backlog.
+
+REPLICAOF changes the role of a running server. a manual failover is
+
+	REPLICAOF newhost newport  on the old primary. running writes finish,
+	                           new ones are rejected. the replicas can
+	                           still fetch the rest of its log
+	INFO                       on the new primary until its lag is 0
+	REPLICAOF NO ONE           on the new primary. it starts a new log,
+	                           the old primary and the other replicas
+	                           sync from it once they point to it
+
+ROLE tells clients which node is the primary.
+*/
+const (
+	// nr of log entries sent in one REPLFETCH reply
+	REPL_FETCH_MAX = 1000
+	// how long REPLFETCH waits for new entries
+	REPL_FETCH_WAIT = time.Second
+	// how long a replica waits for a reply of the primary
+	REPL_TIMEOUT      = 10 * time.Second
+	REPL_SYNC_TIMEOUT = 5 * time.Minute
+	// wait before a replica reconnects
+	REPL_RETRY_INTERVAL = time.Second
+	// replicas that did not fetch for this long are not listed
+	REPL_REPLICA_TIMEOUT = time.Minute
+
+	REPL_RESYNC_PREFIX = "RESYNC"
+
+	// directory in DataDir for snapshots and downloads of replicas
+	REPL_SNAPSHOT_DIR = "replication"
+	// bytes sent in one REPLSYNC READ reply
+	REPL_CHUNK_SIZE = 4 << 20
+	// files of a database in a snapshot
+	REPL_FILE_TRIE = "TRIE"
+	REPL_FILE_META = "META"
+
+	// backlog of a promoted replica without ReplicationBacklog
+	DEFAULT_PROMOTED_BACKLOG = 10000
+
+	COMMAND_READONLY = 3
+
+	ROLE_PRIMARY = "primary"
+	ROLE_REPLICA = "replica"
+)
+
+var (
+	// write commands that are not sent to replicas
+	ReplicationSkipCommands = map[string]bool{
+		"SAVE":     true,
+		"UPLOAD":   true,
+		"BULKLOAD": true,
+	}
+
+	// write commands a replica accepts from clients
+	ReplicaWriteCommands = map[string]bool{
+		"SAVE": true,
+	}
+
+	errResync  = errors.New("the primary asks for a full sync")
+	errStopped = errors.New("replication stopped")
+)
+
+/*
+ReplEntry is a write command in the replication log or a snapshot of a
+database that replaces it. Time is when the command ran in unix
+nanoseconds.
+*/
+type ReplEntry struct {
+	Offset     int64
+	Time       int64
+	Db         string   `json:",omitempty"`
+	Cmd        string   `json:",omitempty"`
+	Args       []string `json:",omitempty"`
+	SnapshotId string   `json:",omitempty"`
+}
+
+/*
+replSnapshot is a set of database snapshots in a directory of the
+replication log.
+*/
+type replSnapshot struct {
+	Id  string
+	Dbs []string
+	dir string
+	// full sync snapshots are removed by REPLSYNC DONE or after
+	// REPL_SYNC_TIMEOUT, the others with their log entry
+	full     bool
+	lastRead time.Time
+}
+
+/*
+path returns the name of a REPL_FILE_* file of the n-th database.
+*/
+func (snap *replSnapshot) path(n int, file string) string {
+	fname := filepath.Join(snap.dir, snap.Dbs[n])
+	if file == REPL_FILE_META {
+		fname += META_FILE_SUFFIX
+	}
+	return fname
+}
+
+type replicaInfo struct {
+	Offset    int64
+	LastFetch time.Time
+}
+
+/*
+replicationLog is the backlog of a primary. writeLock is held while a
+write command runs and gets logged and while snapshots are taken.
+*/
+type replicationLog struct {
+	sync.Mutex
+	writeLock sync.Mutex
+	Id        string
+	size      int
+	entries   []*ReplEntry
+	offset    int64
+	changed   chan bool
+	replicas  map[string]*replicaInfo
+	// where the snapshots are written to
+	dir       string
+	snapshots map[string]*replSnapshot
+}
+
+func randomId(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+/*
+newReplicationLog creates a log that keeps size entries and its
+snapshots in a directory below snapshotDir.
+*/
+func newReplicationLog(size int, snapshotDir string) *replicationLog {
+	id := randomId(20)
+	return &replicationLog{
+		Id:        id,
+		size:      size,
+		changed:   make(chan bool),
+		replicas:  make(map[string]*replicaInfo),
+		dir:       filepath.Join(snapshotDir, id),
+		snapshots: make(map[string]*replSnapshot),
+	}
+}
+
+/*
+append adds e to the log. e.Time is set to now if it is not set yet.
+*/
+func (l *replicationLog) append(e *ReplEntry) {
+	l.Lock()
+	defer l.Unlock()
+	l.offset++
+	e.Offset = l.offset
+	if e.Time == 0 {
+		e.Time = time.Now().UnixNano()
+	}
+	l.entries = append(l.entries, e)
+	if len(l.entries) > l.size {
+		for _, dropped := range l.entries[:len(l.entries)-l.size] {
+			if dropped.SnapshotId != "" {
+				l.removeSnapshot(dropped.SnapshotId)
+			}
+		}
+		l.entries = l.entries[len(l.entries)-l.size:]
+	}
+	close(l.changed)
+	l.changed = make(chan bool)
+}
+
+/*
+addSnapshot registers snap. full sync snapshots that were not read for
+REPL_SYNC_TIMEOUT are removed.
+*/
+func (l *replicationLog) addSnapshot(snap *replSnapshot) {
+	l.Lock()
+	defer l.Unlock()
+	for id, other := range l.snapshots {
+		if other.full && time.Since(other.lastRead) > REPL_SYNC_TIMEOUT {
+			l.removeSnapshot(id)
+		}
+	}
+	snap.lastRead = time.Now()
+	l.snapshots[snap.Id] = snap
+}
+
+/*
+snapshot returns the snapshot id or nil if it is gone.
+*/
+func (l *replicationLog) snapshot(id string) *replSnapshot {
+	l.Lock()
+	defer l.Unlock()
+	snap := l.snapshots[id]
+	if snap != nil {
+		snap.lastRead = time.Now()
+	}
+	return snap
+}
+
+/*
+removeSnapshot deletes the snapshot id and its files. the caller has to
+hold the lock.
+*/
+func (l *replicationLog) removeSnapshot(id string) {
+	if snap, exists := l.snapshots[id]; exists {
+		delete(l.snapshots, id)
+		os.RemoveAll(snap.dir)
+	}
+}
+
+/*
+close removes all snapshots of a log that is not used anymore.
+*/
+func (l *replicationLog) close() {
+	l.Lock()
+	defer l.Unlock()
+	l.snapshots = make(map[string]*replSnapshot)
+	os.RemoveAll(l.dir)
+}
+
+/*
+since returns up to max entries after offset. ok is false if offset is
+not covered by the backlog.
+*/
+func (l *replicationLog) since(offset int64, max int) (entries []*ReplEntry, current int64, ok bool, changed chan bool) {
+	l.Lock()
+	defer l.Unlock()
+	current, changed = l.offset, l.changed
+	first := l.offset + 1
+	if len(l.entries) > 0 {
+		first = l.entries[0].Offset
+	}
+	if offset > l.offset || offset < first-1 {
+		return
+	}
+	start := int(offset - first + 1)
+	end := len(l.entries)
+	if end-start > max {
+		end = start + max
+	}
+	return l.entries[start:end], current, true, changed
+}
+
+func (l *replicationLog) seen(replica string, offset int64) {
+	l.Lock()
+	defer l.Unlock()
+	l.replicas[replica] = &replicaInfo{Offset: offset, LastFetch: time.Now()}
+}
+
+func (l *replicationLog) String() string {
+	l.Lock()
+	defer l.Unlock()
+	first := l.offset + 1
+	if len(l.entries) > 0 {
+		first = l.entries[0].Offset
+	}
+	info := fmt.Sprintf("  Role: primary\n  ReplicationId: %s\n  Offset: %v\n  Backlog: %v-%v\n", l.Id, l.offset, first, l.offset)
+	var ids sort.StringSlice
+	for id, r := range l.replicas {
+		if time.Since(r.LastFetch) > REPL_REPLICA_TIMEOUT {
+			delete(l.replicas, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	info += fmt.Sprintf("  Replicas: %v\n", len(ids))
+	for _, id := range ids {
+		r := l.replicas[id]
+		info += fmt.Sprintf("    %s offset %v, %v behind, last fetch %v ago\n", id, r.Offset, l.offset-r.Offset, time.Since(r.LastFetch))
+	}
+	return info
+}
+
+/*
+replicaLink is the connection of a replica to its primary.
+*/
+type replicaLink struct {
+	sync.Mutex
+	Primary       string
+	Id            string
+	Offset        int64
+	PrimaryOffset int64
+	Synced        bool
+	Up            bool
+	LastError     string
+	LastContact   time.Time
+	// time of the last applied entry on the primary
+	LastApplied int64
+	stop        chan bool
+	// held while entries are applied. nothing is applied once stopped
+	applyLock sync.Mutex
+	stopped   bool
+}
+
+func (link *replicaLink) String() string {
+	link.Lock()
+	defer link.Unlock()
+	state := "down"
+	if link.Up {
+		state = "up"
+	}
+	if link.LastError != "" {
+		state += ", last error: " + link.LastError
+	}
+	lastContact := "never"
+	if !link.LastContact.IsZero() {
+		lastContact = fmt.Sprintf("%v ago", time.Since(link.LastContact))
+	}
+	lag := "unknown"
+	if link.Synced {
+		lag = fmt.Sprintf("%v entries", link.PrimaryOffset-link.Offset)
+		if link.PrimaryOffset > link.Offset && link.LastApplied > 0 {
+			lag += fmt.Sprintf(", %v", time.Since(time.Unix(0, link.LastApplied)))
+		}
+	}
+	return fmt.Sprintf("  Role: replica\n  Primary: %s\n  Link: %s\n  LastContact: %s\n  ReplicationId: %s\n  Offset: %v\n  PrimaryOffset: %v\n  Lag: %s\n",
+		link.Primary, state, lastContact, link.Id, link.Offset, link.PrimaryOffset, lag)
+}
+
+func (link *replicaLink) down(err error) {
+	link.Lock()
+	link.Up = false
+	link.LastError = err.Error()
+	link.Unlock()
+}
+
+/*
+isReplica tells whether the server replicates a primary.
+*/
+func (s *Server) isReplica() bool {
+	s.replLock.RLock()
+	defer s.replLock.RUnlock()
+	return s.replica != nil
+}
+
+func (s *Server) replicationLog() *replicationLog {
+	s.replLock.RLock()
+	defer s.replLock.RUnlock()
+	return s.replLog
+}
+
+func (s *Server) replSnapshotDir() string {
+	return filepath.Join(s.Config.DataDir, REPL_SNAPSHOT_DIR)
+}
+
+func (s *Server) replicationInfo() string {
+	s.replLock.RLock()
+	replica, replLog := s.replica, s.replLog
+	s.replLock.RUnlock()
+	switch {
+	case replica != nil:
+		return replica.String()
+	case replLog != nil:
+		return replLog.String()
+	}
+	return "  Role: primary\n  Backlog: disabled\n"
+}
+
+func readOnlyReply() *Reply {
+	return NewReply([][]byte{[]byte("READONLY This server is a replica and does not accept writes.")}, COMMAND_READONLY, 1, []int{REPLY_TYPE_STRING})
+}
+
+func copyFile(src string, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(out, in)
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	return
+}
+
+/*
+writeSnapshotFiles writes the trie and meta file of d to snap. an
+unloaded database is copied from its data files and not loaded.
+*/
+func (s *Server) writeSnapshotFiles(snap *replSnapshot, n int, d *Database) (err error) {
+	// holding the read lock keeps d from being loaded and written
+	d.RLock()
+	defer d.RUnlock()
+	if !d.Loaded() {
+		fname := s.dbFilePath(d.Name)
+		if err = copyFile(fname, snap.path(n, REPL_FILE_TRIE)); err != nil {
+			return
+		}
+		if err = copyFile(fname+META_FILE_SUFFIX, snap.path(n, REPL_FILE_META)); os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = d.Db.DumpToFile(snap.path(n, REPL_FILE_TRIE)); err != nil {
+		return
+	}
+	data, err := json.Marshal(d.meta())
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(snap.path(n, REPL_FILE_META), data, 0600)
+}
+
+/*
+createSnapshot writes snapshots of dbs and registers them with l. the
+caller holds writeLock.
+*/
+func (s *Server) createSnapshot(l *replicationLog, dbs []*Database, full bool) (snap *replSnapshot, err error) {
+	snap = &replSnapshot{Id: randomId(8), full: full}
+	snap.dir = filepath.Join(l.dir, snap.Id)
+	if err = os.MkdirAll(snap.dir, 0700); err != nil {
+		return nil, err
+	}
+	for n, d := range dbs {
+		snap.Dbs = append(snap.Dbs, d.Name)
+		if err = s.writeSnapshotFiles(snap, n, d); err != nil {
+			os.RemoveAll(snap.dir)
+			return nil, errors.New(fmt.Sprintf("Could not snapshot db %s: %v", d.Name, err))
+		}
+	}
+	l.addSnapshot(snap)
+	return
+}
+
+/*
+restoreSnapshotFiles replaces or creates the database name with the
+contents of the trie and meta file.
+*/
+func (s *Server) restoreSnapshotFiles(name string, trieFile string, metaFile string) (err error) {
+	if err = CheckDbName(name); err != nil {
+		return
+	}
+	d := newDetachedDatabase(name)
+	d.PersistOpsLimit = s.Config.PersistOpsLimit
+	d.PersistInterval = s.Config.PersistInterval
+	d.clock = &s.writeClock
+	if d.Db, err = trie.LoadFromFile(trieFile); err != nil {
+		return
+	}
+	meta, err := d.readMeta(metaFile)
+	if err != nil {
+		return
+	}
+	d.applyMeta(meta)
+	d.OpsCount = 1
+	d.touch()
+	s.Lock()
+	if existing, exists := s.Databases[name]; exists {
+		existing.Lock()
+		swapContents(existing, d)
+		existing.OpsCount += 1
+		existing.Unlock()
+	} else {
+		s.Databases[name] = d
+	}
+	s.Unlock()
+	return
+}
+
+/*
+replicate logs a successful write command that ran at now. the caller
+holds writeLock.
+*/
+func (s *Server) replicate(l *replicationLog, cmdName string, c *ClientConnection, args []interface{}, now int64) {
+	var snapDb *Database
+	switch cmdName {
+	case "IMPORT":
+		s.RLock()
+		snapDb = s.Databases[args[1].(string)]
+		s.RUnlock()
+	case "MERGE":
+		snapDb = c.ActiveDb
+	}
+	if snapDb != nil {
+		s.logSnapshot(l, snapDb)
+		return
+	}
+	e := &ReplEntry{Db: c.ActiveDb.Name, Cmd: cmdName, Time: now}
+	for _, arg := range args {
+		e.Args = append(e.Args, arg.(string))
+	}
+	l.append(e)
+}
+
+func (s *Server) logSnapshot(l *replicationLog, d *Database) {
+	snap, err := s.createSnapshot(l, []*Database{d}, false)
+	if err != nil {
+		s.Log.Printf("Could not snapshot db %s for the replicas: %v\n", d.Name, err)
+		return
+	}
+	l.append(&ReplEntry{Db: d.Name, SnapshotId: snap.Id})
+}
+
+/*
+replicateDatabase sends a snapshot of d to the replicas. it is used for
+changes that do not go through a command.
+*/
+func (s *Server) replicateDatabase(d *Database) {
+	l := s.replicationLog()
+	if l == nil {
+		return
+	}
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+	s.logSnapshot(l, d)
+}
+
+/*
+fullSyncReply replies "<replication id> <offset>", the id of a new
+snapshot of every database and the names of the databases in it. writes
+wait while the snapshot is written.
+*/
+func (s *Server) fullSyncReply(l *replicationLog) *Reply {
+	l.writeLock.Lock()
+	s.RLock()
+	dbs := make([]*Database, 0, len(s.Databases))
+	for _, db := range s.Databases {
+		dbs = append(dbs, db)
+	}
+	s.RUnlock()
+	l.Lock()
+	header := fmt.Sprintf("%s %v", l.Id, l.offset)
+	l.Unlock()
+	snap, err := s.createSnapshot(l, dbs, true)
+	l.writeLock.Unlock()
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	rows := [][]byte{[]byte(header), []byte(snap.Id)}
+	for _, name := range snap.Dbs {
+		rows = append(rows, []byte(name))
+	}
+	return NewReply(rows, COMMAND_OK, 1, []int{REPLY_TYPE_STRING})
+}
+
+/*
+snapshotReadReply replies the size of a file of the n-th database of the
+snapshot id and up to REPL_CHUNK_SIZE bytes of it from pos.
+*/
+func (s *Server) snapshotReadReply(l *replicationLog, id string, n int, file string, pos int64) *Reply {
+	snap := l.snapshot(id)
+	if snap == nil {
+		return NewReply([][]byte{[]byte(REPL_RESYNC_PREFIX + " Unknown snapshot.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	if n < 0 || n >= len(snap.Dbs) || (file != REPL_FILE_TRIE && file != REPL_FILE_META) || pos < 0 {
+		return NewReply([][]byte{[]byte("Invalid snapshot file.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	var size int64
+	var chunk []byte
+	f, err := os.Open(snap.path(n, file))
+	if err == nil {
+		defer f.Close()
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			size = info.Size()
+			chunk = make([]byte, REPL_CHUNK_SIZE)
+			var read int
+			read, err = f.ReadAt(chunk, pos)
+			chunk = chunk[:read]
+			if err == io.EOF {
+				err = nil
+			}
+		}
+	} else if os.IsNotExist(err) && file == REPL_FILE_META {
+		// the database has no meta data
+		err = nil
+	}
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{[]byte(strconv.FormatInt(size, 10)), chunk}, COMMAND_OK, 1, []int{REPLY_TYPE_STRING})
+}
+
+/*
+removeSnapshotReply removes the full sync snapshot id.
+*/
+func (s *Server) removeSnapshotReply(l *replicationLog, id string) *Reply {
+	l.Lock()
+	if snap, exists := l.snapshots[id]; exists && snap.full {
+		l.removeSnapshot(id)
+	}
+	l.Unlock()
+	return NewReply([][]byte{}, COMMAND_OK, 0, []int{})
+}
+
+/*
+fetchReply replies "<replication id> <offset>" followed by the entries
+after offset. it waits up to REPL_FETCH_WAIT for new entries.
+*/
+func (s *Server) fetchReply(l *replicationLog, c *ClientConnection, id string, offset int64) *Reply {
+	if id != l.Id {
+		return NewReply([][]byte{[]byte(REPL_RESYNC_PREFIX + " Unknown replication id.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	l.seen(hex.EncodeToString(c.Id), offset)
+	var entries []*ReplEntry
+	var current int64
+	waited := false
+	for {
+		var ok bool
+		var changed chan bool
+		entries, current, ok, changed = l.since(offset, REPL_FETCH_MAX)
+		if !ok {
+			return NewReply([][]byte{[]byte(REPL_RESYNC_PREFIX + " Offset is not in the backlog.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+		}
+		if len(entries) > 0 || waited {
+			break
+		}
+		select {
+		case <-changed:
+		case <-time.After(REPL_FETCH_WAIT):
+			waited = true
+		}
+	}
+	rows := [][]byte{[]byte(fmt.Sprintf("%s %v", l.Id, current))}
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+		}
+		rows = append(rows, data)
+	}
+	return NewReply(rows, COMMAND_OK, 1, []int{REPLY_TYPE_STRING})
+}
+
+/*
+startReplica replicates primary ("host:port") from now on.
+*/
+func (s *Server) startReplica(primary string) {
+	link := &replicaLink{Primary: primary, stop: make(chan bool)}
+	s.replLock.Lock()
+	s.replica = link
+	s.replLock.Unlock()
+	s.Log.Printf("Replicating %s\n", primary)
+	go s.runReplica(link)
+}
+
+/*
+stopReplica stops replicating. the data stays as it is. an entry that is
+being applied is finished first.
+*/
+func (s *Server) stopReplica() {
+	s.replLock.Lock()
+	link := s.replica
+	s.replica = nil
+	s.replLock.Unlock()
+	if link == nil {
+		return
+	}
+	link.applyLock.Lock()
+	link.stopped = true
+	link.applyLock.Unlock()
+	close(link.stop)
+}
+
+/*
+ReplicaOf makes the server a replica of primary ("host:port"). running
+writes finish first, new ones are rejected. a replication log is kept
+until the first full sync so its replicas can catch up.
+*/
+func (s *Server) ReplicaOf(primary string) {
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	s.stopReplica()
+	s.startReplica(primary)
+}
+
+/*
+Promote stops replicating and makes the server a primary with a new
+replication log. it returns false if the server is a primary already.
+*/
+func (s *Server) Promote() bool {
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	if !s.isReplica() {
+		return false
+	}
+	s.stopReplica()
+	backlog := s.Config.ReplicationBacklog
+	if backlog <= 0 {
+		backlog = DEFAULT_PROMOTED_BACKLOG
+	}
+	s.replLock.Lock()
+	if s.replLog != nil {
+		s.replLog.close()
+	}
+	s.replLog = newReplicationLog(backlog, s.replSnapshotDir())
+	s.replLock.Unlock()
+	s.Log.Println("Promoted to primary")
+	return true
+}
+
+/*
+roleReply replies the role, the primary of a replica, the offset and the
+state of the link to the primary.
+*/
+func (s *Server) roleReply() *Reply {
+	s.replLock.RLock()
+	replica, replLog := s.replica, s.replLog
+	s.replLock.RUnlock()
+	row := []string{ROLE_PRIMARY, "", "0", ""}
+	if replica != nil {
+		replica.Lock()
+		link := "down"
+		if replica.Up {
+			link = "up"
+		}
+		row = []string{ROLE_REPLICA, replica.Primary, strconv.FormatInt(replica.Offset, 10), link}
+		replica.Unlock()
+	} else if replLog != nil {
+		replLog.Lock()
+		row[2] = strconv.FormatInt(replLog.offset, 10)
+		replLog.Unlock()
+	}
+	var rows [][]byte
+	for _, field := range row {
+		rows = append(rows, []byte(field))
+	}
+	return NewReply(rows, COMMAND_OK, 4, []int{REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_STRING, REPLY_TYPE_STRING})
+}
+
+/*
+sleepOrStop waits for d. it returns false if the link got stopped.
+*/
+func (link *replicaLink) sleepOrStop(d time.Duration) bool {
+	select {
+	case <-link.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (s *Server) runReplica(link *replicaLink) {
+	for !s.Ready() {
+		if !link.sleepOrStop(100 * time.Millisecond) {
+			return
+		}
+	}
+	var sock *zmq.Socket
+	defer func() {
+		if sock != nil {
+			sock.Close()
+		}
+	}()
+	for {
+		select {
+		case <-link.stop:
+			s.Log.Printf("Stopped replicating %s\n", link.Primary)
+			return
+		default:
+		}
+		var err error
+		if sock == nil {
+			sock, err = s.connectPrimary(link.Primary)
+		}
+		if err == nil {
+			link.Lock()
+			synced := link.Synced
+			link.Unlock()
+			if synced {
+				err = s.fetchFromPrimary(sock, link)
+			} else {
+				err = s.syncFromPrimary(sock, link)
+			}
+		}
+		if err == errStopped {
+			continue
+		}
+		if err == errResync {
+			s.Log.Printf("Full sync with %s needed\n", link.Primary)
+			link.Lock()
+			link.Synced = false
+			link.Unlock()
+			continue
+		}
+		if err != nil {
+			s.Log.Printf("Replication from %s failed: %v\n", link.Primary, err)
+			link.down(err)
+			if sock != nil {
+				// a REQ socket without a reply can not be used again
+				sock.Close()
+				sock = nil
+			}
+			if !link.sleepOrStop(REPL_RETRY_INTERVAL) {
+				return
+			}
+		}
+	}
+}
+
+/*
+connectPrimary opens a socket to the primary and authenticates if
+ReplicaUser is set.
+*/
+func (s *Server) connectPrimary(primary string) (sock *zmq.Socket, err error) {
+	sock, err = s.Context.NewSocket(zmq.REQ)
+	if err != nil {
+		return
+	}
+	sock.SetSockOptInt(zmq.LINGER, 0)
+	sock.SetSockOptInt(zmq.SNDTIMEO, int(REPL_TIMEOUT/time.Millisecond))
+	sock.SetSockOptInt(zmq.RCVTIMEO, int(REPL_TIMEOUT/time.Millisecond))
+	if s.Config.ReplicaServerKey != "" {
+		var public, secret string
+		public, secret, err = GenerateCurveKeyPair()
+		if err == nil {
+			err = SetCurveClientKeys(sock, s.Config.ReplicaServerKey, public, secret)
+		}
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	if err = sock.Connect("tcp://" + primary); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	if s.Config.ReplicaUser != "" {
+		var reply *Reply
+		reply, err = primaryRequest(sock, fmt.Sprintf("AUTH %s %s", s.Config.ReplicaUser, s.Config.ReplicaSecret))
+		if err == nil && reply.ReturnCode != COMMAND_OK {
+			err = errors.New(fmt.Sprintf("AUTH failed: %s", reply.Payload[0]))
+		}
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+func primaryRequest(sock *zmq.Socket, msg string) (reply *Reply, err error) {
+	if err = sock.Send([]byte(msg+"\n"), 0); err != nil {
+		return
+	}
+	r, err := sock.Recv(0)
+	if err != nil {
+		return
+	}
+	return Unserialize(r), nil
+}
+
+/*
+parseReplHeader parses the "<replication id> <offset>" row.
+*/
+func parseReplHeader(row []byte) (id string, offset int64, err error) {
+	parts := strings.Split(string(row), " ")
+	if len(parts) != 2 {
+		return "", 0, errors.New("Invalid replication header")
+	}
+	offset, err = strconv.ParseInt(parts[1], 10, 64)
+	return parts[0], offset, err
+}
+
+func replyError(reply *Reply) error {
+	msg := "unknown error"
+	if len(reply.Payload) > 0 {
+		msg = string(reply.Payload[0])
+	}
+	if strings.HasPrefix(msg, REPL_RESYNC_PREFIX) {
+		return errResync
+	}
+	return errors.New(msg)
+}
+
+/*
+fetchSnapshotFile downloads a REPL_FILE_* file of the n-th database of
+the snapshot id to a temporary file.
+*/
+func (s *Server) fetchSnapshotFile(sock *zmq.Socket, id string, n int, file string) (fname string, err error) {
+	if err = os.MkdirAll(s.replSnapshotDir(), 0700); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(s.replSnapshotDir(), "download_")
+	if err != nil {
+		return
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	var pos int64
+	for {
+		var reply *Reply
+		reply, err = primaryRequest(sock, fmt.Sprintf("%s READ %s %v %s %v", (&CommandReplSync{}).Name(), id, n, file, pos))
+		if err != nil {
+			return
+		}
+		if reply.ReturnCode != COMMAND_OK || len(reply.Payload) != 2 {
+			return "", replyError(reply)
+		}
+		var size int64
+		if size, err = strconv.ParseInt(string(reply.Payload[0]), 10, 64); err != nil {
+			return
+		}
+		if _, err = f.Write(reply.Payload[1]); err != nil {
+			return
+		}
+		pos += int64(len(reply.Payload[1]))
+		if pos >= size {
+			break
+		}
+		if len(reply.Payload[1]) == 0 {
+			return "", errors.New(fmt.Sprintf("Snapshot file %s of db %v ended early", file, n))
+		}
+	}
+	return f.Name(), nil
+}
+
+/*
+fetchSnapshotDb downloads the n-th database of the snapshot id and
+restores it as name.
+*/
+func (s *Server) fetchSnapshotDb(sock *zmq.Socket, id string, n int, name string) (err error) {
+	trieFile, err := s.fetchSnapshotFile(sock, id, n, REPL_FILE_TRIE)
+	if err != nil {
+		return
+	}
+	defer os.Remove(trieFile)
+	metaFile, err := s.fetchSnapshotFile(sock, id, n, REPL_FILE_META)
+	if err != nil {
+		return
+	}
+	defer os.Remove(metaFile)
+	return s.restoreSnapshotFiles(name, trieFile, metaFile)
+}
+
+/*
+dropDatabase removes the database name and its files. clients that
+selected it are moved to the default database. the caller has to hold
+the server lock.
+*/
+func (s *Server) dropDatabase(name string) {
+	db := s.Databases[name]
+	delete(s.Databases, name)
+	db.Lock()
+	// keeps requests that still use it from persisting it again
+	db.LastPersistOpsCount = db.OpsCount
+	db.Unlock()
+	for _, fname := range []string{s.dbFilePath(name), s.dbFilePath(name) + META_FILE_SUFFIX} {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			s.Log.Printf("Could not remove %s: %v\n", fname, err)
+		}
+	}
+	for _, c := range s.ActiveClients {
+		if c.ActiveDb == db {
+			c.ActiveDb = s.Databases[DEFAULT_DB]
+		}
+	}
+}
+
+/*
+syncFromPrimary replaces all databases with the snapshots of the primary.
+databases the primary does not have are dropped.
+*/
+func (s *Server) syncFromPrimary(sock *zmq.Socket, link *replicaLink) (err error) {
+	s.Log.Printf("Full sync from %s...\n", link.Primary)
+	start := time.Now()
+	sock.SetSockOptInt(zmq.RCVTIMEO, int(REPL_SYNC_TIMEOUT/time.Millisecond))
+	reply, err := primaryRequest(sock, (&CommandReplSync{}).Name())
+	sock.SetSockOptInt(zmq.RCVTIMEO, int(REPL_TIMEOUT/time.Millisecond))
+	if err != nil {
+		return
+	}
+	if reply.ReturnCode != COMMAND_OK || len(reply.Payload) < 2 {
+		return replyError(reply)
+	}
+	id, offset, err := parseReplHeader(reply.Payload[0])
+	if err != nil {
+		return
+	}
+	snapId := string(reply.Payload[1])
+	link.applyLock.Lock()
+	defer link.applyLock.Unlock()
+	if link.stopped {
+		return errStopped
+	}
+	synced := make(map[string]bool)
+	for n, name := range reply.Payload[2:] {
+		if err = s.fetchSnapshotDb(sock, snapId, n, string(name)); err != nil {
+			return errors.New(fmt.Sprintf("Could not restore the snapshot of db %s: %v", name, err))
+		}
+		synced[string(name)] = true
+	}
+	if _, err = primaryRequest(sock, fmt.Sprintf("%s DONE %s", (&CommandReplSync{}).Name(), snapId)); err != nil {
+		return
+	}
+	s.Lock()
+	for name, db := range s.Databases {
+		if synced[name] {
+			continue
+		}
+		if name == DEFAULT_DB {
+			db.Lock()
+			db.Clear()
+			db.OpsCount += 1
+			db.Unlock()
+			continue
+		}
+		s.Log.Printf("Dropping db %s, the primary does not have it\n", name)
+		s.dropDatabase(name)
+	}
+	s.Unlock()
+	// the log of a former primary is not needed anymore
+	s.replLock.Lock()
+	if s.replLog != nil {
+		s.replLog.close()
+	}
+	s.replLog = nil
+	s.replLock.Unlock()
+	link.Lock()
+	link.Id, link.Offset, link.PrimaryOffset = id, offset, offset
+	link.Synced, link.Up, link.LastError = true, true, ""
+	link.LastContact = time.Now()
+	link.Unlock()
+	s.Log.Printf("Full sync of %v databases from %s at offset %v took %v\n", len(synced), link.Primary, offset, time.Since(start))
+	return
+}
+
+/*
+fetchFromPrimary applies the log entries after the offset of the link.
+*/
+func (s *Server) fetchFromPrimary(sock *zmq.Socket, link *replicaLink) (err error) {
+	link.Lock()
+	msg := fmt.Sprintf("%s %s %v", (&CommandReplFetch{}).Name(), link.Id, link.Offset)
+	link.Unlock()
+	reply, err := primaryRequest(sock, msg)
+	if err != nil {
+		return
+	}
+	if reply.ReturnCode != COMMAND_OK || len(reply.Payload) == 0 {
+		return replyError(reply)
+	}
+	_, primaryOffset, err := parseReplHeader(reply.Payload[0])
+	if err != nil {
+		return
+	}
+	link.Lock()
+	link.PrimaryOffset, link.Up, link.LastError = primaryOffset, true, ""
+	link.LastContact = time.Now()
+	link.Unlock()
+	for _, data := range reply.Payload[1:] {
+		e := &ReplEntry{}
+		if err = json.Unmarshal(data, e); err != nil {
+			return
+		}
+		if err = s.applyLinkEntry(sock, link, e); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Server) applyLinkEntry(sock *zmq.Socket, link *replicaLink, e *ReplEntry) (err error) {
+	link.applyLock.Lock()
+	defer link.applyLock.Unlock()
+	if link.stopped {
+		return errStopped
+	}
+	if err = s.applyReplEntry(sock, e); err != nil {
+		s.Log.Printf("Could not apply replication entry %v: %v\n", e.Offset, err)
+		return errResync
+	}
+	link.Lock()
+	link.Offset, link.LastApplied = e.Offset, e.Time
+	link.Unlock()
+	return
+}
+
+/*
+applyReplEntry runs a logged command against its database with the time
+it ran at on the primary or fetches and restores a snapshot.
+*/
+func (s *Server) applyReplEntry(sock *zmq.Socket, e *ReplEntry) (err error) {
+	if e.SnapshotId != "" {
+		return s.fetchSnapshotDb(sock, e.SnapshotId, 0, e.Db)
+	}
+	cmd, exists := s.Commands[e.Cmd]
+	if !exists {
+		return errors.New(fmt.Sprintf("Unknown command %s", e.Cmd))
+	}
+	s.RLock()
+	db, exists := s.Databases[e.Db]
+	s.RUnlock()
+	if !exists {
+		return errors.New(fmt.Sprintf("Databases %s does not exist.", e.Db))
+	}
+	if err = s.acquireDatabase(db); err != nil {
+		return
+	}
+	defer releaseDatabase(db)
+	c := &ClientConnection{Id: []byte("replication"), ActiveDb: db}
+	args := make([]interface{}, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg
+	}
+	atomic.StoreInt64(&s.writeClock, e.Time)
+	reply := cmd.Function(s, c, args...)
+	atomic.StoreInt64(&s.writeClock, 0)
+	if reply.ReturnCode != COMMAND_OK && len(reply.Payload) > 0 {
+		s.Log.Printf("Replicated %s failed: %s\n", e.Cmd, reply.Payload[0])
+	}
+	if COMMAND_FLAG_WRITE&cmd.Flags() == COMMAND_FLAG_WRITE {
+		c.ActiveDb.Lock()
+		c.ActiveDb.OpsCount += 1
+		c.ActiveDb.Unlock()
+	}
+	return
+}
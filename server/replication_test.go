@@ -0,0 +1,126 @@
+package tris
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func offsets(entries []*ReplEntry) (o []int64) {
+	for _, e := range entries {
+		o = append(o, e.Offset)
+	}
+	return
+}
+
+func TestReplicationLogSince(t *testing.T) {
+	l := newReplicationLog(3, t.TempDir())
+	if _, current, ok, _ := l.since(0, 10); !ok || current != 0 {
+		t.Fatalf("empty log: ok %v, current %v", ok, current)
+	}
+	for i := 0; i < 5; i++ {
+		l.append(&ReplEntry{Cmd: "ADD"})
+	}
+	// the backlog holds 3, 4 and 5
+	tests := []struct {
+		offset int64
+		max    int
+		ok     bool
+		want   []int64
+	}{
+		{0, 10, false, nil},
+		{1, 10, false, nil},
+		{2, 10, true, []int64{3, 4, 5}},
+		{3, 10, true, []int64{4, 5}},
+		{2, 2, true, []int64{3, 4}},
+		{4, 1, true, []int64{5}},
+		{5, 10, true, nil},
+		{6, 10, false, nil},
+	}
+	for _, tt := range tests {
+		entries, current, ok, _ := l.since(tt.offset, tt.max)
+		if ok != tt.ok || current != 5 {
+			t.Errorf("since(%v, %v): ok %v, current %v", tt.offset, tt.max, ok, current)
+			continue
+		}
+		got := offsets(entries)
+		if len(got) != len(tt.want) {
+			t.Errorf("since(%v, %v) = %v, want %v", tt.offset, tt.max, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("since(%v, %v) = %v, want %v", tt.offset, tt.max, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestReplicationLogSnapshots(t *testing.T) {
+	l := newReplicationLog(2, t.TempDir())
+	snap := &replSnapshot{Id: "snap", dir: filepath.Join(l.dir, "snap"), Dbs: []string{"db"}}
+	if err := os.MkdirAll(snap.dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	l.addSnapshot(snap)
+	l.append(&ReplEntry{Db: "db", SnapshotId: snap.Id})
+	if l.snapshot(snap.Id) == nil {
+		t.Fatal("the snapshot is gone")
+	}
+	l.append(&ReplEntry{Cmd: "ADD"})
+	l.append(&ReplEntry{Cmd: "ADD"})
+	// the entry left the backlog
+	if l.snapshot(snap.Id) != nil {
+		t.Error("the snapshot is still registered")
+	}
+	if _, err := os.Stat(snap.dir); !os.IsNotExist(err) {
+		t.Errorf("the snapshot files are still there: %v", err)
+	}
+}
+
+func TestSnapshotReadReply(t *testing.T) {
+	s := &Server{}
+	l := newReplicationLog(10, t.TempDir())
+	snap := &replSnapshot{Id: "snap", dir: filepath.Join(l.dir, "snap"), Dbs: []string{"db"}, full: true}
+	if err := os.MkdirAll(snap.dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(snap.path(0, REPL_FILE_TRIE), []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l.addSnapshot(snap)
+	tests := []struct {
+		id    string
+		n     int
+		file  string
+		pos   int64
+		ok    bool
+		size  string
+		chunk string
+	}{
+		{"snap", 0, REPL_FILE_TRIE, 0, true, "10", "0123456789"},
+		{"snap", 0, REPL_FILE_TRIE, 4, true, "10", "456789"},
+		{"snap", 0, REPL_FILE_TRIE, 10, true, "10", ""},
+		// no meta data
+		{"snap", 0, REPL_FILE_META, 0, true, "0", ""},
+		{"snap", 1, REPL_FILE_TRIE, 0, false, "", ""},
+		{"snap", 0, "OTHER", 0, false, "", ""},
+		{"gone", 0, REPL_FILE_TRIE, 0, false, "", ""},
+	}
+	for _, tt := range tests {
+		r := s.snapshotReadReply(l, tt.id, tt.n, tt.file, tt.pos)
+		if (r.ReturnCode == COMMAND_OK) != tt.ok {
+			t.Errorf("read %s %v %s %v: return code %v", tt.id, tt.n, tt.file, tt.pos, r.ReturnCode)
+			continue
+		}
+		if tt.ok && (string(r.Payload[0]) != tt.size || string(r.Payload[1]) != tt.chunk) {
+			t.Errorf("read %s %v %s %v = %q %q", tt.id, tt.n, tt.file, tt.pos, r.Payload[0], r.Payload[1])
+		}
+	}
+	s.removeSnapshotReply(l, "snap")
+	if _, err := os.Stat(snap.dir); !os.IsNotExist(err) {
+		t.Error("DONE did not remove the snapshot")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/fvbock/tris/util"
 	"io"
 	// "time"
+	"strconv"
 	"strings"
 )
 
@@ -14,7 +15,15 @@ const (
 	REPLY_TYPE_BOOL   = 0
 	REPLY_TYPE_INT    = 1
 	REPLY_TYPE_STRING = 2
-	// REPLY_TYPE_FLOAT  = 3
+	REPLY_TYPE_FLOAT  = 3
+	REPLY_TYPE_BYTES  = 4
+)
+
+const (
+	// INT and BOOL fields are varints in 4 bytes which limits them to
+	// 28 bits
+	MAX_INT_REPLY = 1<<27 - 1
+	MIN_INT_REPLY = -1 << 27
 )
 
 type Reply struct {
@@ -67,6 +76,14 @@ func (r *Reply) Print() {
 				// 	fmt.Println("ERROR: decoding failed:", err)
 				// }
 				row = fmt.Sprintf("%s", pItem)
+			case REPLY_TYPE_FLOAT:
+				data, err := decodeFloatReply(pItem)
+				if err != nil {
+					fmt.Println("ERROR: decoding failed:", err)
+				}
+				row = fmt.Sprintf("%v", data)
+			case REPLY_TYPE_BYTES:
+				row = fmt.Sprintf("%q", pItem)
 			default:
 				fmt.Println("ERROR: got unknown response type:", rType)
 			}
@@ -142,7 +159,7 @@ func (r *Reply) Serialize() (ser []byte) {
 			ser = append(ser, bData...)
 		case REPLY_TYPE_INT:
 			ser = append(ser, payload...)
-		case REPLY_TYPE_STRING:
+		case REPLY_TYPE_STRING, REPLY_TYPE_FLOAT, REPLY_TYPE_BYTES:
 			ser = append(ser, encodeStringReply(payload)...)
 		default:
 			fmt.Println("ERROR: got unknown response type:", rtype)
@@ -176,7 +193,16 @@ func decodeBoolReply(reply *bytes.Reader) (r bool, err error) {
 	return
 }
 
+/*
+encodeIntReply encodes r as a 4 byte varint. values outside of
+MIN_INT_REPLY and MAX_INT_REPLY are clamped.
+*/
 func encodeIntReply(r int64) (ir []byte) {
+	if r > MAX_INT_REPLY {
+		r = MAX_INT_REPLY
+	} else if r < MIN_INT_REPLY {
+		r = MIN_INT_REPLY
+	}
 	ir = make([]byte, 4)
 	_ = binary.PutVarint(ir, r)
 	return
@@ -195,6 +221,21 @@ func decodeIntReply(reply *bytes.Reader) (r int64, err error) {
 	return
 }
 
+/*
+EncodeIntPayload encodes n as an INT or BOOL field of a reply payload.
+*/
+func EncodeIntPayload(n int64) []byte {
+	return encodeIntReply(n)
+}
+
+/*
+DecodeIntPayload decodes an INT or BOOL field of a reply payload.
+*/
+func DecodeIntPayload(p []byte) int64 {
+	n, _ := decodeIntReply(bytes.NewReader(p))
+	return n
+}
+
 func encodeStringReply(r []byte) (sr []byte) {
 	// byte length of the item
 	pl := make([]byte, 4)
@@ -226,10 +267,17 @@ func decodeStringReply(reply *bytes.Reader) (r []byte, err error) {
 	return
 }
 
-// func encodeFloatReply(r int64) {
-// }
-// func decodeFloatReply(r int64) {
-// }
+/*
+floats are sent as their string representation so they can use the
+length prefixed encoding of strings
+*/
+func encodeFloatReply(r float64) (fr []byte) {
+	return []byte(strconv.FormatFloat(r, 'g', -1, 64))
+}
+
+func decodeFloatReply(reply []byte) (r float64, err error) {
+	return strconv.ParseFloat(string(reply), 64)
+}
 
 func Unserialize(r []byte) *Reply {
 	// var unserStart = time.Now()
@@ -275,7 +323,7 @@ readLoop:
 			break
 		}
 		for _, rType := range reply.Signature {
-			if rType != REPLY_TYPE_STRING {
+			if rType != REPLY_TYPE_STRING && rType != REPLY_TYPE_FLOAT && rType != REPLY_TYPE_BYTES {
 				payload := make([]byte, 4)
 				_, err := buf.Read(payload)
 				if err != nil {
@@ -294,6 +342,10 @@ readLoop:
 					fmt.Println(err)
 				}
 				buf.Seek(int64(4-bl), 1)
+				if pLength < 0 || pLength > int64(buf.Len()) {
+					fmt.Println("frakk. invalid field length", pLength)
+					break readLoop
+				}
 				if pLength > 0 {
 					payload := make([]byte, pLength)
 					bRead, err := buf.Read(payload)
@@ -302,6 +354,9 @@ readLoop:
 						break readLoop
 					}
 					reply.Payload = append(reply.Payload, payload)
+				} else {
+					// empty fields are kept so the rows stay aligned with the signature
+					reply.Payload = append(reply.Payload, []byte{})
 				}
 			}
 		}
@@ -0,0 +1,310 @@
+package tris
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+File names given to IMPORT, MERGE, EXPORT and BULKLOAD are resolved
+relative to ServerConfig.ImportDir. absolute paths, .. elements and
+symlinks below ImportDir are rejected. without an ImportDir these
+commands only work with uploads.
+
+clients without access to the servers file system can send a file with
+
+	UPLOAD name <base64 chunk>
+
+repeatedly and then refer to it as upload:name on the same connection.
+every connection has its own uploads below UploadDir. they are removed
+once IMPORT, MERGE or BULKLOAD consumed them, when the connection sends
+EXIT and when they were not written to for UploadIdleTime. the upload
+directories of an earlier run are removed on startup. UPLOAD replies the
+size as an INT, so an upload can not grow past MAX_UPLOAD_SIZE. a
+connection can keep MaxConnectionUploads uploads of together
+MaxConnectionUploadBytes.
+*/
+const (
+	UPLOAD_PREFIX      = "upload:"
+	DEFAULT_UPLOAD_DIR = "uploads"
+	MAX_UPLOAD_SIZE    = MAX_INT_REPLY
+
+	DEFAULT_MAX_CONNECTION_UPLOAD_BYTES = MAX_UPLOAD_SIZE
+	DEFAULT_MAX_CONNECTION_UPLOADS      = 8
+	DEFAULT_UPLOAD_IDLE_TIME            = time.Hour
+	// how often uploads are checked for UploadIdleTime
+	UPLOAD_CHECK_INTERVAL = time.Minute
+)
+
+/*
+uploadDir returns UploadDir or DataDir/DEFAULT_UPLOAD_DIR.
+*/
+func (s *Server) uploadDir() string {
+	if s.Config.UploadDir != "" {
+		return s.Config.UploadDir
+	}
+	return filepath.Join(s.Config.DataDir, DEFAULT_UPLOAD_DIR)
+}
+
+/*
+maxUploadSize returns MaxUploadSize or MAX_UPLOAD_SIZE.
+*/
+func (s *Server) maxUploadSize() int64 {
+	if s.Config.MaxUploadSize <= 0 || s.Config.MaxUploadSize > MAX_UPLOAD_SIZE {
+		return MAX_UPLOAD_SIZE
+	}
+	return s.Config.MaxUploadSize
+}
+
+func (s *Server) maxConnectionUploadBytes() int64 {
+	if s.Config.MaxConnectionUploadBytes <= 0 {
+		return DEFAULT_MAX_CONNECTION_UPLOAD_BYTES
+	}
+	return s.Config.MaxConnectionUploadBytes
+}
+
+func (s *Server) maxConnectionUploads() int {
+	if s.Config.MaxConnectionUploads <= 0 {
+		return DEFAULT_MAX_CONNECTION_UPLOADS
+	}
+	return s.Config.MaxConnectionUploads
+}
+
+func (s *Server) uploadIdleTime() time.Duration {
+	if s.Config.UploadIdleTime <= 0 {
+		return DEFAULT_UPLOAD_IDLE_TIME
+	}
+	return s.Config.UploadIdleTime
+}
+
+/*
+connectionUploadDir returns the directory of the uploads of c.
+*/
+func (s *Server) connectionUploadDir(c *ClientConnection) string {
+	return filepath.Join(s.uploadDir(), hex.EncodeToString(c.Id))
+}
+
+/*
+checkRelativePath rejects empty and absolute names and names with ..
+elements.
+*/
+func checkRelativePath(name string) error {
+	if name == "" || filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return errors.New(fmt.Sprintf("Invalid path %s: paths have to be relative.", name))
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == filepath.Separator }) {
+		if part == ".." {
+			return errors.New(fmt.Sprintf("Invalid path %s: .. is not allowed.", name))
+		}
+	}
+	return nil
+}
+
+/*
+resolveSandboxed joins name to dir and makes sure no existing part of the
+path below dir is a symlink. the last element does not have to exist.
+*/
+func resolveSandboxed(dir string, name string) (fpath string, err error) {
+	if err = checkRelativePath(name); err != nil {
+		return
+	}
+	fpath = dir
+	for _, part := range strings.Split(filepath.Clean(name), string(filepath.Separator)) {
+		if part == "" || part == "." {
+			continue
+		}
+		fpath = filepath.Join(fpath, part)
+		info, lerr := os.Lstat(fpath)
+		if os.IsNotExist(lerr) {
+			continue
+		}
+		if lerr != nil {
+			return "", lerr
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New(fmt.Sprintf("Invalid path %s: symlinks are not allowed.", name))
+		}
+	}
+	return
+}
+
+/*
+resolveFilePath resolves a file name of IMPORT, MERGE, EXPORT or
+BULKLOAD for c. upload tells whether it refers to an upload.
+*/
+func (s *Server) resolveFilePath(c *ClientConnection, name string) (fpath string, upload bool, err error) {
+	if strings.HasPrefix(name, UPLOAD_PREFIX) {
+		fpath, err = s.uploadPath(c, strings.TrimPrefix(name, UPLOAD_PREFIX))
+		return fpath, true, err
+	}
+	if s.Config.ImportDir == "" {
+		return "", false, errors.New("No ImportDir is configured. Use UPLOAD.")
+	}
+	fpath, err = resolveSandboxed(s.Config.ImportDir, name)
+	return
+}
+
+/*
+uploadPath returns the path of the upload name of c. upload names can
+not contain path separators.
+*/
+func (s *Server) uploadPath(c *ClientConnection, name string) (fpath string, err error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return "", errors.New(fmt.Sprintf("Invalid upload name %s", name))
+	}
+	return filepath.Join(s.connectionUploadDir(c), name), nil
+}
+
+/*
+appendUpload decodes chunk and appends it to the upload name of c. it
+returns the size of the upload.
+*/
+func (s *Server) appendUpload(c *ClientConnection, name string, chunk string) (size int64, err error) {
+	fpath, err := s.uploadPath(c, name)
+	if err != nil {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(chunk)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid base64 chunk: %v", err))
+	}
+	err = os.MkdirAll(s.connectionUploadDir(c), 0700)
+	if err != nil {
+		return
+	}
+	if err = s.checkConnectionUploads(c, name, int64(len(data))); err != nil {
+		return
+	}
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if info.Size()+int64(len(data)) > s.maxUploadSize() {
+		return 0, errors.New(fmt.Sprintf("Upload %s would be larger than %v bytes.", name, s.maxUploadSize()))
+	}
+	if _, err = f.Write(data); err != nil {
+		return
+	}
+	return info.Size() + int64(len(data)), nil
+}
+
+/*
+checkConnectionUploads tells whether c may add n bytes to its upload
+name.
+*/
+func (s *Server) checkConnectionUploads(c *ClientConnection, name string, n int64) error {
+	infos, err := ioutil.ReadDir(s.connectionUploadDir(c))
+	if err != nil {
+		return err
+	}
+	var total int64
+	exists := false
+	for _, info := range infos {
+		total += info.Size()
+		exists = exists || info.Name() == name
+	}
+	if !exists && len(infos) >= s.maxConnectionUploads() {
+		return errors.New(fmt.Sprintf("A connection can keep at most %v uploads.", s.maxConnectionUploads()))
+	}
+	if total+n > s.maxConnectionUploadBytes() {
+		return errors.New(fmt.Sprintf("The uploads of a connection can not be larger than %v bytes.", s.maxConnectionUploadBytes()))
+	}
+	return nil
+}
+
+/*
+removeUpload deletes a consumed upload and the directory of the
+connection once it is empty.
+*/
+func (s *Server) removeUpload(fpath string) {
+	if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+		s.Log.Printf("Could not remove upload %s: %v\n", fpath, err)
+	}
+	// fails while the connection has other uploads
+	os.Remove(filepath.Dir(fpath))
+}
+
+/*
+removeConnectionUploads deletes all uploads of c.
+*/
+func (s *Server) removeConnectionUploads(c *ClientConnection) {
+	if err := os.RemoveAll(s.connectionUploadDir(c)); err != nil {
+		s.Log.Printf("Could not remove the uploads of %x: %v\n", c.Id, err)
+	}
+}
+
+/*
+uploadDirs returns the connection directories in the upload dir.
+*/
+func (s *Server) uploadDirs() (dirs []os.FileInfo, err error) {
+	infos, err := ioutil.ReadDir(s.uploadDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	for _, info := range infos {
+		if _, herr := hex.DecodeString(info.Name()); herr == nil && info.IsDir() {
+			dirs = append(dirs, info)
+		}
+	}
+	return
+}
+
+/*
+clearUploads deletes the uploads of an earlier run. only connection
+directories are removed, other files in UploadDir are left alone.
+*/
+func (s *Server) clearUploads() error {
+	dirs, err := s.uploadDirs()
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err = os.RemoveAll(filepath.Join(s.uploadDir(), dir.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+removeIdleUploads deletes the uploads of connections that did not write
+to any of them for UploadIdleTime.
+*/
+func (s *Server) removeIdleUploads() {
+	dirs, err := s.uploadDirs()
+	if err != nil {
+		s.Log.Printf("Could not list the uploads: %v\n", err)
+		return
+	}
+	idleSince := time.Now().Add(-s.uploadIdleTime())
+	for _, dir := range dirs {
+		dpath := filepath.Join(s.uploadDir(), dir.Name())
+		lastWrite := dir.ModTime()
+		infos, _ := ioutil.ReadDir(dpath)
+		for _, info := range infos {
+			if info.ModTime().After(lastWrite) {
+				lastWrite = info.ModTime()
+			}
+		}
+		if lastWrite.Before(idleSince) {
+			s.Log.Printf("Removing idle uploads %s\n", dpath)
+			os.RemoveAll(dpath)
+		}
+	}
+}
+
+func pathFailReply(err error) *Reply {
+	return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+}
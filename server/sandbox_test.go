@@ -0,0 +1,139 @@
+package tris
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAppendUpload(t *testing.T) {
+	s := &Server{Config: &ServerConfig{DataDir: t.TempDir(), MaxUploadSize: 8}}
+	c1 := &ClientConnection{Id: []byte{1}}
+	c2 := &ClientConnection{Id: []byte{2}}
+	chunk := base64.StdEncoding.EncodeToString([]byte("abcde"))
+
+	if size, err := s.appendUpload(c1, "f", chunk); err != nil || size != 5 {
+		t.Fatalf("first chunk: %v, %v", size, err)
+	}
+	// connections have their own uploads
+	if size, err := s.appendUpload(c2, "f", chunk); err != nil || size != 5 {
+		t.Fatalf("other connection: %v, %v", size, err)
+	}
+	if _, err := s.appendUpload(c1, "f", chunk); err == nil {
+		t.Fatal("upload grew past MaxUploadSize")
+	}
+	fpath, _, err := s.resolveFilePath(c1, UPLOAD_PREFIX+"f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(fpath); string(data) != "abcde" {
+		t.Errorf("upload contains %q", data)
+	}
+	for _, name := range []string{"", "..", "a/b"} {
+		if _, err := s.appendUpload(c1, name, chunk); err == nil {
+			t.Errorf("upload name %q was accepted", name)
+		}
+	}
+}
+
+func TestConnectionUploadQuota(t *testing.T) {
+	s := &Server{Config: &ServerConfig{DataDir: t.TempDir(), MaxConnectionUploadBytes: 12, MaxConnectionUploads: 2}}
+	c := &ClientConnection{Id: []byte{1}}
+	chunk := base64.StdEncoding.EncodeToString([]byte("abcde"))
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"a", true},
+		{"b", true},
+		// a third upload
+		{"c", false},
+		// 15 bytes together
+		{"a", false},
+	}
+	for _, tt := range tests {
+		if _, err := s.appendUpload(c, tt.name, chunk); (err == nil) != tt.ok {
+			t.Errorf("upload %s: %v", tt.name, err)
+		}
+	}
+	small := base64.StdEncoding.EncodeToString([]byte("ab"))
+	if _, err := s.appendUpload(c, "a", small); err != nil {
+		t.Errorf("upload within the quota: %v", err)
+	}
+}
+
+func TestRemoveUploads(t *testing.T) {
+	s := &Server{
+		Config: &ServerConfig{DataDir: t.TempDir(), UploadIdleTime: time.Hour},
+		Log:    log.New(ioutil.Discard, "", 0),
+	}
+	c1 := &ClientConnection{Id: []byte{1}}
+	c2 := &ClientConnection{Id: []byte{2}}
+	c3 := &ClientConnection{Id: []byte{3}}
+	chunk := base64.StdEncoding.EncodeToString([]byte("abcde"))
+	for _, c := range []*ClientConnection{c1, c2, c3} {
+		if _, err := s.appendUpload(c, "f", chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(c *ClientConnection) bool {
+		_, err := os.Stat(s.connectionUploadDir(c))
+		return err == nil
+	}
+
+	// EXIT
+	s.removeConnectionUploads(c1)
+	if exists(c1) {
+		t.Error("the uploads of c1 were not removed")
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	fpath, _ := s.uploadPath(c2, "f")
+	for _, p := range []string{fpath, s.connectionUploadDir(c2)} {
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.removeIdleUploads()
+	if exists(c2) || !exists(c3) {
+		t.Errorf("idle uploads: c2 %v, c3 %v", exists(c2), exists(c3))
+	}
+
+	other := filepath.Join(s.uploadDir(), "keep")
+	if err := ioutil.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.clearUploads(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(c3) {
+		t.Error("clearUploads left the uploads of c3")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("clearUploads removed another file: %v", err)
+	}
+}
+
+func TestExportFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "outside")
+	fname := filepath.Join(dir, "export.csv")
+	if err := os.Symlink(outside, fname+".tmp"); err != nil {
+		t.Skip(err)
+	}
+	d := newDetachedDatabase("export")
+	d.Add("key")
+	if _, err := d.ExportFile(fname, EXPORT_FORMAT_CSV); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(outside); !os.IsNotExist(err) {
+		t.Error("the export followed the symlink")
+	}
+	if _, err := os.Stat(fname); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,322 @@
+package tris
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/fvbock/tris/util"
+	"golang.org/x/crypto/curve25519"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+Connections can be encrypted in two ways:
+
+	CURVE  with ServerConfig.CurveSecretKey the zmq socket uses CurveZMQ.
+	       clients need the public key of the server (DSN.ServerKey).
+	       keys are z85 encoded as printed by main/keygen. this needs
+	       libzmq 4 and a build with the zmq_4_x tag, without it setting
+	       up CURVE fails
+	TLS    with ServerConfig.TLSPort the server accepts TLS connections
+	       and forwards them to the zmq socket over the ipc endpoint
+	       DataDir/TLS_IPC_DIR/TLS_IPC_SOCKET. with TLSClientCAFile
+	       clients have to present a certificate signed by one of those
+	       CAs. clients use the protocol "tls" in their DSN
+
+the ipc endpoint is bound before CURVE is enabled so TLS connections do
+not need a CURVE key as well. with TLSOnly the plain endpoint is not
+bound at all.
+
+the ipc endpoint is trusted: a connection to it skips CURVE and the TLS
+client certificate check. it lives in a directory only the user running
+the server can enter.
+*/
+const (
+	TLS_IPC_DIR    = "tls"
+	TLS_IPC_SOCKET = "tris-tls.sock"
+
+	CURVE_KEY_BYTES = 32
+	// length of a z85 encoded curve key
+	CURVE_KEY_LENGTH = 40
+
+	SELF_SIGNED_CERT_VALIDITY = 365 * 24 * time.Hour
+)
+
+const z85Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+/*
+Z85Encode encodes data as described in ZeroMQ RFC 32. len(data) has to
+be a multiple of 4.
+*/
+func Z85Encode(data []byte) (string, error) {
+	if len(data)%4 != 0 {
+		return "", errors.New("Z85 data length has to be a multiple of 4")
+	}
+	encoded := make([]byte, 0, len(data)*5/4)
+	for i := 0; i < len(data); i += 4 {
+		value := uint32(data[i])<<24 | uint32(data[i+1])<<16 | uint32(data[i+2])<<8 | uint32(data[i+3])
+		var chunk [5]byte
+		for j := 4; j >= 0; j-- {
+			chunk[j] = z85Alphabet[value%85]
+			value /= 85
+		}
+		encoded = append(encoded, chunk[:]...)
+	}
+	return string(encoded), nil
+}
+
+/*
+Z85Decode decodes a Z85Encode string.
+*/
+func Z85Decode(s string) ([]byte, error) {
+	if len(s)%5 != 0 {
+		return nil, errors.New("Z85 string length has to be a multiple of 5")
+	}
+	data := make([]byte, 0, len(s)*4/5)
+	for i := 0; i < len(s); i += 5 {
+		var value uint64
+		for j := 0; j < 5; j++ {
+			digit := strings.IndexByte(z85Alphabet, s[i+j])
+			if digit < 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid Z85 character %q", s[i+j]))
+			}
+			value = value*85 + uint64(digit)
+		}
+		if value > 0xffffffff {
+			return nil, errors.New("Invalid Z85 chunk")
+		}
+		data = append(data, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+	return data, nil
+}
+
+/*
+GenerateCurveKeyPair returns a new z85 encoded CURVE key pair.
+*/
+func GenerateCurveKeyPair() (public string, secret string, err error) {
+	key := make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+	publicKey, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	if public, err = Z85Encode(publicKey); err != nil {
+		return
+	}
+	secret, err = Z85Encode(key)
+	return
+}
+
+/*
+CheckCurveKey tells whether key is a z85 encoded CURVE key.
+*/
+func CheckCurveKey(key string) error {
+	if len(key) != CURVE_KEY_LENGTH {
+		return errors.New(fmt.Sprintf("A CURVE key has to be %v characters long", CURVE_KEY_LENGTH))
+	}
+	_, err := Z85Decode(key)
+	return err
+}
+
+/*
+LoadCertPool reads the PEM encoded certificates in fname.
+*/
+func LoadCertPool(fname string) (pool *x509.CertPool, err error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(fmt.Sprintf("No certificates found in %s", fname))
+	}
+	return
+}
+
+/*
+GenerateSelfSignedCert writes a self signed certificate for hosts and its
+key as PEM to certFile and keyFile.
+*/
+func GenerateSelfSignedCert(hosts []string, certFile string, keyFile string) (err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(SELF_SIGNED_CERT_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func (s *Server) tlsEnabled() bool {
+	return s.Config.TLSPort > 0
+}
+
+func (s *Server) tlsIpcPath() string {
+	return filepath.Join(s.Config.DataDir, TLS_IPC_DIR, TLS_IPC_SOCKET)
+}
+
+/*
+makeTLSIpcDir creates the directory of the ipc endpoint that only the
+server user can enter.
+*/
+func (s *Server) makeTLSIpcDir() error {
+	dir := filepath.Dir(s.tlsIpcPath())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// the directory may be left from a run with other permissions
+	return os.Chmod(dir, 0700)
+}
+
+/*
+checkSecurityConfig validates the CURVE and TLS settings.
+*/
+func (s *Server) checkSecurityConfig() error {
+	if s.Config.CurveSecretKey != "" {
+		if err := CheckCurveKey(s.Config.CurveSecretKey); err != nil {
+			return errors.New(fmt.Sprintf("Invalid CurveSecretKey: %v", err))
+		}
+	}
+	if s.Config.TLSOnly && !s.tlsEnabled() {
+		return errors.New("TLSOnly is set but no TLSPort")
+	}
+	if s.tlsEnabled() && (s.Config.TLSCertFile == "" || s.Config.TLSKeyFile == "") {
+		return errors.New("TLS needs TLSCertFile and TLSKeyFile")
+	}
+	return nil
+}
+
+/*
+bindSocket binds the zmq socket to the TLS ipc endpoint and the plain
+endpoint. CURVE is enabled in between.
+*/
+func (s *Server) bindSocket() (err error) {
+	if s.tlsEnabled() {
+		if err = s.makeTLSIpcDir(); err != nil {
+			return
+		}
+		os.Remove(s.tlsIpcPath())
+		s.Log.Printf("Binding to ipc://%s for TLS\n", s.tlsIpcPath())
+		if err = s.Socket.Bind("ipc://" + s.tlsIpcPath()); err != nil {
+			return
+		}
+	}
+	if s.Config.CurveSecretKey != "" {
+		if err = SetCurveServerKey(s.Socket, s.Config.CurveSecretKey); err != nil {
+			return
+		}
+		s.Log.Println("CURVE encryption enabled")
+	}
+	if s.Config.TLSOnly {
+		return
+	}
+	s.Log.Println(fmt.Sprintf("Binding to %s://%s:%v", s.Config.Protocol, s.Config.Host, s.Config.Port))
+	return s.Socket.Bind(fmt.Sprintf("%s://%s:%v", s.Config.Protocol, s.Config.Host, s.Config.Port))
+}
+
+/*
+startTLS listens for TLS connections on TLSPort and forwards each to the
+ipc endpoint of the zmq socket.
+*/
+func (s *Server) startTLS() (err error) {
+	cert, err := tls.LoadX509KeyPair(s.Config.TLSCertFile, s.Config.TLSKeyFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not load the TLS certificate: %v", err))
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if s.Config.TLSClientCAFile != "" {
+		config.ClientCAs, err = LoadCertPool(s.Config.TLSClientCAFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Could not load the TLS client CAs: %v", err))
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	addr := fmt.Sprintf("%s:%v", s.Config.Host, s.Config.TLSPort)
+	s.tlsListener, err = tls.Listen("tcp", addr, config)
+	if err != nil {
+		return
+	}
+	s.Log.Printf("Listening for TLS on %s\n", addr)
+	go func() {
+		for {
+			conn, err := s.tlsListener.Accept()
+			if err != nil {
+				// closed on shutdown
+				return
+			}
+			go s.forwardTLS(conn)
+		}
+	}()
+	return
+}
+
+func (s *Server) forwardTLS(conn net.Conn) {
+	if err := conn.(*tls.Conn).Handshake(); err != nil {
+		s.Log.Printf("TLS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	backend, err := net.Dial("unix", s.tlsIpcPath())
+	if err != nil {
+		s.Log.Printf("Could not forward TLS connection: %v\n", err)
+		conn.Close()
+		return
+	}
+	tris.Pipe(conn, backend)
+}
+
+func (s *Server) stopTLS() {
+	if s.tlsListener == nil {
+		return
+	}
+	s.tlsListener.Close()
+	os.Remove(s.tlsIpcPath())
+}
@@ -0,0 +1,84 @@
+package tris
+
+import (
+	"bytes"
+	"golang.org/x/crypto/curve25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZ85(t *testing.T) {
+	tests := []struct {
+		data    []byte
+		encoded string
+	}{
+		{[]byte{}, ""},
+		// the example of the Z85 spec
+		{[]byte{0x86, 0x4F, 0xD2, 0x6F, 0xB5, 0x59, 0xF7, 0x5B}, "HelloWorld"},
+		{[]byte{0, 0, 0, 0}, "00000"},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, "%nSc0"},
+	}
+	for _, tt := range tests {
+		encoded, err := Z85Encode(tt.data)
+		if err != nil || encoded != tt.encoded {
+			t.Errorf("Z85Encode(%x) = %q, %v, want %q", tt.data, encoded, err, tt.encoded)
+		}
+		data, err := Z85Decode(tt.encoded)
+		if err != nil || !bytes.Equal(data, tt.data) {
+			t.Errorf("Z85Decode(%q) = %x, %v, want %x", tt.encoded, data, err, tt.data)
+		}
+	}
+}
+
+func TestZ85Invalid(t *testing.T) {
+	if _, err := Z85Encode([]byte{1, 2, 3}); err == nil {
+		t.Error("Z85Encode accepted 3 bytes")
+	}
+	for _, s := range []string{"0000", "0000\"", "%nSc1"} {
+		if _, err := Z85Decode(s); err == nil {
+			t.Errorf("Z85Decode accepted %q", s)
+		}
+	}
+}
+
+func TestGenerateCurveKeyPair(t *testing.T) {
+	public, secret, err := GenerateCurveKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckCurveKey(public); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckCurveKey(secret); err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _ := Z85Decode(public)
+	secretKey, _ := Z85Decode(secret)
+	derived, err := curve25519.X25519(secretKey, curve25519.Basepoint)
+	if err != nil || !bytes.Equal(derived, publicKey) {
+		t.Errorf("public key %x does not belong to the secret key", publicKey)
+	}
+}
+
+func TestMakeTLSIpcDir(t *testing.T) {
+	s := &Server{Config: &ServerConfig{DataDir: t.TempDir()}}
+	dir := filepath.Join(s.Config.DataDir, TLS_IPC_DIR)
+	// left from a run with other permissions
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.makeTLSIpcDir(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("mode of the ipc directory is %v", info.Mode().Perm())
+	}
+	if filepath.Dir(s.tlsIpcPath()) != dir {
+		t.Errorf("the ipc socket %s is not in %s", s.tlsIpcPath(), dir)
+	}
+}
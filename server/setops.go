@@ -0,0 +1,212 @@
+package tris
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fvbock/trie"
+	"sort"
+	"strings"
+)
+
+const (
+	SETOP_UNION     = 1
+	SETOP_INTERSECT = 2
+	SETOP_DIFF      = 3
+
+	// how the counts of a key in several dbs are combined
+	COMBINE_SUM = "SUM"
+	COMBINE_MIN = "MIN"
+	COMBINE_MAX = "MAX"
+)
+
+/*
+parseSetOpArgs parses "src1 src2 [src ...] [COMBINE SUM|MIN|MAX]".
+*/
+func parseSetOpArgs(args []interface{}) (srcNames []string, combine string, err error) {
+	combine = COMBINE_SUM
+	for i := 0; i < len(args); i++ {
+		arg := args[i].(string)
+		if strings.ToUpper(arg) == "COMBINE" {
+			if i+1 >= len(args) {
+				err = errors.New("COMBINE needs SUM, MIN or MAX")
+				return
+			}
+			combine = strings.ToUpper(args[i+1].(string))
+			if combine != COMBINE_SUM && combine != COMBINE_MIN && combine != COMBINE_MAX {
+				err = errors.New(fmt.Sprintf("Unknown COMBINE rule %s", args[i+1]))
+				return
+			}
+			i++
+			continue
+		}
+		srcNames = append(srcNames, arg)
+	}
+	if len(srcNames) < 2 {
+		err = errors.New("At least two source databases are needed.")
+	}
+	return
+}
+
+func combineCounts(a int64, b int64, combine string) int64 {
+	switch combine {
+	case COMBINE_MIN:
+		if b < a {
+			return b
+		}
+	case COMBINE_MAX:
+		if b > a {
+			return b
+		}
+	default:
+		return a + b
+	}
+	return a
+}
+
+/*
+setOp runs a UNION, INTERSECT or DIFF over the members of dbs. keys are
+compared in their normalized form, the result holds the display form of
+the first db containing the key. DIFF keeps the counts of the first db.
+the result is sorted by key.
+*/
+func setOp(dbs []*Database, op int, combine string) (result []*trie.MemberInfo) {
+	type entry struct {
+		member *trie.MemberInfo
+		seen   int
+	}
+	entries := make(map[string]*entry)
+	var order []string
+	for n, db := range dbs {
+		db.RLock()
+		for _, m := range db.Members() {
+			e, exists := entries[m.Value]
+			switch {
+			case !exists && (n == 0 || op == SETOP_UNION):
+				entries[m.Value] = &entry{
+					member: &trie.MemberInfo{Value: db.DisplayKey(m.Value), Count: m.Count},
+					seen:   1,
+				}
+				order = append(order, m.Value)
+			case !exists:
+			case e.seen < n+1:
+				if op != SETOP_DIFF {
+					e.member.Count = combineCounts(e.member.Count, m.Count, combine)
+				}
+				e.seen = n + 1
+			}
+		}
+		db.RUnlock()
+		if op == SETOP_INTERSECT {
+			// keys missing in this db can not be in the intersection
+			for key, e := range entries {
+				if e.seen < n+1 {
+					delete(entries, key)
+				}
+			}
+		}
+	}
+	sort.Strings(order)
+	for _, key := range order {
+		e, exists := entries[key]
+		if !exists {
+			continue
+		}
+		if op == SETOP_DIFF && e.seen > 1 {
+			continue
+		}
+		result = append(result, e.member)
+	}
+	return
+}
+
+/*
+setOpReply runs the set operation for UNION, INTERSECT and DIFF and
+replies the resulting keys and counts.
+*/
+func setOpReply(s *Server, c *ClientConnection, op int, args []interface{}) *Reply {
+	srcNames, combine, err := parseSetOpArgs(args)
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	dbs, err := s.databasesByName(c, srcNames)
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	defer releaseDatabases(dbs)
+	var rows [][]byte
+	for _, m := range setOp(dbs, op, combine) {
+		rows = append(rows, []byte(m.Value), encodeIntReply(m.Count))
+	}
+	return NewReply(rows, COMMAND_OK, 2, []int{REPLY_TYPE_STRING, REPLY_TYPE_INT})
+}
+
+/*
+setOpStoreReply runs the set operation for UNIONSTORE, INTERSECTSTORE
+and DIFFSTORE. the result replaces the contents of the destination db,
+which gets created if it does not exist and c may run ADMIN commands. it
+replies the number of stored keys.
+*/
+func setOpStoreReply(s *Server, c *ClientConnection, op int, args []interface{}) *Reply {
+	if len(args) < 3 {
+		return NewReply([][]byte{[]byte("Expected a destination and at least two source databases.")}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	dstName := args[0].(string)
+	if err := CheckDbName(dstName); err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	if err := s.checkDbAccess(c, dstName); err != nil {
+		return permissionReply(err)
+	}
+	srcNames, combine, err := parseSetOpArgs(args[1:])
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	dbs, err := s.databasesByName(c, srcNames)
+	if err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	defer releaseDatabases(dbs)
+	result := setOp(dbs, op, combine)
+	for _, m := range result {
+		if m.Count > MAX_COUNT {
+			errMsg := fmt.Sprintf("The count of %s would exceed %d.", m.Value, MAX_COUNT)
+			return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+		}
+	}
+
+	s.Lock()
+	if !s.dbExists(dstName) {
+		if err := s.checkCreateAccess(c, dstName); err != nil {
+			s.Unlock()
+			return permissionReply(err)
+		}
+		s.NewDatabase(dstName)
+	}
+	dst := s.Databases[dstName]
+	s.Unlock()
+	// an unloaded dst keeps its options only if its meta is read first
+	if err := s.acquireDatabase(dst); err != nil {
+		return NewReply([][]byte{[]byte(err.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	defer releaseDatabase(dst)
+
+	dst.Lock()
+	if dst.bulkLoading() {
+		dst.Unlock()
+		return NewReply([][]byte{[]byte(bulkLoadingError(dst).Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	dst.Clear()
+	for _, m := range result {
+		dst.SetCount(m.Value, m.Count)
+	}
+	dst.OpsCount += 1
+	dst.Unlock()
+
+	err = dst.Persist(s.dbFilePath(dstName))
+	if err != nil {
+		errMsg := fmt.Sprintf("Could persist the db %s: %v", dstName, err)
+		s.Log.Println(errMsg)
+		return NewReply([][]byte{[]byte(errMsg)}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+	}
+	return NewReply([][]byte{encodeIntReply(int64(len(result)))}, COMMAND_OK, 1, []int{REPLY_TYPE_INT})
+}
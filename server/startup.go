@@ -0,0 +1,202 @@
+package tris
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fvbock/trie"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The data files found in DataDir by Initialize are loaded in the
+background once the server is started, by LoadWorkers goroutines in
+parallel. until all of them are done the server is LOADING and only
+answers the commands in LoadingCommands. everything else fails with a
+LOADING error. READY tells whether loading is done.
+
+a file that can not be loaded is skipped and logged. with
+ServerConfig.FailOnLoadError the server stops instead.
+*/
+const (
+	LOAD_STATE_LOADING = 0
+	LOAD_STATE_READY   = 1
+	LOAD_STATE_FAILED  = 2
+)
+
+var (
+	// commands that are served while the data files are loading
+	LoadingCommands = map[string]bool{
+		"INFO":     true,
+		"EXIT":     true,
+		"PING":     true,
+		"READY":    true,
+		"TIMING":   true,
+		"SHUTDOWN": true,
+		"HELP":     true,
+		"ROLE":     true,
+	}
+)
+
+/*
+LoadProgress counts the data files loaded on startup.
+*/
+type LoadProgress struct {
+	State   int32
+	Total   int64
+	Loaded  int64
+	Failed  int64
+	Started time.Time
+	Took    time.Duration
+}
+
+func (p *LoadProgress) String() string {
+	switch atomic.LoadInt32(&p.State) {
+	case LOAD_STATE_READY:
+		return fmt.Sprintf("READY %v files loaded, %v failed in %v", atomic.LoadInt64(&p.Loaded), atomic.LoadInt64(&p.Failed), p.Took)
+	case LOAD_STATE_FAILED:
+		return fmt.Sprintf("FAILED %v/%v files loaded, %v failed", atomic.LoadInt64(&p.Loaded), p.Total, atomic.LoadInt64(&p.Failed))
+	}
+	return fmt.Sprintf("LOADING %v/%v files loaded, %v failed", atomic.LoadInt64(&p.Loaded), p.Total, atomic.LoadInt64(&p.Failed))
+}
+
+/*
+Ready tells whether all data files are loaded.
+*/
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.Loading.State) == LOAD_STATE_READY
+}
+
+func (s *Server) loadingReply() *Reply {
+	return NewReply([][]byte{[]byte(s.Loading.String())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+}
+
+/*
+findDataFiles lists the trie files in DataDir.
+*/
+func (s *Server) findDataFiles() (files []string, err error) {
+	dir, err := os.Open(s.Config.DataDir)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read the data dir %s: %v", s.Config.DataDir, err))
+	}
+	defer dir.Close()
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read the data dir %s: %v", s.Config.DataDir, err))
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasSuffix(name, META_FILE_SUFFIX) || !strings.HasPrefix(name, s.Config.StorageFilePrefix) {
+			continue
+		}
+		files = append(files, name)
+	}
+	return
+}
+
+/*
+loadDataFiles loads the files found by Initialize with LoadWorkers
+goroutines and marks the server ready when done.
+*/
+func (s *Server) loadDataFiles() {
+	workers := s.Config.LoadWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	s.Loading.Started = time.Now()
+	s.Log.Printf("Loading %v data files with %v workers...\n", s.Loading.Total, workers)
+
+	files := make(chan string)
+	failed := make(chan error, 1)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fname := range files {
+				start := time.Now()
+				err := s.loadDataFile(fname)
+				if err != nil {
+					n := atomic.AddInt64(&s.Loading.Failed, 1)
+					s.Log.Printf("Error loading data file %s (%v failed): %v\n", fname, n, err)
+					if s.Config.FailOnLoadError {
+						select {
+						case failed <- errors.New(fmt.Sprintf("Could not load %s: %v", fname, err)):
+						default:
+						}
+					}
+					continue
+				}
+				n := atomic.AddInt64(&s.Loading.Loaded, 1)
+				s.Log.Printf("Loaded data file %s (%v/%v) in %v\n", fname, n, s.Loading.Total, time.Since(start))
+			}
+		}()
+	}
+	for _, fname := range s.dataFiles {
+		files <- fname
+	}
+	close(files)
+	wg.Wait()
+	s.dataFiles = nil
+	s.Loading.Took = time.Since(s.Loading.Started)
+
+	select {
+	case err := <-failed:
+		atomic.StoreInt32(&s.Loading.State, LOAD_STATE_FAILED)
+		s.Log.Printf("Loading failed: %v. Stopping the server.\n", err)
+		s.Stop()
+	default:
+		atomic.StoreInt32(&s.Loading.State, LOAD_STATE_READY)
+		s.Log.Println(s.Loading.String())
+	}
+}
+
+/*
+loadDataFile registers the database stored in fname and reads it unless
+LazyLoad is set. a database that fails to load is not registered so its
+file does not get overwritten.
+*/
+func (s *Server) loadDataFile(fname string) (err error) {
+	id := strings.TrimPrefix(fname, s.Config.StorageFilePrefix)
+	if id == "" {
+		return errors.New("Data file without a database name")
+	}
+	if err = CheckDbName(id); err != nil {
+		// e.g. left over from an interrupted SWAP
+		return errors.New(fmt.Sprintf("Not a database file: %v", err))
+	}
+	d := newDetachedDatabase(id)
+	d.PersistOpsLimit = s.Config.PersistOpsLimit
+	d.PersistInterval = s.Config.PersistInterval
+	d.clock = &s.writeClock
+	d.touch()
+	if s.Config.LazyLoad {
+		// ensureLoaded reads it on first use
+		d.dropContents()
+	} else {
+		d.Db, err = trie.LoadFromFile(s.dbFilePath(id))
+		if err != nil {
+			return
+		}
+		err = d.LoadMeta(s.dbFilePath(id) + META_FILE_SUFFIX)
+		if err != nil {
+			return
+		}
+	}
+	s.Lock()
+	if existing, exists := s.Databases[id]; exists {
+		// the default db is registered before loading. clients may
+		// already use it, so it keeps its identity
+		existing.Lock()
+		swapContents(existing, d)
+		existing.Unlock()
+	} else {
+		s.Databases[id] = d
+	}
+	s.Unlock()
+	return
+}
@@ -0,0 +1,116 @@
+package tris
+
+import (
+	"github.com/fvbock/trie"
+	"sort"
+	"strings"
+)
+
+/*
+The suffix index of a database with Options.SuffixIndex is a second trie
+holding every suffix of every key as
+
+	<suffix>\x00<key>
+
+starting at each rune boundary. all keys containing s can then be found
+under the prefix s, all keys ending with s under the prefix s\x00.
+*/
+const SUFFIX_INDEX_SEPARATOR = "\x00"
+
+/*
+SuffixIndex keeps the suffix trie and what it costs.
+*/
+type SuffixIndex struct {
+	Trie    *trie.Trie
+	Entries int64
+	Bytes   int64
+}
+
+func NewSuffixIndex() *SuffixIndex {
+	return &SuffixIndex{
+		Trie: trie.NewTrie(),
+	}
+}
+
+func (si *SuffixIndex) add(nkey string) {
+	for i := range nkey {
+		entry := nkey[i:] + SUFFIX_INDEX_SEPARATOR + nkey
+		si.Trie.Add(entry)
+		si.Entries++
+		si.Bytes += int64(len(entry))
+	}
+}
+
+func (si *SuffixIndex) remove(nkey string) {
+	for i := range nkey {
+		entry := nkey[i:] + SUFFIX_INDEX_SEPARATOR + nkey
+		if si.Trie.Delete(entry) {
+			si.Entries--
+			si.Bytes -= int64(len(entry))
+		}
+	}
+}
+
+/*
+keys returns the distinct keys of all entries starting with prefix.
+*/
+func (si *SuffixIndex) keys(prefix string) (keys []string) {
+	seen := make(map[string]bool)
+	for _, entry := range prefixKeys(si.Trie, prefix) {
+		sep := strings.Index(entry, SUFFIX_INDEX_SEPARATOR)
+		if sep < 0 {
+			continue
+		}
+		nkey := entry[sep+len(SUFFIX_INDEX_SEPARATOR):]
+		if !seen[nkey] {
+			seen[nkey] = true
+			keys = append(keys, nkey)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+/*
+RebuildSuffixIndex builds the suffix index from scratch. it drops the
+index if the database has no Options.SuffixIndex. the caller has to hold
+the write lock.
+*/
+func (d *Database) RebuildSuffixIndex() {
+	if !d.Options.SuffixIndex {
+		d.Suffixes = nil
+		return
+	}
+	d.Suffixes = NewSuffixIndex()
+	for _, m := range d.Db.Members() {
+		d.Suffixes.add(m.Value)
+	}
+}
+
+/*
+SuffixMembers returns all keys ending with suffix. the caller has to
+hold the read lock.
+*/
+func (d *Database) SuffixMembers(suffix string) []*trie.MemberInfo {
+	return d.suffixIndexMembers(d.normalize(suffix) + SUFFIX_INDEX_SEPARATOR)
+}
+
+/*
+ContainsMembers returns all keys containing sub. the caller has to hold
+the read lock.
+*/
+func (d *Database) ContainsMembers(sub string) []*trie.MemberInfo {
+	return d.suffixIndexMembers(d.normalize(sub))
+}
+
+func (d *Database) suffixIndexMembers(prefix string) (members []*trie.MemberInfo) {
+	if d.Suffixes == nil {
+		return
+	}
+	for _, nkey := range d.Suffixes.keys(prefix) {
+		if exists, count := d.hasCount(nkey); exists {
+			members = append(members, &trie.MemberInfo{Value: nkey, Count: count})
+		}
+	}
+	return
+}
@@ -6,13 +6,14 @@ import (
 	"fmt"
 	zmq "github.com/alecthomas/gozmq"
 	"github.com/fvbock/trie"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	// "runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -21,6 +22,15 @@ const (
 	VERSION    = "0.0.2"
 	DEFAULT_DB = "0"
 
+	// version of the reply rows. protocol 2 added the value field and
+	// the score of dbs with decay to member listings. connections start
+	// with MIN_PROTOCOL_VERSION and choose another version with HELLO
+	PROTOCOL_VERSION     = 2
+	MIN_PROTOCOL_VERSION = 1
+
+	// suffix of the file next to a trie file holding the DatabaseMeta
+	META_FILE_SUFFIX = ".meta"
+
 	STATE_STOP    = 1
 	STATE_STOPPED = 2
 	STATE_RUNNING = 3
@@ -38,11 +48,41 @@ type Server struct {
 	CycleLength      int64
 	cycleTicker      <-chan time.Time
 	CheckStateChange time.Duration
+	sweeping         int32
+	memoryChecking   int32
+	unloadingIdle    int32
+	// data files found by Initialize and their loading state
+	dataFiles []string
+	Loading   LoadProgress
+	// access rules of the users
+	ACL *ACL
+	// the replication log if this is a primary and the link to the
+	// primary if this is a replica
+	replLog  *replicationLog
+	replica  *replicaLink
+	replLock sync.RWMutex
+	// held by writes while they run and by role changes
+	roleLock sync.RWMutex
+	// token buckets shared by all connections of a user
+	userLimiters map[string]*rateLimiter
+	rateLock     sync.Mutex
+	// set while writes are rejected because of MaxMemory
+	memoryFull int32
+	// unix nanoseconds the databases use as the current time while a
+	// replicated write runs, 0 otherwise. accessed atomically
+	writeClock int64
+	// held by RENAME and SWAP so names do not change while they run
+	dbOpsLock sync.Mutex
+	// running bulk loads. bulkCancel is closed on shutdown
+	bulkLoads  sync.WaitGroup
+	bulkCancel chan struct{}
 
 	// zeromq
 	Context   *zmq.Context
 	Socket    *zmq.Socket
 	pollItems zmq.PollItems
+	// accepts TLS connections if TLSPort is set
+	tlsListener net.Listener
 
 	// CommandQueue  chan *ClientConnection
 	ActiveClients     map[string]*ClientConnection
@@ -62,21 +102,33 @@ func NewServer(config *ServerConfig) (s *Server, err error) {
 		CheckStateChange:  time.Second * 1,
 		ActiveClients:     make(map[string]*ClientConnection),
 		InactiveClientIds: make(chan string),
+		ACL:               NewACL(),
+		userLimiters:      make(map[string]*rateLimiter),
+		bulkCancel:        make(chan struct{}),
 		Log:               log.New(os.Stderr, "", log.LstdFlags),
 		// stats
 		RequestsRunning:   0,
 		CommandsProcessed: 0,
 	}
-	s.Initialize()
+	err = s.Initialize()
 	return
 }
 
-func (s *Server) Initialize() {
+func (s *Server) Initialize() (err error) {
 	// register commands
 	TrisCommands = append(TrisCommands, &CommandInfo{})
 	TrisCommands = append(TrisCommands, &CommandDbInfo{})
 	TrisCommands = append(TrisCommands, &CommandExit{})
 	TrisCommands = append(TrisCommands, &CommandPing{})
+	TrisCommands = append(TrisCommands, &CommandReady{})
+	TrisCommands = append(TrisCommands, &CommandHello{})
+	TrisCommands = append(TrisCommands, &CommandAuth{})
+	TrisCommands = append(TrisCommands, &CommandACL{})
+	TrisCommands = append(TrisCommands, &CommandClient{})
+	TrisCommands = append(TrisCommands, &CommandReplSync{})
+	TrisCommands = append(TrisCommands, &CommandReplFetch{})
+	TrisCommands = append(TrisCommands, &CommandReplicaOf{})
+	TrisCommands = append(TrisCommands, &CommandRole{})
 	TrisCommands = append(TrisCommands, &CommandSave{})
 	TrisCommands = append(TrisCommands, &CommandImportDb{})
 	TrisCommands = append(TrisCommands, &CommandMergeDb{})
@@ -86,9 +138,40 @@ func (s *Server) Initialize() {
 	// TrisCommands = append(TrisCommands, &CommandDropTrie{})
 	TrisCommands = append(TrisCommands, &CommandAdd{})
 	TrisCommands = append(TrisCommands, &CommandDel{})
+	TrisCommands = append(TrisCommands, &CommandMAdd{})
+	TrisCommands = append(TrisCommands, &CommandMDel{})
+	TrisCommands = append(TrisCommands, &CommandMHas{})
 	TrisCommands = append(TrisCommands, &CommandHas{})
 	TrisCommands = append(TrisCommands, &CommandHasCount{})
+	TrisCommands = append(TrisCommands, &CommandGetCount{})
+	TrisCommands = append(TrisCommands, &CommandIncrBy{})
+	TrisCommands = append(TrisCommands, &CommandSetCount{})
 	TrisCommands = append(TrisCommands, &CommandHasPrefix{})
+	TrisCommands = append(TrisCommands, &CommandDelPrefix{})
+	TrisCommands = append(TrisCommands, &CommandCountPrefix{})
+	TrisCommands = append(TrisCommands, &CommandSet{})
+	TrisCommands = append(TrisCommands, &CommandGet{})
+	TrisCommands = append(TrisCommands, &CommandPrefixGet{})
+	TrisCommands = append(TrisCommands, &CommandAddEx{})
+	TrisCommands = append(TrisCommands, &CommandExpire{})
+	TrisCommands = append(TrisCommands, &CommandTTL{})
+	TrisCommands = append(TrisCommands, &CommandPersistKey{})
+	TrisCommands = append(TrisCommands, &CommandSuffixMembers{})
+	TrisCommands = append(TrisCommands, &CommandContains{})
+	TrisCommands = append(TrisCommands, &CommandLongestPrefix{})
+	TrisCommands = append(TrisCommands, &CommandAllPrefixes{})
+	TrisCommands = append(TrisCommands, &CommandUnion{})
+	TrisCommands = append(TrisCommands, &CommandUnionStore{})
+	TrisCommands = append(TrisCommands, &CommandIntersect{})
+	TrisCommands = append(TrisCommands, &CommandIntersectStore{})
+	TrisCommands = append(TrisCommands, &CommandDiff{})
+	TrisCommands = append(TrisCommands, &CommandDiffStore{})
+	TrisCommands = append(TrisCommands, &CommandCopyDb{})
+	TrisCommands = append(TrisCommands, &CommandRenameDb{})
+	TrisCommands = append(TrisCommands, &CommandSwapDb{})
+	TrisCommands = append(TrisCommands, &CommandExportDb{})
+	TrisCommands = append(TrisCommands, &CommandBulkLoad{})
+	TrisCommands = append(TrisCommands, &CommandUpload{})
 	TrisCommands = append(TrisCommands, &CommandMembers{})
 	TrisCommands = append(TrisCommands, &CommandPrefixMembers{})
 	TrisCommands = append(TrisCommands, &CommandTree{})
@@ -97,52 +180,56 @@ func (s *Server) Initialize() {
 	TrisCommands = append(TrisCommands, &CommandHelp{})
 	s.registerCommands(TrisCommands...)
 
-	//
-
-	dataFiles, err := ioutil.ReadDir(s.Config.DataDir)
+	err = s.checkSecurityConfig()
 	if err != nil {
-
+		return
 	}
-	waitLoadDataFiles := sync.WaitGroup{}
-	for _, f := range dataFiles {
-		if !f.IsDir() {
-			waitLoadDataFiles.Add(1)
-			go func(datafile os.FileInfo) {
-				err := s.loadDataFile(datafile.Name())
-				if err != nil {
-					s.Log.Printf("Error loading trie file %s: %v\n", f.Name(), err)
-				}
-				waitLoadDataFiles.Done()
-			}(f)
-		}
+	// snapshots, downloads and uploads of an earlier run
+	os.RemoveAll(s.replSnapshotDir())
+	err = s.clearUploads()
+	if err != nil {
+		return
+	}
+	if s.Config.ReplicationBacklog > 0 && s.Config.ReplicaOf == "" {
+		s.replLog = newReplicationLog(s.Config.ReplicationBacklog, s.replSnapshotDir())
 	}
-	waitLoadDataFiles.Wait()
+	err = s.LoadACL()
+	if err != nil {
+		return
+	}
+
+	// the data files get loaded by Start
+	s.dataFiles, err = s.findDataFiles()
+	if err != nil {
+		return
+	}
+	s.Loading.Total = int64(len(s.dataFiles))
 	s.NewDatabase(DEFAULT_DB)
+	return
 }
 
 func (s *Server) NewDatabase(name string) {
-	s.Databases[name] = &Database{
+	s.Databases[name] = s.newDatabase(name)
+}
+
+/*
+newDatabase returns an empty database that is not registered.
+*/
+func (s *Server) newDatabase(name string) (d *Database) {
+	d = &Database{
 		Name:                name,
 		Db:                  trie.NewTrie(),
 		OpsCount:            0,
 		LastPersistOpsCount: 0,
 		PersistOpsLimit:     s.Config.PersistOpsLimit,
 		PersistInterval:     s.Config.PersistInterval,
+		Values:              make(map[string][]byte),
+		Expires:             make(map[string]int64),
+		Scores:              make(map[string]*DecayScore),
+		Display:             make(map[string]string),
+		clock:               &s.writeClock,
 	}
-}
-
-func (s *Server) loadDataFile(fname string) (err error) {
-	if len(fname) > len(s.Config.StorageFilePrefix) && fname[0:len(s.Config.StorageFilePrefix)] == s.Config.StorageFilePrefix {
-		id := strings.Split(fname, s.Config.StorageFilePrefix)[1]
-		s.Log.Printf("Loading Trie %s\n", id)
-		s.NewDatabase(id)
-		s.Databases[id].Db, err = trie.LoadFromFile(fmt.Sprintf("%s/%s%s", s.Config.DataDir, s.Config.StorageFilePrefix, id))
-		if err != nil {
-			return
-		}
-	} else {
-		err = errors.New("")
-	}
+	d.touch()
 	return
 }
 
@@ -171,9 +258,25 @@ func (s *Server) Start() (err error) {
 
 		}
 		s.Socket.SetSockOptInt(zmq.LINGER, 0)
-		s.Log.Println(fmt.Sprintf("Binding to %s://%s:%v", s.Config.Protocol, s.Config.Host, s.Config.Port))
-		s.Socket.Bind(fmt.Sprintf("%s://%s:%v", s.Config.Protocol, s.Config.Host, s.Config.Port))
+		err = s.bindSocket()
+		if err != nil {
+			s.Log.Printf("Could not bind: %v\n", err)
+			s.shutdown()
+			return
+		}
+		if s.tlsEnabled() {
+			err = s.startTLS()
+			if err != nil {
+				s.Log.Printf("Could not start TLS: %v\n", err)
+				s.shutdown()
+				return
+			}
+		}
 		s.Log.Println("Server started...")
+		go s.loadDataFiles()
+		if s.Config.ReplicaOf != "" {
+			s.startReplica(s.Config.ReplicaOf)
+		}
 
 		s.pollItems = zmq.PollItems{
 			zmq.PollItem{Socket: s.Socket, Events: zmq.POLLIN},
@@ -184,6 +287,24 @@ func (s *Server) Start() (err error) {
 		var cycleStart time.Time
 		s.cycleTicker = time.Tick(time.Duration(s.CycleLength) * time.Nanosecond)
 		stateTicker := time.Tick(s.CheckStateChange)
+		sweepInterval := s.Config.ExpireSweepInterval
+		if sweepInterval <= 0 {
+			sweepInterval = DEFAULT_EXPIRE_SWEEP_INTERVAL
+		}
+		sweepTicker := time.Tick(sweepInterval)
+		var memoryTicker <-chan time.Time
+		if s.Config.MaxMemory > 0 {
+			memoryInterval := s.Config.MemoryCheckInterval
+			if memoryInterval <= 0 {
+				memoryInterval = DEFAULT_MEMORY_CHECK_INTERVAL
+			}
+			memoryTicker = time.Tick(memoryInterval)
+		}
+		uploadTicker := time.Tick(UPLOAD_CHECK_INTERVAL)
+		var idleTicker <-chan time.Time
+		if s.Config.IdleUnloadTime > 0 {
+			idleTicker = time.Tick(IDLE_CHECK_INTERVAL)
+		}
 	mainLoop:
 		for {
 			// s.Log.Println("* cycle start *")
@@ -222,6 +343,14 @@ func (s *Server) Start() (err error) {
 					default:
 						// time.Sleep(1)
 					}
+				case <-sweepTicker:
+					go s.sweepExpiredKeys()
+				case <-memoryTicker:
+					go s.checkMemory()
+				case <-idleTicker:
+					go s.unloadIdleDatabases()
+				case <-uploadTicker:
+					go s.removeIdleUploads()
 				case sig := <-sigChan:
 					s.Log.Println("got signal:", sig)
 					switch sig {
@@ -268,7 +397,9 @@ beforeSleepCycle:
 		case <-s.cycleTicker:
 			break beforeSleepCycle
 		case cId := <-s.InactiveClientIds:
+			s.Lock()
 			delete(s.ActiveClients, cId)
+			s.Unlock()
 			continue
 		default:
 			break beforeSleepCycle
@@ -281,10 +412,12 @@ func (s *Server) handleRequest(msgParts [][]byte) {
 	clientKey := string(msgParts[0])
 	var c *ClientConnection
 	var unknown bool
+	s.Lock()
 	if c, unknown = s.ActiveClients[clientKey]; !unknown {
 		s.ActiveClients[clientKey] = NewClientConnection(s, msgParts[0])
 		c = s.ActiveClients[clientKey]
 	}
+	s.Unlock()
 	var execStart time.Time
 	if c.ShowExecTime {
 		execStart = time.Now()
@@ -299,24 +432,43 @@ func (s *Server) handleRequest(msgParts [][]byte) {
 	var replies []*Reply
 
 	for i, cmd := range cmds {
+		// CMD@db runs the command against db instead of the active db
+		cmd, qualifiedDb := splitDbQualifier(cmd)
 		var cmdName string = strings.ToUpper(cmd)
+		cc := c
+		var qerr error
+		// unauthenticated clients must not learn which dbs exist
+		authenticated := !s.AuthRequired() || c.Authenticated
+		if qualifiedDb != "" && authenticated {
+			cc, qerr = s.qualifiedClient(c, cmdName, qualifiedDb)
+		}
 		if _, exists := s.Commands[cmdName]; !exists {
 			// handle non existing command call
 			reply = NewReply(
 				[][]byte{[]byte(fmt.Sprintf("Unknown Command %s.", cmd))},
 				COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+		} else if !authenticated && (qualifiedDb != "" || !UnauthenticatedCommands[cmdName]) {
+			reply = noAuthReply()
+		} else if qerr != nil {
+			reply = NewReply([][]byte{[]byte(qerr.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+		} else if aerr := s.checkCommandAccess(cc, s.Commands[cmdName]); aerr != nil {
+			reply = permissionReply(aerr)
+		} else if limited := s.checkRateLimit(c, s.Commands[cmdName]); limited != nil {
+			reply = limited
+		} else if !LoadingCommands[cmdName] && !s.Ready() {
+			reply = s.loadingReply()
+		} else if COMMAND_FLAG_WRITE&s.Commands[cmdName].Flags() == COMMAND_FLAG_WRITE && !ReplicaWriteCommands[cmdName] && s.isReplica() {
+			reply = readOnlyReply()
+		} else if COMMAND_FLAG_WRITE&s.Commands[cmdName].Flags() == COMMAND_FLAG_WRITE && atomic.LoadInt32(&s.memoryFull) == 1 {
+			reply = s.memoryFullReply()
+		} else if lerr := s.acquireDatabase(cc.ActiveDb); lerr != nil {
+			reply = NewReply([][]byte{[]byte(lerr.Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
 		} else {
-			reply = s.Commands[cmdName].Function(s, c, args[i]...)
-			if reply.ReturnCode != COMMAND_OK {
-				s.Log.Println(string(reply.Payload[0]))
-			}
-			// do this even when we fail...?
-			if COMMAND_FLAG_WRITE&s.Commands[cmdName].Flags() == COMMAND_FLAG_WRITE {
-				s.Log.Println("WRITE cmd +1")
-				c.ActiveDb.Lock()
-				c.ActiveDb.OpsCount += 1
-				c.ActiveDb.Unlock()
-			}
+			atomic.AddInt64(&c.Commands, 1)
+			// SELECT changes ActiveDb
+			db := cc.ActiveDb
+			reply = s.runCommand(cmdName, cc, args[i])
+			releaseDatabase(db)
 		}
 		replies = append(replies, reply)
 		s.Lock()
@@ -342,6 +494,58 @@ func (s *Server) handleRequest(msgParts [][]byte) {
 	// runtime.GC()
 }
 
+/*
+runCommand executes cmdName for c. writes wait while the role of the
+server changes. on a primary with a replication log they run one at a
+time and get logged for the replicas.
+*/
+func (s *Server) runCommand(cmdName string, c *ClientConnection, args []interface{}) (reply *Reply) {
+	cmd := s.Commands[cmdName]
+	write := COMMAND_FLAG_WRITE&cmd.Flags() == COMMAND_FLAG_WRITE
+	var replLog *replicationLog
+	if write {
+		s.roleLock.RLock()
+		defer s.roleLock.RUnlock()
+		if !ReplicaWriteCommands[cmdName] && s.isReplica() {
+			return readOnlyReply()
+		}
+		if !BulkLoadExemptCommands[cmdName] {
+			c.ActiveDb.bulkGate.RLock()
+			defer c.ActiveDb.bulkGate.RUnlock()
+			if c.ActiveDb.bulkLoading() {
+				return NewReply([][]byte{[]byte(bulkLoadingError(c.ActiveDb).Error())}, COMMAND_FAIL, 1, []int{REPLY_TYPE_STRING})
+			}
+		}
+		if !ReplicationSkipCommands[cmdName] {
+			replLog = s.replicationLog()
+		}
+	}
+	var now int64
+	if replLog != nil {
+		replLog.writeLock.Lock()
+		defer replLog.writeLock.Unlock()
+		// the replicas apply the command with the same time
+		now = time.Now().UnixNano()
+		atomic.StoreInt64(&s.writeClock, now)
+		defer atomic.StoreInt64(&s.writeClock, 0)
+	}
+	reply = cmd.Function(s, c, args...)
+	if reply.ReturnCode != COMMAND_OK {
+		s.Log.Println(string(reply.Payload[0]))
+	}
+	// do this even when we fail...?
+	if write {
+		s.Log.Println("WRITE cmd +1")
+		c.ActiveDb.Lock()
+		c.ActiveDb.OpsCount += 1
+		c.ActiveDb.Unlock()
+	}
+	if replLog != nil && reply.ReturnCode == COMMAND_OK {
+		s.replicate(replLog, cmdName, c, args, now)
+	}
+	return
+}
+
 func (s *Server) Stop() {
 	s.Log.Println("Stopping server.")
 	s.Stateswitch <- STATE_STOP
@@ -356,6 +560,7 @@ func (s *Server) prepareShutdown() {
 		s.Log.Println("Requests running:", s.RequestsRunning)
 		time.Sleep(100 * time.Millisecond)
 	}
+	s.stopBulkLoads()
 	waitPersist := sync.WaitGroup{}
 	for _, db := range s.Databases {
 		waitPersist.Add(1)
@@ -370,6 +575,8 @@ func (s *Server) prepareShutdown() {
 
 func (s *Server) shutdown() {
 	s.Log.Println("Server teardown.")
+	s.stopTLS()
+	s.stopReplica()
 	s.Socket.Close()
 	s.Log.Println("Socket closed.")
 	s.Context.Close()
@@ -390,6 +597,13 @@ func (s *Server) registerCommands(cmds ...Command) (err error) {
 	return
 }
 
+/*
+dbFilePath returns the path of the trie file of the database name.
+*/
+func (s *Server) dbFilePath(name string) string {
+	return fmt.Sprintf("%s/%s%s", s.Config.DataDir, s.Config.StorageFilePrefix, name)
+}
+
 func (s *Server) dbExists(name string) bool {
 	if _, exists := s.Databases[name]; !exists {
 		return false
@@ -0,0 +1,126 @@
+package tris
+
+import (
+	"bytes"
+	"github.com/fvbock/trie"
+)
+
+/*
+The walk functions work directly on the exported Branch fields of a
+trie: a key is the concatenation of the LeafValues and Branches indices
+along its path, Branch.End marks a member.
+
+All of them read lock the branches they visit. The trie itself can still
+be modified concurrently, so callers that need a consistent view have to
+hold the Database lock.
+*/
+
+/*
+findPrefixBranch returns the branch under which all members starting with
+prefix live and the key bytes up to and including that branches
+LeafValue. it returns nil if no key starts with prefix.
+*/
+func findPrefixBranch(t *trie.Trie, prefix []byte) (b *trie.Branch, path []byte) {
+	b = t.Root
+	for b != nil {
+		b.RLock()
+		lv := b.LeafValue
+		n := len(lv)
+		if len(prefix) < n {
+			n = len(prefix)
+		}
+		if !bytes.Equal(lv[:n], prefix[:n]) {
+			b.RUnlock()
+			return nil, nil
+		}
+		path = append(path, lv...)
+		if len(prefix) <= len(lv) {
+			b.RUnlock()
+			return
+		}
+		prefix = prefix[len(lv):]
+		next, ok := b.Branches[prefix[0]]
+		b.RUnlock()
+		if !ok {
+			return nil, nil
+		}
+		path = append(path, prefix[0])
+		prefix = prefix[1:]
+		b = next
+	}
+	return nil, nil
+}
+
+/*
+walkBranch calls fn for every member in the subtree of b. path has to be
+the key bytes up to and including the LeafValue of b. fn must not keep
+the key slice around without copying it.
+*/
+func walkBranch(b *trie.Branch, path []byte, fn func(key []byte, b *trie.Branch)) {
+	b.RLock()
+	defer b.RUnlock()
+	if b.End {
+		fn(path, b)
+	}
+	for idx, child := range b.Branches {
+		childPath := make([]byte, 0, len(path)+1+len(child.LeafValue))
+		childPath = append(childPath, path...)
+		childPath = append(childPath, idx)
+		child.RLock()
+		childPath = append(childPath, child.LeafValue...)
+		child.RUnlock()
+		walkBranch(child, childPath, fn)
+	}
+}
+
+/*
+walkPrefix calls fn for every member of t that starts with prefix.
+*/
+func walkPrefix(t *trie.Trie, prefix string, fn func(key []byte, b *trie.Branch)) {
+	b, path := findPrefixBranch(t, []byte(prefix))
+	if b == nil {
+		return
+	}
+	walkBranch(b, path, fn)
+}
+
+/*
+prefixKeys returns all member keys of t starting with prefix.
+*/
+func prefixKeys(t *trie.Trie, prefix string) (keys []string) {
+	walkPrefix(t, prefix, func(key []byte, b *trie.Branch) {
+		keys = append(keys, string(key))
+	})
+	return
+}
+
+/*
+walkPrefixesOf calls fn for every member of t that is a prefix of input,
+shortest first.
+*/
+func walkPrefixesOf(t *trie.Trie, input []byte, fn func(key []byte, b *trie.Branch)) {
+	var path []byte
+	b := t.Root
+	for b != nil {
+		b.RLock()
+		lv := b.LeafValue
+		if len(lv) > len(input) || !bytes.Equal(lv, input[:len(lv)]) {
+			b.RUnlock()
+			return
+		}
+		path = append(path, lv...)
+		input = input[len(lv):]
+		if b.End {
+			fn(path, b)
+		}
+		if len(input) == 0 {
+			b.RUnlock()
+			return
+		}
+		next := b.Branches[input[0]]
+		b.RUnlock()
+		path = append(path, input[0])
+		input = input[1:]
+		b = next
+	}
+}
@@ -0,0 +1,25 @@
+package tris
+
+import (
+	"io"
+	"net"
+)
+
+/*
+Pipe copies between a and b in both directions until one side is done
+and then closes both.
+*/
+func Pipe(a net.Conn, b net.Conn) {
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- true
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- true
+	}()
+	<-done
+	a.Close()
+	b.Close()
+}